@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"os"
@@ -18,7 +19,8 @@ import (
 var usage = `
 Usage:
 
-    ping [-c count] [-i interval] [-t timeout] [-cw workers] [-cb buffersize] [-w workers] [-b buffer] [-r] [-d] [-m] host host2 host3
+    ping [-c count] [-i interval] [-t timeout] [-cw workers] [-cb buffersize] [-w workers] [-b buffer] [-r] [-d] [-p pps] [-l latewindow] [-a] [-m] host host2 host3
+    ping serve [-l address] [-i interval] [-t timeout] [-w workers] [-r reresolve] [-L name=value,...] [-f file] host host2 host3
 
 Examples:
 
@@ -33,15 +35,32 @@ Examples:
 
     # ping google with a 500ms timeout re-resolving dns every ping
     ping -t 500ms -r www.google.com
+
+    # ping many hosts, spread randomly across the interval, at no more than 1000 pings per second
+    ping -d -p 1000 10.0.0.1 10.0.0.2 10.0.0.3
+
+    # drop replies that were not sent in reply to this process, such as spoofed ones
+    ping -a www.google.com
+
+    # serve prometheus metrics for google on port 9374
+    ping serve -l :9374 www.google.com
 `
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+
 	timeout := flag.Duration("t", time.Second, "")
 	interval := flag.Duration("i", time.Second, "")
 	count := flag.Int("c", 0, "")
 	workers := flag.Int("w", 1, "")
 	reResolve := flag.Int("r", 1, "")
-	//randDelay := flag.Bool("d", false, "")
+	randDelay := flag.Bool("d", false, "")
+	rate := flag.Int("p", 0, "")
+	late := flag.Duration("l", 0, "")
+	auth := flag.Bool("a", false, "")
 	manual := flag.Bool("m", false, "")
 	flood := flag.Bool("f", false, "")
 	quiet := flag.Bool("q", false, "")
@@ -66,6 +85,18 @@ func main() {
 	var recieved, dropped, errored int64
 
 	handle := func(pkt *ping.Ping, err error) {
+		if pkt.Late {
+			if !*quiet {
+				fmt.Printf("Late reply from %v rtt: %v seq: %v id: %v count: %v\n", pkt.Src.String(), pkt.RTT(), pkt.Seq, pkt.ID, pkt.Count)
+			}
+			return
+		}
+		if pkt.Duplicate {
+			if !*quiet {
+				fmt.Printf("%v bytes from %v rtt: %v ttl: %v seq: %v id: %v count: %v (DUP!)\n", pkt.Len, pkt.Src.String(), pkt.RTT(), pkt.TTL, pkt.Seq, pkt.ID, pkt.Count)
+			}
+			return
+		}
 		if err == nil {
 			atomic.AddInt64(&recieved, 1)
 			if !*quiet {
@@ -88,7 +119,23 @@ func main() {
 		}
 	}
 
+	stats := ping.NewStats()
+	handle = stats.Wrap(handle)
+
 	ping.DefaultSocket().SetWorkers(*workers)
+	if *randDelay {
+		ping.DefaultSocket().SetStagger(ping.StaggerRandom)
+	}
+	ping.DefaultSocket().SetScheduleRate(*rate)
+	ping.DefaultSocket().SetLateWindow(*late)
+	if *auth {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		ping.DefaultSocket().SetSecret(secret)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -149,5 +196,14 @@ func main() {
 	}
 
 	wg.Wait()
+	for _, dst := range stats.Destinations() {
+		s := stats.Summary(dst)[0]
+		fmt.Printf("--- %v ping statistics ---\n", dst)
+		fmt.Printf("%v sent, %v recieved, %v lost, %v late, %v duplicates, %v out of order, %v errored, %.1f%% loss\n", s.Sent, s.Recieved, s.Lost, s.Late, s.Duplicates, s.OutOfOrder, s.Errors, s.Loss()*100)
+		fmt.Printf("rtt min/avg/max/mdev = %v/%v/%v/%v jitter %v\n", s.Min, s.Avg, s.Max, s.StdDev, s.Jitter)
+	}
 	fmt.Printf("%v recieved, %v dropped, %v errored\n", atomic.LoadInt64(&recieved), atomic.LoadInt64(&dropped), atomic.LoadInt64(&errored))
+	if *auth {
+		fmt.Printf("%v unauthenticated replies dropped\n", ping.DefaultSocket().Stats().Unauthenticated)
+	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping"
+	"github.com/TrilliumIT/go-multiping/ping/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var serveUsage = `
+Usage:
+
+    ping serve [-l address] [-i interval] [-t timeout] [-w workers] [-r reresolve] [-L name=value,...] [-f file] host host2 host3
+
+Serves prometheus metrics for the hosts at /metrics.
+Labels set with -L are added to the metrics of every host.
+
+Hosts can also be read from a file with -f, one per line followed by optional
+name=value labels. Blank lines and lines starting with # are ignored.
+The file is read again on SIGHUP, adding and removing hosts without a restart.
+Label names are fixed at startup, a reload adding new label names is rejected.
+
+Errors pinging a host are printed when they first happen or change.
+
+Examples:
+
+    # serve metrics for two hosts on port 9374
+    ping serve -l :9374 www.google.com 8.8.8.8
+
+    # ping every 500ms and add a site label
+    ping serve -i 500ms -L site=home www.google.com
+
+    # ping the hosts in targets.txt, reload with kill -HUP
+    ping serve -f targets.txt
+`
+
+func parseLabels(kvs []string, labels map[string]string) error {
+	for _, kv := range kvs {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return fmt.Errorf("invalid label %q", kv)
+		}
+		labels[p[0]] = p[1]
+	}
+	return nil
+}
+
+// readTargets reads hosts and their labels from a file
+func readTargets(file string, common map[string]string) (map[string]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := map[string]map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		labels := map[string]string{}
+		for k, v := range common {
+			labels[k] = v
+		}
+		if err := parseLabels(fields[1:], labels); err != nil {
+			return nil, err
+		}
+		r[fields[0]] = labels
+	}
+	return r, sc.Err()
+}
+
+// labelNames returns the sorted names of the labels of targets
+func labelNames(targets map[string]map[string]string) []string {
+	nameSet := map[string]bool{}
+	for _, labels := range targets {
+		for k := range labels {
+			nameSet[k] = true
+		}
+	}
+	var names []string
+	for k := range nameSet {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLabels returns the label names of targets that are not in names
+func newLabels(targets map[string]map[string]string, names []string) []string {
+	var r []string
+	for _, n := range labelNames(targets) {
+		if i := sort.SearchStrings(names, n); i == len(names) || names[i] != n {
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("l", ":9374", "")
+	interval := fs.Duration("i", time.Second, "")
+	timeout := fs.Duration("t", time.Second, "")
+	workers := fs.Int("w", 1, "")
+	reResolve := fs.Int("r", 1, "")
+	labelFlag := fs.String("L", "", "")
+	file := fs.String("f", "", "")
+	fs.Usage = func() {
+		fmt.Print(serveUsage)
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 && *file == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	common := map[string]string{}
+	if *labelFlag != "" {
+		if err := parseLabels(strings.Split(*labelFlag, ","), common); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	load := func() (map[string]map[string]string, error) {
+		targets := map[string]map[string]string{}
+		if *file != "" {
+			var err error
+			if targets, err = readTargets(*file, common); err != nil {
+				return nil, err
+			}
+		}
+		for _, host := range fs.Args() {
+			targets[host] = common
+		}
+		return targets, nil
+	}
+	targets, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// label names are fixed when the exporter is created, from the targets at startup
+	names := labelNames(targets)
+
+	// a failing host is printed when its error changes, not every interval
+	var errL sync.Mutex
+	lastErr := map[string]string{}
+	onError := func(t exporter.Target, err error) {
+		errL.Lock()
+		defer errL.Unlock()
+		if lastErr[t.Host] == err.Error() {
+			return
+		}
+		lastErr[t.Host] = err.Error()
+		fmt.Fprintf(os.Stderr, "pinging %v: %v\n", t.Host, err)
+	}
+
+	s := ping.NewSocket()
+	s.SetWorkers(*workers)
+	s.SetStagger(ping.StaggerHash)
+	e := exporter.New(s, &exporter.Options{Labels: names, OnError: onError})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	m := s.NewMonitor()
+	apply := func(targets map[string]map[string]string) {
+		current := map[string]*ping.Target{}
+		for _, t := range m.Targets() {
+			current[t.Host] = t
+			if _, ok := targets[t.Host]; !ok {
+				_ = m.Remove(t.Host)
+				e.Remove(exporter.Target{Host: t.Host, Labels: t.Labels})
+			}
+		}
+		for host, labels := range targets {
+			old, ok := current[host]
+			if ok && reflect.DeepEqual(old.Labels, labels) {
+				continue
+			}
+			h, err := e.Handler(exporter.Target{Host: host, Labels: labels})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %v: %v\n", host, err)
+				continue
+			}
+			t := &ping.Target{
+				Host:           host,
+				Interval:       *interval,
+				Timeout:        *timeout,
+				ReResolveEvery: *reResolve,
+				Labels:         labels,
+				Handler:        h,
+			}
+			if !ok {
+				_ = m.Add(t)
+				continue
+			}
+			_ = m.Update(t)
+			e.Remove(exporter.Target{Host: host, Labels: old.Labels})
+		}
+	}
+	apply(targets)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			targets, err := load()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "reloading targets: %v\n", err)
+				continue
+			}
+			if n := newLabels(targets, names); len(n) > 0 {
+				fmt.Fprintf(os.Stderr, "reloading targets: new labels %v need a restart\n", strings.Join(n, ","))
+				continue
+			}
+			apply(targets)
+		}
+	}()
+
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	if err := http.ListenAndServe(*listen, nil); err != nil {
+		panic(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
 	"github.com/TrilliumIT/go-multiping/ping/internal/socket"
 )
 
@@ -15,6 +16,7 @@ type ipConn struct {
 	id      ping.ID
 	timeout time.Duration
 	handle  func(*ping.Ping, error)
+	payload payload
 }
 
 // ErrNoIDs is returned when there are no icmp ids left to use
@@ -26,24 +28,45 @@ var ErrNoIDs = socket.ErrNoIDs
 // ErrTimedOut is returned when a ping times out
 var ErrTimedOut = socket.ErrTimedOut
 
+// ErrTruncated is returned when a reply contains less data than the echo request
+var ErrTruncated = ping.ErrTruncated
+
+// ErrCorrupted is returned when the data in a reply does not match the echo request
+var ErrCorrupted = ping.ErrCorrupted
+
+// UnreachableError is returned when a destination unreachable message is
+// recieved in response to an echo request
+type UnreachableError = ping.UnreachableError
+
+// TimeExceededError is returned when a time exceeded message is recieved in
+// response to an echo request
+type TimeExceededError = ping.TimeExceededError
+
+// ParameterProblemError is returned when a parameter problem message is
+// recieved in response to an echo request
+type ParameterProblemError = ping.ParameterProblemError
+
 func (s *Socket) newIPConn(dst *net.IPAddr, handle func(*ping.Ping, error), timeout time.Duration) (*IPConn, error) {
 	c := &IPConn{
-		count: -1,
+		count:    -1,
+		hist:     NewHistogram(),
+		counters: &connCounters{},
 	}
 	var err error
-	c.ipc, err = s.newipConn(dst, handle, timeout)
+	c.ipc, err = s.newipConn(dst, c.counters.wrap(c.hist.wrap(handle)), timeout, payload{})
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
-func (s *Socket) newipConn(dst *net.IPAddr, handle func(*ping.Ping, error), timeout time.Duration) (*ipConn, error) {
+func (s *Socket) newipConn(dst *net.IPAddr, handle func(*ping.Ping, error), timeout time.Duration, pl payload) (*ipConn, error) {
 	ipc := &ipConn{
 		dst:     dst,
 		timeout: timeout,
 		s:       s,
 		handle:  handle,
+		payload: pl,
 	}
 	var err error
 	ipc.id, err = s.s.Add(dst, ipc.handle)
@@ -55,6 +78,7 @@ func (c *ipConn) close() error {
 		return nil
 	}
 	defer func() { c.s = nil }() // make anybody who tries to send after close panic
+	c.s.leaks.del(c)
 	return c.s.s.Del(c.dst.IP, c.id)
 }
 
@@ -65,10 +89,24 @@ func (c *ipConn) drain() {
 	c.s.s.Drain(c.dst.IP, c.id)
 }
 
+// setOrder makes the handler calls of c in the order o
+func (c *ipConn) setOrder(o *seqmap.Order) error {
+	return c.s.s.SetOrder(c.dst.IP, c.id, o)
+}
+
 // ErrNotRunning is returned if a ping is set to a closed connection.
 var ErrNotRunning = conn.ErrNotRunning
 
+// ErrTTLNotSupported is returned when sending with a ttl on a platform that does not support it.
+var ErrTTLNotSupported = conn.ErrTTLNotSupported
+
+// sendPing sends p. If the socket is closed p was never added to the connection,
+// so it is not waited for by drain or ordered by setOrder. It is handled with the
+// error here, on the calling goroutine.
 func (c *ipConn) sendPing(p *ping.Ping) {
 	p.Dst, p.ID, p.TimeOut = c.dst, c.id, c.timeout
-	c.s.s.SendPing(p)
+	p.HeaderLen, p.Data = c.payload.hl, c.payload.data
+	if err := c.s.s.SendPing(p); err != nil {
+		c.handle(p, err)
+	}
 }
@@ -0,0 +1,59 @@
+package ping
+
+import (
+	"sync/atomic"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// ConnStats counts the results of the pings sent on a connection
+type ConnStats struct {
+	// Recieved is the number of pings that were replied to
+	Recieved uint64
+	// TimedOut is the number of pings that timed out
+	TimedOut uint64
+	// Errors is the number of pings handled with an error other than ErrTimedOut
+	Errors uint64
+	// Late is the number of replies recieved after the ping timed out, within the late window of the socket
+	Late uint64
+	// Duplicates is the number of duplicate replies
+	Duplicates uint64
+	// OutOfOrder is the number of replies recieved after the reply to a later ping
+	OutOfOrder uint64
+}
+
+type connCounters struct {
+	recieved, timedOut, errors, late, duplicates, outOfOrder uint64
+}
+
+func (c *connCounters) wrap(next func(*ping.Ping, error)) func(*ping.Ping, error) {
+	return func(p *ping.Ping, err error) {
+		switch {
+		case p.Late:
+			atomic.AddUint64(&c.late, 1)
+		case p.Duplicate:
+			atomic.AddUint64(&c.duplicates, 1)
+		case err == nil:
+			atomic.AddUint64(&c.recieved, 1)
+		case err == ErrTimedOut:
+			atomic.AddUint64(&c.timedOut, 1)
+		default:
+			atomic.AddUint64(&c.errors, 1)
+		}
+		if p.OutOfOrder {
+			atomic.AddUint64(&c.outOfOrder, 1)
+		}
+		next(p, err)
+	}
+}
+
+func (c *connCounters) stats() *ConnStats {
+	return &ConnStats{
+		Recieved:   atomic.LoadUint64(&c.recieved),
+		TimedOut:   atomic.LoadUint64(&c.timedOut),
+		Errors:     atomic.LoadUint64(&c.errors),
+		Late:       atomic.LoadUint64(&c.late),
+		Duplicates: atomic.LoadUint64(&c.duplicates),
+		OutOfOrder: atomic.LoadUint64(&c.outOfOrder),
+	}
+}
@@ -0,0 +1,391 @@
+// Package exporter exports ping results as prometheus metrics.
+//
+// An Exporter records the results of pings as per target metrics, and
+// reports the internal state of the socket the pings are sent on.
+// Register the exporter with a prometheus registry, then either pass the
+// HandleFunc returned by Handler to your own pings, or use Run to ping a set of targets.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "ping"
+
+// TargetLabel is the label holding the target of each per target metric
+const TargetLabel = "target"
+
+// Options configures an Exporter
+type Options struct {
+	// Labels are the names of the user defined labels added to each per target metric
+	Labels []string
+	// Buckets are the RTT histogram buckets, in seconds
+	Buckets []float64
+	// Interval is how often each target is pinged by Run
+	Interval time.Duration
+	// Timeout is how long Run waits for a reply
+	Timeout time.Duration
+	// ReResolveEvery is how many pings Run sends before resolving a target again.
+	// Zero resolves once.
+	ReResolveEvery int
+	// OnError is called with the errors of pings to a target other than timeouts, such as
+	// failing to resolve it, as they are handled. It must not block.
+	OnError func(Target, error)
+}
+
+// DefaultOptions returns the options used for any unset fields in the options passed to New
+func DefaultOptions() *Options {
+	return &Options{
+		Buckets:        prometheus.ExponentialBuckets(0.00005, 2, 20),
+		Interval:       time.Second,
+		Timeout:        time.Second,
+		ReResolveEvery: 1,
+	}
+}
+
+// Target is a host to be pinged
+type Target struct {
+	// Host is the hostname or ip address to ping. It is the value of the target label.
+	Host string
+	// Labels are the values of the user defined labels. Labels that are not set are empty.
+	Labels map[string]string
+}
+
+// ErrUnknownLabel is returned when a target has a label that was not passed to New
+var ErrUnknownLabel = errors.New("unknown label")
+
+// Exporter is a prometheus.Collector for ping results
+type Exporter struct {
+	s      *ping.Socket
+	opts   *Options
+	labels []string
+
+	rtt        *prometheus.HistogramVec
+	sent       *prometheus.CounterVec
+	received   *prometheus.CounterVec
+	timeouts   *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	late       *prometheus.CounterVec
+	duplicates *prometheus.CounterVec
+	outOfOrder *prometheus.CounterVec
+	lastSeen   *prometheus.GaugeVec
+
+	endpoints       *prometheus.Desc
+	pendingTimeouts *prometheus.Desc
+	latePending     *prometheus.Desc
+	workers         *prometheus.Desc
+	pending         *prometheus.Desc
+	timeoutsFired   *prometheus.Desc
+	packetsRead     *prometheus.Desc
+	packetsSent     *prometheus.Desc
+	parseErrors     *prometheus.Desc
+	sendRetries     *prometheus.Desc
+	unmatched       *prometheus.Desc
+	rateLimited     *prometheus.Desc
+	unauthenticated *prometheus.Desc
+	queueDepth      *prometheus.Desc
+	queueDropped    *prometheus.Desc
+}
+
+// New creates an Exporter for pings sent on s.
+// If s is nil the default socket is used.
+func New(s *ping.Socket, opts *Options) *Exporter {
+	if s == nil {
+		s = ping.DefaultSocket()
+	}
+	o := DefaultOptions()
+	if opts != nil {
+		o.Labels = opts.Labels
+		if len(opts.Buckets) > 0 {
+			o.Buckets = opts.Buckets
+		}
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+		o.ReResolveEvery = opts.ReResolveEvery
+		o.OnError = opts.OnError
+	}
+	labels := append([]string{TargetLabel}, o.Labels...)
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: name, Help: help,
+		}, labels)
+	}
+	return &Exporter{
+		s:      s,
+		opts:   o,
+		labels: labels,
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rtt_seconds",
+			Help:      "Round trip time of echo replies.",
+			Buckets:   o.Buckets,
+		}, labels),
+		sent:       counter("sent_total", "Echo requests sent, counted when they are handled."),
+		received:   counter("received_total", "Echo replies received."),
+		timeouts:   counter("timeouts_total", "Echo requests that timed out."),
+		errors:     counter("errors_total", "Echo requests that failed with an error other than a timeout."),
+		late:       counter("late_replies_total", "Echo replies received after the request timed out, within the socket late window."),
+		duplicates: counter("duplicates_total", "Duplicate echo replies."),
+		outOfOrder: counter("out_of_order_total", "Echo replies received after the reply to a later request."),
+		lastSeen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_seen_timestamp_seconds",
+			Help:      "Time the last echo reply was received.",
+		}, labels),
+		endpoints: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "endpoints"),
+			"Active destination and ICMP ID pairs on the socket.",
+			[]string{"family"}, nil,
+		),
+		pendingTimeouts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "pending_timeouts"),
+			"Sent echo requests waiting for a reply or timeout.",
+			[]string{"family"}, nil,
+		),
+		latePending: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "late_pending"),
+			"Timed out echo requests that a late reply would still be matched to.",
+			[]string{"family"}, nil,
+		),
+		workers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "workers"),
+			"Workers reading replies from the socket.",
+			[]string{"family"}, nil,
+		),
+		pending: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "pending"),
+			"Sent echo requests waiting to be matched to a reply.",
+			[]string{"family"}, nil,
+		),
+		timeoutsFired: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "timeouts_total"),
+			"Timeouts fired on the socket.",
+			[]string{"family"}, nil,
+		),
+		packetsRead: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "packets_read_total"),
+			"Packets read from the socket.",
+			[]string{"family"}, nil,
+		),
+		packetsSent: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "packets_sent_total"),
+			"Echo requests written to the socket.",
+			[]string{"family"}, nil,
+		),
+		parseErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "parse_errors_total"),
+			"Packets read from the socket that were not echo replies or errors about an echo request.",
+			[]string{"family", "error"}, nil,
+		),
+		sendRetries: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "send_retries_total"),
+			"Writes retried because the kernel was out of buffer space.",
+			[]string{"family"}, nil,
+		),
+		unmatched: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "unmatched_total"),
+			"Replies that did not match an endpoint, or a pending echo request of the endpoint.",
+			[]string{"family", "reason"}, nil,
+		),
+		rateLimited: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "rate_limited_total"),
+			"Echo requests delayed or failed by the socket rate limits.",
+			nil, nil,
+		),
+		unauthenticated: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "unauthenticated_total"),
+			"Replies dropped because they did not carry a valid MAC for the socket secret.",
+			nil, nil,
+		),
+		queueDepth: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "queue_depth"),
+			"Pings waiting in the queue for a handler.",
+			nil, nil,
+		),
+		queueDropped: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "socket", "queue_dropped_total"),
+			"Pings dropped without being handled because the handler queue was full.",
+			nil, nil,
+		),
+	}
+}
+
+func (e *Exporter) labelValues(t Target) ([]string, error) {
+	v := make([]string, len(e.labels))
+	v[0] = t.Host
+	n := 0
+	for i, l := range e.labels[1:] {
+		if lv, ok := t.Labels[l]; ok {
+			v[i+1] = lv
+			n++
+		}
+	}
+	if n != len(t.Labels) {
+		return nil, ErrUnknownLabel
+	}
+	return v, nil
+}
+
+// Handler returns a HandleFunc that records results as the metrics for t
+func (e *Exporter) Handler(t Target) (ping.HandleFunc, error) {
+	lv, err := e.labelValues(t)
+	if err != nil {
+		return nil, err
+	}
+	rtt := e.rtt.WithLabelValues(lv...)
+	sent := e.sent.WithLabelValues(lv...)
+	received := e.received.WithLabelValues(lv...)
+	timeouts := e.timeouts.WithLabelValues(lv...)
+	errs := e.errors.WithLabelValues(lv...)
+	late := e.late.WithLabelValues(lv...)
+	dups := e.duplicates.WithLabelValues(lv...)
+	ooo := e.outOfOrder.WithLabelValues(lv...)
+	lastSeen := e.lastSeen.WithLabelValues(lv...)
+	return func(p *ping.Ping, err error) {
+		switch {
+		case p.Late:
+			late.Inc()
+			return
+		case p.Duplicate:
+			dups.Inc()
+			return
+		case p.OutOfOrder:
+			ooo.Inc()
+		}
+		sent.Inc()
+		switch err {
+		case nil:
+			received.Inc()
+			rtt.Observe(p.RTT().Seconds())
+			lastSeen.Set(float64(p.Recieved.UnixNano()) / 1e9)
+		case ping.ErrTimedOut:
+			timeouts.Inc()
+		default:
+			errs.Inc()
+			if e.opts.OnError != nil {
+				e.opts.OnError(t, err)
+			}
+		}
+	}, nil
+}
+
+// Remove deletes the metrics for t
+func (e *Exporter) Remove(t Target) {
+	lv, err := e.labelValues(t)
+	if err != nil {
+		return
+	}
+	for _, v := range []interface {
+		DeleteLabelValues(...string) bool
+	}{e.rtt, e.sent, e.received, e.timeouts, e.errors, e.late, e.duplicates, e.outOfOrder, e.lastSeen} {
+		v.DeleteLabelValues(lv...)
+	}
+}
+
+// Run pings each target every interval until ctx is canceled.
+// If pinging any target fails, the others are stopped and its error is returned.
+// Errors of individual pings are reported to Options.OnError.
+func (e *Exporter) Run(ctx context.Context, targets []Target) error {
+	handlers := make([]ping.HandleFunc, len(targets))
+	for i, t := range targets {
+		h, err := e.Handler(t)
+		if err != nil {
+			return err
+		}
+		handlers[i] = h
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, len(targets))
+	for i, t := range targets {
+		go func(host string, h ping.HandleFunc) {
+			errCh <- e.s.HostInterval(ctx, host, e.opts.ReResolveEvery, h, 0, e.opts.Interval, e.opts.Timeout)
+		}(t.Host, handlers[i])
+	}
+	var err error
+	for range targets {
+		if tErr := <-errCh; tErr != nil && err == nil {
+			// the first error stops the others, rather than waiting for ctx
+			err = tErr
+			cancel()
+		}
+	}
+	return err
+}
+
+// Describe implements prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.rtt.Describe(ch)
+	e.sent.Describe(ch)
+	e.received.Describe(ch)
+	e.timeouts.Describe(ch)
+	e.errors.Describe(ch)
+	e.late.Describe(ch)
+	e.duplicates.Describe(ch)
+	e.outOfOrder.Describe(ch)
+	e.lastSeen.Describe(ch)
+	ch <- e.endpoints
+	ch <- e.pendingTimeouts
+	ch <- e.latePending
+	ch <- e.workers
+	ch <- e.pending
+	ch <- e.timeoutsFired
+	ch <- e.packetsRead
+	ch <- e.packetsSent
+	ch <- e.parseErrors
+	ch <- e.sendRetries
+	ch <- e.unmatched
+	ch <- e.rateLimited
+	ch <- e.unauthenticated
+	ch <- e.queueDepth
+	ch <- e.queueDropped
+}
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.rtt.Collect(ch)
+	e.sent.Collect(ch)
+	e.received.Collect(ch)
+	e.timeouts.Collect(ch)
+	e.errors.Collect(ch)
+	e.late.Collect(ch)
+	e.duplicates.Collect(ch)
+	e.outOfOrder.Collect(ch)
+	e.lastSeen.Collect(ch)
+
+	st := e.s.Stats()
+	for _, f := range []struct {
+		family string
+		s      ping.SocketFamilyStats
+	}{{"ipv4", st.V4}, {"ipv6", st.V6}} {
+		ch <- prometheus.MustNewConstMetric(e.endpoints, prometheus.GaugeValue, float64(f.s.Endpoints), f.family)
+		ch <- prometheus.MustNewConstMetric(e.pendingTimeouts, prometheus.GaugeValue, float64(f.s.PendingTimeouts), f.family)
+		ch <- prometheus.MustNewConstMetric(e.latePending, prometheus.GaugeValue, float64(f.s.LatePending), f.family)
+		ch <- prometheus.MustNewConstMetric(e.workers, prometheus.GaugeValue, float64(f.s.Workers), f.family)
+		ch <- prometheus.MustNewConstMetric(e.pending, prometheus.GaugeValue, float64(f.s.Pending), f.family)
+		ch <- prometheus.MustNewConstMetric(e.timeoutsFired, prometheus.CounterValue, float64(f.s.TimedOut), f.family)
+		ch <- prometheus.MustNewConstMetric(e.packetsRead, prometheus.CounterValue, float64(f.s.Read), f.family)
+		ch <- prometheus.MustNewConstMetric(e.packetsSent, prometheus.CounterValue, float64(f.s.Sent), f.family)
+		ch <- prometheus.MustNewConstMetric(e.parseErrors, prometheus.CounterValue, float64(f.s.TooShort), f.family, "too_short")
+		ch <- prometheus.MustNewConstMetric(e.parseErrors, prometheus.CounterValue, float64(f.s.Malformed), f.family, "malformed")
+		ch <- prometheus.MustNewConstMetric(e.parseErrors, prometheus.CounterValue, float64(f.s.WrongType), f.family, "wrong_type")
+		ch <- prometheus.MustNewConstMetric(e.parseErrors, prometheus.CounterValue, float64(f.s.NotEcho), f.family, "not_echo")
+		ch <- prometheus.MustNewConstMetric(e.sendRetries, prometheus.CounterValue, float64(f.s.SendRetries), f.family)
+		ch <- prometheus.MustNewConstMetric(e.unmatched, prometheus.CounterValue, float64(f.s.UnmatchedEndpoint), f.family, "endpoint")
+		ch <- prometheus.MustNewConstMetric(e.unmatched, prometheus.CounterValue, float64(f.s.UnmatchedSeq), f.family, "seq")
+	}
+	ch <- prometheus.MustNewConstMetric(e.rateLimited, prometheus.CounterValue, float64(st.RateLimited))
+	ch <- prometheus.MustNewConstMetric(e.unauthenticated, prometheus.CounterValue, float64(st.Unauthenticated))
+	ch <- prometheus.MustNewConstMetric(e.queueDepth, prometheus.GaugeValue, float64(st.QueueDepth))
+	ch <- prometheus.MustNewConstMetric(e.queueDropped, prometheus.CounterValue, float64(st.QueueDropped))
+}
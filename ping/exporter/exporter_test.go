@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, e *Exporter) string {
+	r := prometheus.NewRegistry()
+	assert.NoError(t, r.Register(e))
+	srv := httptest.NewServer(promhttp.HandlerFor(r, promhttp.HandlerOpts{}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestExporterRun(t *testing.T) {
+	assert := assert.New(t)
+	e := New(ping.NewSocket(), &Options{Labels: []string{"site"}, Interval: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 275*time.Millisecond)
+	defer cancel()
+	assert.NoError(e.Run(ctx, []Target{
+		{Host: "127.0.0.1", Labels: map[string]string{"site": "lo"}},
+		{Host: "::1"},
+	}))
+
+	m := scrape(t, e)
+	assert.Regexp(`ping_received_total{site="lo",target="127.0.0.1"} [1-9]`, m)
+	assert.Regexp(`ping_sent_total{site="lo",target="127.0.0.1"} [1-9]`, m)
+	assert.Regexp(`ping_received_total{site="",target="::1"} [1-9]`, m)
+	assert.Regexp(`ping_rtt_seconds_count{site="",target="::1"} [1-9]`, m)
+	assert.Contains(m, `ping_timeouts_total{site="",target="::1"} 0`)
+	assert.Contains(m, `ping_last_seen_timestamp_seconds{site="lo",target="127.0.0.1"}`)
+	assert.Contains(m, `ping_socket_endpoints{family="ipv4"} 0`)
+	assert.Contains(m, `ping_socket_pending_timeouts{family="ipv6"} 0`)
+	assert.Contains(m, `ping_socket_workers{family="ipv6"} 0`)
+	assert.Contains(m, `ping_socket_rate_limited_total 0`)
+	assert.Contains(m, `ping_socket_unauthenticated_total 0`)
+	assert.Contains(m, `ping_socket_queue_dropped_total 0`)
+	assert.Regexp(`ping_socket_packets_sent_total{family="ipv4"} [1-9]`, m)
+	assert.Regexp(`ping_socket_packets_read_total{family="ipv6"} [1-9]`, m)
+	assert.Contains(m, `ping_socket_parse_errors_total{error="too_short",family="ipv4"} 0`)
+	assert.Contains(m, `ping_socket_unmatched_total{family="ipv6",reason="seq"}`)
+}
+
+func TestExporterHandler(t *testing.T) {
+	assert := assert.New(t)
+	var reported []error
+	e := New(nil, &Options{OnError: func(t Target, err error) {
+		assert.Equal("192.0.2.1", t.Host)
+		reported = append(reported, err)
+	}})
+	tgt := Target{Host: "192.0.2.1"}
+	h, err := e.Handler(tgt)
+	assert.NoError(err)
+	now := time.Now()
+	sendErr := errors.New("send failed")
+	h(&ping.Ping{Sent: now, Recieved: now.Add(time.Millisecond)}, nil)
+	h(&ping.Ping{Sent: now}, ping.ErrTimedOut)
+	h(&ping.Ping{Sent: now}, sendErr)
+	assert.Equal([]error{sendErr}, reported)
+
+	m := scrape(t, e)
+	assert.Contains(m, `ping_sent_total{target="192.0.2.1"} 3`)
+	assert.Contains(m, `ping_received_total{target="192.0.2.1"} 1`)
+	assert.Contains(m, `ping_timeouts_total{target="192.0.2.1"} 1`)
+	assert.Contains(m, `ping_errors_total{target="192.0.2.1"} 1`)
+	assert.Contains(m, `ping_rtt_seconds_sum{target="192.0.2.1"} 0.001`)
+
+	e.Remove(tgt)
+	assert.NotContains(scrape(t, e), `target="192.0.2.1"`)
+
+	_, err = e.Handler(Target{Host: "192.0.2.1", Labels: map[string]string{"site": "x"}})
+	assert.Equal(ErrUnknownLabel, err)
+	assert.Equal(ErrUnknownLabel, e.Run(context.Background(), []Target{{Labels: map[string]string{"site": "x"}}}))
+}
+
+func TestExporterRunFails(t *testing.T) {
+	s := ping.NewSocket()
+	assert.NoError(t, s.Close(context.Background()))
+	done := make(chan error)
+	go func() {
+		done <- New(s, nil).Run(context.Background(), []Target{{Host: "127.0.0.1"}, {Host: "::1"}})
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, ping.ErrSocketClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Error("run did not return the error of its targets")
+	}
+}
@@ -1,12 +1,26 @@
 package ping
 
 import (
+	"net"
+	"sync/atomic"
+
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
 // HandleFunc is a function to handle responses and errors
 type HandleFunc func(*Ping, error)
 
-func iHandle(handle HandleFunc) func(*ping.Ping, error) {
-	return func(p *ping.Ping, err error) { handle(iPingToPing(p), err) }
+func (s *Socket) iHandle(handle HandleFunc) func(*ping.Ping, error) {
+	return func(p *ping.Ping, err error) {
+		if atomic.LoadInt32(&s.reuse) == 0 {
+			handle(iPingToPing(p), err)
+			return
+		}
+		rp, _ := s.pings.Get().(*Ping)
+		if rp == nil {
+			rp = &Ping{Src: &net.IPAddr{}, Dst: &net.IPAddr{}}
+		}
+		handle(iPingInto(rp, p), err)
+		s.pings.Put(rp)
+	}
 }
@@ -0,0 +1,48 @@
+package ping
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestReusePings(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	ip := &ping.Ping{
+		Src:      &net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+		Dst:      &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+		ID:       1234,
+		Seq:      5,
+		Count:    5,
+		Sent:     time.Now(),
+		Recieved: time.Now(),
+	}
+
+	var got []*Ping
+	h := s.iHandle(func(p *Ping, err error) { got = append(got, p) })
+	h(ip, nil)
+	h(ip, nil)
+	if assert.Len(got, 2) {
+		assert.True(got[0] != got[1], "pings are not reused by default")
+		assert.Equal(1234, got[1].ID)
+		assert.Equal("fe80::1%eth0", got[1].Dst.String())
+	}
+
+	s.SetReusePings(true)
+	var p Ping
+	h = s.iHandle(func(rp *Ping, err error) { p = *rp })
+	h(ip, nil)
+	assert.Equal(5, p.Count)
+	assert.Equal("192.0.2.1", p.Src.String())
+	assert.Equal("fe80::1%eth0", p.Dst.String())
+	if raceEnabled {
+		return
+	}
+	allocs := testing.AllocsPerRun(100, func() { h(ip, nil) })
+	assert.Zero(allocs)
+}
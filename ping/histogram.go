@@ -0,0 +1,301 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// Histograms use log-linear buckets. Values below histSubCount nanoseconds have a bucket each,
+// above that each power of two is split into histSubCount linear buckets.
+// The percentiles reported are within 1/(2*histSubCount) of the true value.
+const (
+	histSubBits  = 7
+	histSubCount = 1 << histSubBits
+	histBuckets  = (64 - histSubBits) * histSubCount
+
+	histVersion = 1
+)
+
+// ErrInvalidSnapshot is returned when unmarshaling a HistogramSnapshot that is malformed
+// or was encoded with incompatible buckets
+var ErrInvalidSnapshot = errors.New("invalid histogram snapshot")
+
+func histIndex(v uint64) int {
+	if v < histSubCount {
+		return int(v)
+	}
+	e := bits.Len64(v) - histSubBits - 1
+	return (e+1)*histSubCount + int(v>>uint(e)) - histSubCount
+}
+
+// histBounds returns the lowest value in bucket i, and the lowest value in the next bucket
+func histBounds(i int) (uint64, uint64) {
+	if i < histSubCount {
+		return uint64(i), uint64(i) + 1
+	}
+	e := uint(i/histSubCount - 1)
+	m := uint64(i%histSubCount + histSubCount)
+	return m << e, (m + 1) << e
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram.
+//
+// Snapshots from any number of histograms can be merged, and can be serialized with
+// MarshalBinary to compute percentiles elsewhere without the raw samples.
+type HistogramSnapshot struct {
+	// Count is the number of RTTs recorded
+	Count uint64
+	// Min and Max are the exact minimum and maximum RTT recorded
+	Min, Max time.Duration
+	// Sum is the sum of all RTTs recorded
+	Sum time.Duration
+	// counts is indexed by bucket, and only as long as the highest bucket with a value
+	counts []uint64
+}
+
+func (s *HistogramSnapshot) record(v time.Duration, n uint64) {
+	if v < 0 {
+		v = 0
+	}
+	i := histIndex(uint64(v))
+	for len(s.counts) <= i {
+		s.counts = append(s.counts, 0)
+	}
+	s.counts[i] += n
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if v > s.Max {
+		s.Max = v
+	}
+	s.Count += n
+	s.Sum += v * time.Duration(n)
+}
+
+// Merge adds the values in o to s
+func (s *HistogramSnapshot) Merge(o *HistogramSnapshot) {
+	if o == nil || o.Count == 0 {
+		return
+	}
+	for len(s.counts) < len(o.counts) {
+		s.counts = append(s.counts, 0)
+	}
+	for i, c := range o.counts {
+		s.counts[i] += c
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+}
+
+// Mean returns the average RTT
+func (s *HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Percentile returns the RTT that p percent of RTTs are less than or equal to.
+// p is between 0 and 100.
+//
+// Zero is returned if nothing has been recorded.
+func (s *HistogramSnapshot) Percentile(p float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(s.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	// the extremes are known exactly
+	if rank == 1 {
+		return s.Min
+	}
+	if rank >= s.Count {
+		return s.Max
+	}
+	var cum uint64
+	for i, c := range s.counts {
+		cum += c
+		if cum < rank {
+			continue
+		}
+		lo, hi := histBounds(i)
+		v := time.Duration(lo + (hi-1-lo)/2)
+		if v < s.Min {
+			v = s.Min
+		}
+		if v > s.Max {
+			v = s.Max
+		}
+		return v
+	}
+	return s.Max
+}
+
+// P50 returns the median RTT
+func (s *HistogramSnapshot) P50() time.Duration { return s.Percentile(50) }
+
+// P90 returns the 90th percentile RTT
+func (s *HistogramSnapshot) P90() time.Duration { return s.Percentile(90) }
+
+// P99 returns the 99th percentile RTT
+func (s *HistogramSnapshot) P99() time.Duration { return s.Percentile(99) }
+
+// P999 returns the 99.9th percentile RTT
+func (s *HistogramSnapshot) P999() time.Duration { return s.Percentile(99.9) }
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// MarshalBinary encodes the snapshot. Only buckets with values are encoded.
+func (s *HistogramSnapshot) MarshalBinary() ([]byte, error) {
+	b := []byte{histVersion, histSubBits}
+	b = appendUvarint(b, s.Count)
+	b = appendUvarint(b, uint64(s.Min))
+	b = appendUvarint(b, uint64(s.Max))
+	b = appendUvarint(b, uint64(s.Sum))
+	// buckets are encoded as the gap from the previous non empty bucket and the count
+	last := -1
+	for i, c := range s.counts {
+		if c == 0 {
+			continue
+		}
+		b = appendUvarint(b, uint64(i-last))
+		b = appendUvarint(b, c)
+		last = i
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a snapshot encoded with MarshalBinary, replacing the contents of s
+func (s *HistogramSnapshot) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[0] != histVersion || b[1] != histSubBits {
+		return ErrInvalidSnapshot
+	}
+	b = b[2:]
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, false
+		}
+		b = b[n:]
+		return v, true
+	}
+	var h [4]uint64
+	for i := range h {
+		var ok bool
+		if h[i], ok = next(); !ok {
+			return ErrInvalidSnapshot
+		}
+	}
+	r := HistogramSnapshot{Count: h[0], Min: time.Duration(h[1]), Max: time.Duration(h[2]), Sum: time.Duration(h[3])}
+	var total uint64
+	i := -1
+	for len(b) > 0 {
+		gap, ok := next()
+		if !ok || gap == 0 || gap > histBuckets {
+			return ErrInvalidSnapshot
+		}
+		c, ok := next()
+		if !ok {
+			return ErrInvalidSnapshot
+		}
+		i += int(gap)
+		if i >= histBuckets {
+			return ErrInvalidSnapshot
+		}
+		for len(r.counts) <= i {
+			r.counts = append(r.counts, 0)
+		}
+		r.counts[i] = c
+		total += c
+	}
+	if total != r.Count {
+		return ErrInvalidSnapshot
+	}
+	*s = r
+	return nil
+}
+
+// Histogram records the distribution of RTTs.
+//
+// Histogram is safe to use from handlers running on multiple workers.
+type Histogram struct {
+	l sync.Mutex
+	s HistogramSnapshot
+}
+
+// NewHistogram returns an empty Histogram
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// Record records an RTT
+func (h *Histogram) Record(rtt time.Duration) {
+	h.l.Lock()
+	h.s.record(rtt, 1)
+	h.l.Unlock()
+}
+
+// Handle records the RTT of successful pings. It can be used directly as a HandleFunc.
+//
+// Late and duplicate replies are not recorded, the ping was already handled.
+func (h *Histogram) Handle(p *Ping, err error) {
+	if err != nil || p == nil || p.Again() {
+		return
+	}
+	h.Record(p.RTT())
+}
+
+// wrap is Wrap for internal handlers
+func (h *Histogram) wrap(next func(*ping.Ping, error)) func(*ping.Ping, error) {
+	return func(p *ping.Ping, err error) {
+		if err == nil && !p.Again() {
+			h.Record(p.RTT())
+		}
+		next(p, err)
+	}
+}
+
+// Wrap returns a HandleFunc that records each successful ping before passing it on to next
+func (h *Histogram) Wrap(next HandleFunc) HandleFunc {
+	return func(p *Ping, err error) {
+		h.Handle(p, err)
+		next(p, err)
+	}
+}
+
+// Snapshot returns a copy of the histogram
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	h.l.Lock()
+	defer h.l.Unlock()
+	s := h.s
+	s.counts = append([]uint64(nil), h.s.counts...)
+	return &s
+}
+
+// Reset clears the histogram and returns a snapshot of what it held.
+//
+// This is useful for shipping snapshots periodically, each covering the time since the last.
+func (h *Histogram) Reset() *HistogramSnapshot {
+	h.l.Lock()
+	defer h.l.Unlock()
+	s := h.s
+	h.s = HistogramSnapshot{}
+	return &s
+}
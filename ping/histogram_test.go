@@ -0,0 +1,126 @@
+package ping
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistIndex(t *testing.T) {
+	assert := assert.New(t)
+	last := -1
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 257, 1000, 1e6, 1e9, 1e12, 1<<63 - 1} {
+		i := histIndex(v)
+		assert.True(i >= last, "index should not decrease")
+		assert.True(i < histBuckets)
+		lo, hi := histBounds(i)
+		assert.True(lo <= v && v < hi, "%v not in bucket %v [%v, %v)", v, i, lo, hi)
+		if v >= histSubCount {
+			assert.True(float64(hi-lo)/float64(lo) <= 1.0/histSubCount, "bucket %v too wide", i)
+		}
+		last = i
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHistogram()
+	r := rand.New(rand.NewSource(1))
+	var raw []time.Duration
+	for i := 0; i < 100000; i++ {
+		d := time.Duration(r.ExpFloat64() * float64(10*time.Millisecond))
+		raw = append(raw, d)
+		h.Record(d)
+	}
+	sort.Slice(raw, func(i, j int) bool { return raw[i] < raw[j] })
+	s := h.Snapshot()
+	assert.Equal(uint64(len(raw)), s.Count)
+	assert.Equal(raw[0], s.Min)
+	assert.Equal(raw[len(raw)-1], s.Max)
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		exact := raw[int(p/100*float64(len(raw)))-1]
+		assert.InEpsilon(float64(exact), float64(s.Percentile(p)), 1.0/histSubCount, "p%v", p)
+	}
+	assert.Equal(s.Percentile(50), s.P50())
+	assert.Equal(s.Percentile(99.9), s.P999())
+	assert.Equal(s.Min, s.Percentile(0))
+	assert.Equal(s.Max, s.Percentile(100))
+	assert.Zero(NewHistogram().Snapshot().P99())
+}
+
+func TestHistogramMerge(t *testing.T) {
+	assert := assert.New(t)
+	all, a, b := NewHistogram(), NewHistogram(), NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i) * time.Microsecond
+		all.Record(d)
+		if i%3 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+	}
+	m := &HistogramSnapshot{}
+	m.Merge(a.Snapshot())
+	m.Merge(b.Snapshot())
+	m.Merge(nil)
+	assert.Equal(all.Snapshot(), m)
+	assert.Equal(all.Snapshot().Mean(), m.Mean())
+}
+
+func TestHistogramMarshal(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHistogram()
+	for _, d := range []time.Duration{0, 5, 300, time.Millisecond, time.Second, time.Hour} {
+		h.Record(d)
+	}
+	s := h.Snapshot()
+	b, err := s.MarshalBinary()
+	assert.NoError(err)
+	r := &HistogramSnapshot{}
+	assert.NoError(r.UnmarshalBinary(b))
+	assert.Equal(s, r)
+
+	assert.Equal(ErrInvalidSnapshot, r.UnmarshalBinary(nil))
+	assert.Equal(ErrInvalidSnapshot, r.UnmarshalBinary(b[:len(b)-1]))
+	bad := append([]byte{}, b...)
+	bad[1]++
+	assert.Equal(ErrInvalidSnapshot, r.UnmarshalBinary(bad))
+	assert.Equal(s, r, "a failed unmarshal should not modify the snapshot")
+
+	e, err := (&HistogramSnapshot{}).MarshalBinary()
+	assert.NoError(err)
+	assert.NoError(r.UnmarshalBinary(e))
+	assert.Zero(r.Count)
+}
+
+func TestHistogramReset(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHistogram()
+	h.Record(time.Millisecond)
+	s := h.Reset()
+	assert.Equal(uint64(1), s.Count)
+	assert.Zero(h.Snapshot().Count)
+}
+
+func TestIPConnHistogram(t *testing.T) {
+	assert := assert.New(t)
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+	c, err := NewIPConn(dst, func(*Ping, error) {}, time.Second)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		c.SendPing()
+	}
+	c.Drain()
+	assert.NoError(c.Close())
+	s := c.Histogram().Snapshot()
+	assert.Equal(uint64(10), s.Count)
+	assert.NotZero(s.P50())
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
 )
 
 // HostConn is an ICMP connection based on hostname
@@ -23,6 +24,10 @@ type HostConn struct {
 	reResolveEvery int
 	handle         func(*ping.Ping, error)
 	timeout        time.Duration
+	payload        payload
+	hist           *Histogram
+	counters       *connCounters
+	order          *seqmap.Order
 }
 
 // NewHostConn returns a new HostConn
@@ -32,17 +37,21 @@ func NewHostConn(host string, reResolveEvery int, handle HandleFunc, timeout tim
 
 // NewHostConn returns a new HostConn
 func (s *Socket) NewHostConn(host string, reResolveEvery int, handle HandleFunc, timeout time.Duration) *HostConn {
-	return s.newHostConn(host, reResolveEvery, iHandle(handle), timeout)
+	return s.newHostConn(host, reResolveEvery, s.iHandle(handle), timeout)
 }
 
 func (s *Socket) newHostConn(host string, reResolveEvery int, handle func(*ping.Ping, error), timeout time.Duration) *HostConn {
+	hist := NewHistogram()
+	counters := &connCounters{}
 	return &HostConn{
 		s:              s,
 		host:           host,
 		reResolveEvery: reResolveEvery,
-		handle:         handle,
+		handle:         counters.wrap(hist.wrap(handle)),
 		timeout:        timeout,
 		count:          -1,
+		hist:           hist,
+		counters:       counters,
 	}
 }
 
@@ -70,7 +79,10 @@ func (h *HostConn) getNextPing() (*ping.Ping, error) {
 				}()
 				h.draining = append(h.draining, h.ipc)
 			}
-			h.ipc, err = h.s.newipConn(dst, h.handle, h.timeout)
+			h.ipc, err = h.s.newipConn(dst, h.handle, h.timeout, h.payload)
+			if err == nil && h.order != nil {
+				err = h.ipc.setOrder(h.order)
+			}
 			if err != nil {
 				p.Sent = time.Now()
 				return p, err
@@ -83,12 +95,56 @@ func (h *HostConn) getNextPing() (*ping.Ping, error) {
 
 func (h *HostConn) sendPing(p *ping.Ping, err error) {
 	if err != nil {
+		if h.order != nil {
+			h.order.Handle(p, err)
+			return
+		}
 		h.handle(p, err)
 		return
 	}
 	h.ipc.sendPing(p)
 }
 
+// SetPayload sets the payload sent with each echo request. ErrPayloadTooSmall is
+// returned for a size below MinPayloadSize, see Payload for the smallest sizes.
+//
+// This must be called before any pings are sent.
+func (h *HostConn) SetPayload(p Payload) error {
+	pl, err := p.data()
+	if err != nil {
+		return err
+	}
+	h.payload = pl
+	return nil
+}
+
+// SetOrdered sets whether handler calls for this connection are serialized in Count order,
+// across every address the host resolves to. See IPConn.SetOrdered.
+//
+// This must be called before any pings are sent.
+func (h *HostConn) SetOrdered(ordered bool) error {
+	h.order = nil
+	if ordered {
+		h.order = seqmap.NewOrder(h.handle)
+	}
+	if h.ipc == nil {
+		return nil
+	}
+	return h.ipc.setOrder(h.order)
+}
+
+// Histogram returns the histogram of RTTs of successful pings on this connection.
+// It covers every address the host has resolved to.
+func (h *HostConn) Histogram() *Histogram {
+	return h.hist
+}
+
+// Stats returns the counts of results on this connection.
+// It covers every address the host has resolved to.
+func (h *HostConn) Stats() *ConnStats {
+	return h.counters.stats()
+}
+
 // SendPing sends a ping
 func (h *HostConn) SendPing() {
 	h.sendPing(h.getNextPing())
@@ -148,9 +204,11 @@ func HostInterval(ctx context.Context, host string, reResolveEvery int, handler
 func (s *Socket) HostInterval(ctx context.Context, host string, reResolveEvery int, handler HandleFunc, count int, interval, timeout time.Duration) error {
 	h := s.NewHostConn(host, reResolveEvery, handler, timeout)
 
-	runInterval(ctx, h.getNextPing, h.sendPing, count, interval)
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	runInterval(ctx, s.sched, hostKey(host), h.getNextPing, h.sendPing, count, interval)
 	h.Drain()
-	return h.Close()
+	return s.closedErr(h.Close())
 }
 
 // HostFlood performs HostFlood using the default socket.
@@ -160,9 +218,16 @@ func HostFlood(ctx context.Context, host string, reResolveEvery int, handler Han
 
 // HostFlood works like HostInterval, but instead of sending on an interval, the next ping is sent as soon as the previous ping is handled.
 func (s *Socket) HostFlood(ctx context.Context, host string, reResolveEvery int, handler HandleFunc, count int, timeout time.Duration) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
 	fC := make(chan struct{})
 	floodHander := func(p *Ping, err error) {
-		fC <- struct{}{}
+		if !p.Again() {
+			select {
+			case fC <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
 		handler(p, err)
 	}
 
@@ -170,5 +235,5 @@ func (s *Socket) HostFlood(ctx context.Context, host string, reResolveEvery int,
 
 	runFlood(ctx, h.getNextPing, h.sendPing, fC, count)
 	h.Drain()
-	return h.Close()
+	return s.closedErr(h.Close())
 }
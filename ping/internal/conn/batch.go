@@ -0,0 +1,308 @@
+package conn
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// readBatchLen is the most packets a worker reads with one syscall
+const readBatchLen = 8
+
+// sendBatchLen is the most pings the sender writes with one syscall
+const sendBatchLen = 64
+
+// packet is a recieved packet before it is parsed
+type packet struct {
+	src, dst netip.Addr
+	rlen     int
+	ttl      int
+	received time.Time
+	source   ping.TimestampSource
+	// drops is the count of packets the kernel dropped because the receive
+	// buffer was full, or zero if it was not reported
+	drops uint32
+}
+
+// readBatch holds the buffers a worker reads into. Everything in it is reused
+// for every read, including the parsed pings, so once a worker is running
+// reading and parsing replies does not allocate.
+type readBatch struct {
+	payloads [][]byte
+	// hdrs hold the ip headers raw ipv4 sockets read ahead of the payload
+	hdrs  [][]byte
+	oobs  [][]byte
+	pkts  []packet
+	pings []*ping.Ping
+	errs  []error
+	sys   sysBatch
+}
+
+func newReadBatch(n int) *readBatch {
+	rb := &readBatch{
+		payloads: make([][]byte, n),
+		hdrs:     make([][]byte, n),
+		oobs:     make([][]byte, n),
+		pkts:     make([]packet, n),
+		pings:    make([]*ping.Ping, n),
+		errs:     make([]error, n),
+	}
+	oobLen := len(ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagSrc | ipv6.FlagHopLimit))
+	if l := len(ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagSrc | ipv4.FlagTTL)); l > oobLen {
+		oobLen = l
+	}
+	for i := range rb.payloads {
+		rb.payloads[i] = make([]byte, maxPacketLen)
+		rb.hdrs[i] = make([]byte, ipv4.HeaderLen)
+		rb.oobs[i] = make([]byte, oobLen+timestampOOBLen+dropsOOBLen)
+		rb.pings[i] = &ping.Ping{
+			Src: &net.IPAddr{IP: make(net.IP, 0, net.IPv6len)},
+			Dst: &net.IPAddr{IP: make(net.IP, 0, net.IPv6len)},
+		}
+	}
+	rb.sys.init(rb)
+	return rb
+}
+
+// parse parses the packet i into rb.pings[i] and rb.errs[i]
+func (rb *readBatch) parse(i, proto int, datagram bool) {
+	p := rb.reply(i)
+	rb.pings[i], rb.errs[i] = p, parse(p, proto, rb.payloads[i], rb.pkts[i].rlen, datagram)
+}
+
+// reply resets the ping for packet i and fills it in from the packet
+func (rb *readBatch) reply(i int) *ping.Ping {
+	p, pkt := rb.pings[i], &rb.pkts[i]
+	*p = ping.Ping{
+		Src:            p.Src,
+		Dst:            p.Dst,
+		Len:            pkt.rlen,
+		TTL:            pkt.ttl,
+		Recieved:       pkt.received,
+		RecievedSource: pkt.source,
+	}
+	// Src and Dst are flipped, cause this is a ping that was sent to dst
+	// which has now come back. The address the reply came from is preferred
+	// for Src, it has the zone of link local addresses.
+	setIPAddr(p.Dst, pkt.src.WithZone(""))
+	if pkt.src.IsValid() {
+		setIPAddr(p.Src, pkt.src)
+	} else {
+		setIPAddr(p.Src, pkt.dst)
+	}
+	return p
+}
+
+// stripHeader returns the length of the icmp message a raw ipv4 socket read
+// into h and payload, n bytes in total. h holds the start of the ip header, if
+// the header has options they were read into payload and are removed.
+func stripHeader(h, payload []byte, n int) int {
+	hl := int(h[0]&0x0f) << 2
+	if d, end := hl-len(h), n-len(h); d > 0 && end > d {
+		copy(payload, payload[d:end])
+	}
+	if n -= hl; n < 0 {
+		return 0
+	}
+	return n
+}
+
+// setIPAddr sets a to addr, reusing the memory of a
+func setIPAddr(a *net.IPAddr, addr netip.Addr) {
+	switch {
+	case addr.Is4():
+		b := addr.As4()
+		a.IP = append(a.IP[:0], b[:]...)
+	case addr.IsValid():
+		b := addr.As16()
+		a.IP = append(a.IP[:0], b[:]...)
+	default:
+		a.IP = a.IP[:0]
+	}
+	a.Zone = addr.Zone()
+}
+
+// addrOf returns the address of a source address returned by ReadFrom or ReadBatch
+func addrOf(a net.Addr) netip.Addr {
+	var ip net.IP
+	var zone string
+	switch a := a.(type) {
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.UDPAddr:
+		ip, zone = a.IP, a.Zone
+	}
+	addr := ping.Addr(ip)
+	if zone != "" {
+		addr = addr.WithZone(zone)
+	}
+	return addr
+}
+
+// sendReq is a ping waiting in the send queue. p is a copy owned by the request,
+// the ping it was copied from may already be read by the reply and timeout paths.
+// sent is called once it has been written, or failed to write.
+type sendReq struct {
+	p    ping.Ping
+	b    []byte
+	err  error
+	sent func(time.Time, int, error)
+}
+
+// marshal sets the sent time of the ping and marshals it
+func (r *sendReq) marshal() error {
+	r.p.Sent = time.Now()
+	r.b, r.err = r.p.ToICMPMsg()
+	return r.err
+}
+
+// sendQueue holds the pings waiting for the sender
+type sendQueue struct {
+	l       sync.Mutex
+	pending []*sendReq
+	// wake is signalled when pending goes from empty to not empty
+	wake  chan struct{}
+	stats *Stats
+}
+
+func newSendQueue(stats *Stats) *sendQueue {
+	return &sendQueue{wake: make(chan struct{}, 1), stats: stats}
+}
+
+func (q *sendQueue) push(r *sendReq) {
+	q.l.Lock()
+	q.pending = append(q.pending, r)
+	first := len(q.pending) == 1
+	q.l.Unlock()
+	if first {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sender writes the pings queued by Send. Everything queued while a batch is
+// being written goes in the next batch, so many IPConns sending at once share
+// a syscall. Once ctx is done what is left in the queue is flushed, after the
+// connection is closed that fails each ping.
+func (q *sendQueue) sender(ctx context.Context, conn conn) {
+	var rs []*sendReq
+	for {
+		done := false
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-q.wake:
+		}
+		q.l.Lock()
+		rs, q.pending = q.pending, rs[:0]
+		q.l.Unlock()
+		for b := rs; len(b) > 0; {
+			n := len(b)
+			if n > sendBatchLen {
+				n = sendBatchLen
+			}
+			q.stats.sent(sendBatch(conn, b[:n]))
+			for _, r := range b[:n] {
+				r.sent(r.p.Sent, len(r.b), r.err)
+			}
+			b = b[n:]
+		}
+		for i := range rs {
+			rs[i] = nil
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// batchWriter is implemented by both ipv4.PacketConn and ipv6.PacketConn
+type batchWriter interface {
+	WriteBatch([]ipv4.Message, int) (int, error)
+}
+
+// sendBatch sends rs, setting the error of each ping that could not be sent.
+// Pings with a ttl need their own control message, so they are written alone.
+// It returns how many pings were sent, and how many writes were retried
+// because the kernel was out of buffer space.
+func sendBatch(conn conn, rs []*sendReq) (sent, retries int) {
+	pending := make([]*sendReq, 0, len(rs))
+	for _, r := range rs {
+		if r.p.SendTTL != 0 {
+			retries += sendOne(conn, r)
+			if r.err == nil {
+				sent++
+			}
+			continue
+		}
+		if r.marshal() == nil {
+			pending = append(pending, r)
+		}
+	}
+
+	for len(pending) > 0 {
+		n, err := conn.writeBatch(pending)
+		if n < 0 {
+			n = 0
+		}
+		sent += n
+		pending = pending[n:]
+		if len(pending) == 0 {
+			return sent, retries
+		}
+		switch {
+		case err == nil && n == 0:
+			pending[0].err = io.ErrShortWrite
+			pending = pending[1:]
+		case err == nil:
+			// partially written, the rest go in the next write
+		case isErrno(err, syscall.ENOBUFS):
+			retries++
+			// the timestamps are stale by the time there is room, remarshal
+			for i := 0; i < len(pending); i++ {
+				if pending[i].marshal() != nil {
+					pending = append(pending[:i], pending[i+1:]...)
+					i--
+				}
+			}
+		default:
+			pending[0].err = err
+			pending = pending[1:]
+		}
+	}
+	return sent, retries
+}
+
+// sendOne sends a single ping, retrying while the kernel is out of buffer space.
+// It returns the number of retries.
+func sendOne(conn conn, r *sendReq) (retries int) {
+	for r.marshal() == nil {
+		_, r.err = conn.writeTo(r.b, r.p.Dst, r.p.SendTTL)
+		if r.err == nil || !isErrno(r.err, syscall.ENOBUFS) {
+			return retries
+		}
+		retries++
+	}
+	return retries
+}
+
+// messages returns a message for each ping in rs
+func (c *icmpConn) messages(rs []*sendReq) []ipv4.Message {
+	ms := make([]ipv4.Message, len(rs))
+	for i, r := range rs {
+		ms[i].Buffers = [][]byte{r.b}
+		ms[i].Addr = c.addr(r.p.Dst)
+	}
+	return ms
+}
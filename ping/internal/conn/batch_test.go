@@ -0,0 +1,164 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+var loopback = &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+func TestSendBatch(t *testing.T) {
+	assert := assert.New(t)
+	const id, pings = 4322, 100
+	var recieved int64
+	done := make(chan struct{})
+	c := New(4, ModeAuto, func(p *ping.Ping, err error) {
+		if err != nil || p.ID != id {
+			return
+		}
+		if atomic.AddInt64(&recieved, 1) == pings {
+			close(done)
+		}
+	})
+	if err := c.Run(2); err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer func() { assert.NoError(c.Stop()) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < pings; i++ {
+		wg.Add(1)
+		go func(i int) {
+			p := &ping.Ping{Dst: loopback, ID: id, Seq: ping.Seq(i), Count: i, TimeOut: time.Second}
+			c.Send(*p, func(sent time.Time, l int, err error) {
+				assert.NoError(err)
+				assert.False(sent.IsZero())
+				assert.Equal(8+ping.HeaderLength, l)
+				// the copy is sent, p is not written to
+				assert.True(p.Sent.IsZero())
+				wg.Done()
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("recieved %v of %v replies", atomic.LoadInt64(&recieved), pings)
+	}
+	st := c.Stats()
+	assert.Equal(uint64(pings), st.Sent)
+	assert.GreaterOrEqual(st.Read, uint64(pings))
+}
+
+func TestSendNotRunning(t *testing.T) {
+	c := New(4, ModeAuto, func(*ping.Ping, error) {})
+	var err error
+	c.Send(ping.Ping{Dst: loopback}, func(_ time.Time, _ int, e error) { err = e })
+	assert.Equal(t, ErrNotRunning, err)
+}
+
+func TestSendShortDatagram(t *testing.T) {
+	c := New(4, ModeDatagram, func(*ping.Ping, error) {})
+	if err := c.Run(1); err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer func() { assert.NoError(t, c.Stop()) }()
+	errs := make(chan error, 2)
+	sent := func(_ time.Time, _ int, e error) { errs <- e }
+	c.Send(ping.Ping{Dst: loopback, HeaderLen: ping.TimeSliceLength}, sent)
+	assert.Equal(t, ping.ErrPayloadTooSmall, <-errs)
+	c.Send(ping.Ping{Dst: loopback, HeaderLen: ping.TimeSliceLength + ping.IDSliceLength}, sent)
+	assert.NoError(t, <-errs)
+}
+
+func benchConn(b *testing.B) conn {
+	c := newConn(4, ModeAuto)
+	if err := c.start(); err != nil {
+		b.Skipf("unable to listen: %v", err)
+	}
+	return c
+}
+
+func benchRun(b *testing.B) *Conn {
+	c := New(4, ModeAuto, func(*ping.Ping, error) {})
+	if err := c.Run(1); err != nil {
+		b.Skipf("unable to listen: %v", err)
+	}
+	return c
+}
+
+// BenchmarkSend compares writing each ping with its own syscall against
+// writing them through the send queue, from many goroutines. Each op is
+// one ping written.
+func BenchmarkSend(b *testing.B) {
+	b.Run("single", func(b *testing.B) {
+		c := benchRun(b)
+		defer func() { _ = c.Stop() }()
+		b.RunParallel(func(pb *testing.PB) {
+			r := &sendReq{p: ping.Ping{Dst: loopback, ID: 4323}}
+			for pb.Next() {
+				c.l.RLock()
+				sendOne(c.conn, r)
+				c.l.RUnlock()
+			}
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		c := benchRun(b)
+		defer func() { _ = c.Stop() }()
+		var wg sync.WaitGroup
+		wg.Add(b.N)
+		sent := func(time.Time, int, error) { wg.Done() }
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.Send(ping.Ping{Dst: loopback, ID: 4323}, sent)
+			}
+		})
+		wg.Wait()
+	})
+}
+
+// BenchmarkRead compares reading one packet per syscall with reading batches,
+// each op is one recieved packet. The allocations reported include those of
+// the goroutine sending the packets, TestReadAllocs checks reading alone.
+func BenchmarkRead(b *testing.B) {
+	for _, n := range []int{1, readBatchLen} {
+		b.Run(fmt.Sprintf("batch%v", n), func(b *testing.B) {
+			c := benchConn(b)
+			defer func() { _ = c.close() }()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				rs := make([]*sendReq, sendBatchLen)
+				for i := range rs {
+					rs[i] = &sendReq{p: ping.Ping{Dst: loopback, ID: 4324}}
+				}
+				for !ctxDone(ctx) {
+					sendBatch(c, rs)
+				}
+			}()
+
+			rb := newReadBatch(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; {
+				r, err := c.read(rb)
+				if err != nil {
+					b.Fatal(err)
+				}
+				i += r
+			}
+		})
+	}
+}
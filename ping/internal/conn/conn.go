@@ -4,9 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
-	"os"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
@@ -14,34 +12,74 @@ import (
 
 // Conn holds a connection, either ipv4 or ipv6
 type Conn struct {
+	// stats is first so it is 64 bit aligned for atomic access
+	stats   Stats
 	l       sync.RWMutex
 	cancel  func()
 	conn    conn
 	handler func(*ping.Ping, error)
 	proto   int
-	// I had a waitgroup for workers, but it has been removed
-	// There's no reason to delay a stop waiting for these to shutdown
-	// If a new listen comes in, a new listener will be created
-	// Just cancel the context and let them die on their own.
+	mode    Mode
+	sq      *sendQueue
+	// ids counts the endpoints using each ICMP id, nil until AddID is called
+	ids map[ping.ID]int
+	// acceptAll is set while the filter accepts every id
+	acceptAll bool
+	// pool holds the workers while the Conn is running. Stop does not wait
+	// for them, they exit on their own once the socket is closed.
+	pool *pool
+	// wg is done once every goroutine started by Run has exited
+	wg      sync.WaitGroup
+	workers int
+	// minWorkers and maxWorkers bound the workers while scaling, which is
+	// enabled if maxWorkers is not zero
+	minWorkers, maxWorkers int
 }
 
 type conn interface {
 	start() error
-	writeTo([]byte, *net.IPAddr) (int, error)
-	read() (*ping.Ping, error)
+	writeTo([]byte, *net.IPAddr, int) (int, error)
+	// writeBatch writes the marshaled pings in order, returning how many were
+	// written. If err is not nil it is the error of the first unwritten ping.
+	writeBatch([]*sendReq) (int, error)
+	// read reads up to len(rb.ms) packets into rb, returning how many were read
+	read(rb *readBatch) (int, error)
+	// setReadDeadline sets the deadline for reads, a time in the past wakes
+	// blocked reads and a zero time clears it
+	setReadDeadline(t time.Time) error
+	// setFilter sets a kernel filter so only replies to ids are read
+	setFilter(ids []ping.ID) error
+	// isDatagram returns true if the conn is an unprivileged datagram socket
+	isDatagram() bool
 	close() error
 }
 
+// Mode selects the kind of socket a Conn listens on
+type Mode int
+
+const (
+	// ModeAuto uses a raw socket, falling back to a datagram socket if
+	// opening the raw socket is not permitted
+	ModeAuto Mode = iota
+	// ModeRaw uses a raw socket, this requires root or CAP_NET_RAW
+	ModeRaw
+	// ModeDatagram uses an unprivileged ICMP datagram socket. On linux the
+	// group must be allowed by the net.ipv4.ping_group_range sysctl.
+	ModeDatagram
+)
+
 // New returns a new Conn
-func New(proto int, h func(*ping.Ping, error)) *Conn {
+func New(proto int, mode Mode, h func(*ping.Ping, error)) *Conn {
 	return &Conn{
 		cancel:  func() {},
 		handler: h,
 		proto:   proto,
+		mode:    mode,
 	}
 }
 
-// Run runs the workers for the Conn
+// Run runs the workers for the Conn. workers is the number to start with,
+// it is changed by SetWorkers and scaling.
 func (c *Conn) Run(workers int) error {
 	c.l.Lock()
 	if c.conn != nil {
@@ -49,16 +87,31 @@ func (c *Conn) Run(workers int) error {
 		return nil
 	}
 
-	c.conn = newConn(c.proto)
+	c.conn = newConn(c.proto, c.mode)
 	err := c.conn.start()
 	if err != nil {
 		_ = c.conn.close()
 		c.l.Unlock()
 		return err
 	}
+	// foreign replies are dropped after parsing if the filter fails
+	c.acceptAll = false
+	_ = c.setFilter()
 	var ctx context.Context
 	ctx, c.cancel = context.WithCancel(context.Background())
-	c.runWorkers(ctx, workers, c.conn.read, c.handler)
+	c.pool = newPool(ctx, c.conn, c.handler, &c.stats, &c.wg)
+	c.workers = workers
+	c.resize()
+	c.sq = newSendQueue(&c.stats)
+	c.wg.Add(2)
+	go func(p *pool) {
+		defer c.wg.Done()
+		c.scaler(ctx, p)
+	}(c.pool)
+	go func(sq *sendQueue, conn conn) {
+		defer c.wg.Done()
+		sq.sender(ctx, conn)
+	}(c.sq, c.conn)
 	c.l.Unlock()
 	return nil
 }
@@ -73,55 +126,88 @@ func (c *Conn) Stop() error {
 		return err
 	}
 	c.conn = nil
+	c.pool = nil
 	c.l.Unlock()
 	return nil
 }
 
+// Wait blocks until the goroutines of the Conn have exited, after it is stopped
+func (c *Conn) Wait() {
+	c.wg.Wait()
+}
+
+// AddID adds an ICMP id the Conn recieves replies and errors for. On linux
+// raw sockets a kernel filter drops packets for other ids, such as replies to
+// other processes pinging from the same host, before they are read.
+// Until AddID is called replies for every id are recieved.
+func (c *Conn) AddID(id ping.ID) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.ids == nil {
+		c.ids = make(map[ping.ID]int)
+	}
+	if c.ids[id]++; c.ids[id] > 1 {
+		return nil
+	}
+	return c.setFilter()
+}
+
+// DelID removes an id added with AddID
+func (c *Conn) DelID(id ping.ID) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.ids[id]--; c.ids[id] > 0 {
+		return nil
+	}
+	delete(c.ids, id)
+	return c.setFilter()
+}
+
+// setFilter updates the filter of the socket to the ids, it is called with the lock held
+func (c *Conn) setFilter() error {
+	if c.conn == nil || c.ids == nil {
+		return nil
+	}
+	if len(c.ids) > maxFilterIDs {
+		// every id is accepted, it only needs setting once
+		if c.acceptAll {
+			return nil
+		}
+		c.acceptAll = true
+	} else {
+		c.acceptAll = false
+	}
+	ids := make([]ping.ID, 0, len(c.ids))
+	for id := range c.ids {
+		ids = append(ids, id)
+	}
+	return c.conn.setFilter(ids)
+}
+
 // ErrNotRunning is returned if a ping is sent through a connection that is not running
 var ErrNotRunning = errors.New("not running")
 
-// Send sends a ping through a Conn
-func (c *Conn) Send(p *ping.Ping) (time.Time, error) {
+// ErrTTLNotSupported is returned when sending with a ttl on a platform that does not support it
+var ErrTTLNotSupported = errors.New("setting the ttl per packet is not supported on this platform")
+
+// Send queues a ping to be sent through a Conn. Pings queued at the same
+// time are written in batches. p is a copy, the original is not written to.
+// Once the ping is written sent is called with the time it was sent and its
+// length, or with the error if it could not be sent. sent must not block,
+// it delays the pings queued behind it.
+func (c *Conn) Send(p ping.Ping, sent func(time.Time, int, error)) {
 	c.l.RLock()
 	if c.conn == nil {
 		c.l.RUnlock()
-		return time.Time{}, ErrNotRunning
+		sent(time.Time{}, 0, ErrNotRunning)
+		return
 	}
-
-	var err error
-	var b []byte
-	var toT time.Time
-send:
-	for {
-		p.Sent = time.Now()
-		toT = p.TimeOutTime()
-		b, err = p.ToICMPMsg()
-		if err != nil {
-			return toT, err
-		}
-		p.Len = len(b)
-		_, err = c.conn.writeTo(b, p.Dst)
-		if err != nil {
-			subErr := err
-			for {
-				switch subErr.(type) {
-				case syscall.Errno:
-					if subErr == syscall.ENOBUFS {
-						continue send
-					}
-					break send
-				case *net.OpError:
-					subErr = subErr.(*net.OpError).Err
-				case *os.SyscallError:
-					subErr = subErr.(*os.SyscallError).Err
-				default:
-					break send
-				}
-			}
-		}
-		break
+	if c.conn.isDatagram() && p.HeaderLen > 0 && p.HeaderLen < ping.TimeSliceLength+ping.IDSliceLength {
+		// replies on datagram sockets are matched by the ID in the payload
+		c.l.RUnlock()
+		sent(time.Time{}, 0, ping.ErrPayloadTooSmall)
+		return
 	}
-
+	c.sq.push(&sendReq{p: p, sent: sent})
 	c.l.RUnlock()
-	return toT, err
 }
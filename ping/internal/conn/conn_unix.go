@@ -4,69 +4,88 @@ package conn
 
 import (
 	"net"
-	"time"
+	"os"
+	"runtime"
+	"syscall"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
-func setupV4Conn(c *ipv4.PacketConn) error {
+// setupV4Conn enables control messages and installs an ICMP filter.
+// Datagram sockets do not support ICMP filters, the kernel only delivers
+// replies to our own echos on them anyway.
+func setupV4Conn(c *ipv4.PacketConn, datagram bool) error {
 	err := c.SetControlMessage(ipv4.FlagDst|ipv4.FlagSrc|ipv4.FlagTTL, true)
-	if err != nil {
+	if err != nil || datagram {
 		return err
 	}
 
 	var f ipv4.ICMPFilter
 	f.SetAll(true)
 	f.Accept(ipv4.ICMPTypeEchoReply)
+	f.Accept(ipv4.ICMPTypeDestinationUnreachable)
+	f.Accept(ipv4.ICMPTypeTimeExceeded)
+	f.Accept(ipv4.ICMPTypeParameterProblem)
 	err = c.SetICMPFilter(&f)
 	return err
 }
 
-func setupV6Conn(c *ipv6.PacketConn) error {
+func setupV6Conn(c *ipv6.PacketConn, datagram bool) error {
 	err := c.SetControlMessage(ipv6.FlagDst|ipv6.FlagSrc|ipv6.FlagHopLimit, true)
-	if err != nil {
+	if err != nil || datagram {
 		return err
 	}
 	var f ipv6.ICMPFilter
 	f.SetAll(true)
 	f.Accept(ipv6.ICMPTypeEchoReply)
+	f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+	f.Accept(ipv6.ICMPTypeTimeExceeded)
+	f.Accept(ipv6.ICMPTypeParameterProblem)
 	err = c.SetICMPFilter(&f)
 	return err
 }
 
-func readV4(c *ipv4.PacketConn, len int) (
-	payload []byte,
-	srcAddr net.Addr,
-	src, dst net.IP,
-	rlen, ttl int,
-	received time.Time,
-	err error,
-) {
-	payload = make([]byte, len)
-	var cm *ipv4.ControlMessage
-	rlen, cm, srcAddr, err = c.ReadFrom(payload)
-	received = time.Now()
-	if cm != nil {
-		src, dst, ttl = cm.Src, cm.Dst, cm.TTL
+// sysIPStripHdr is IP_STRIPHDR, only darwin supports it
+const sysIPStripHdr = 0x17
+
+// listenDatagram opens an unprivileged ICMP datagram socket, the same way
+// icmp.ListenPacket does. Only darwin and linux support them.
+func listenDatagram(network, address string) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, ping.ProtocolICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if network == "udp6" {
+		family, proto = syscall.AF_INET6, ping.ProtocolIPv6ICMP
+		sa = &syscall.SockaddrInet6{}
+	}
+	if ip := net.ParseIP(address); ip == nil || !ip.IsUnspecified() {
+		return nil, net.InvalidAddrError("only the unspecified address is supported")
 	}
-	return
-}
 
-func readV6(c *ipv6.PacketConn, len int) (
-	payload []byte,
-	srcAddr net.Addr,
-	src, dst net.IP,
-	rlen, ttl int,
-	received time.Time,
-	err error,
-) {
-	payload = make([]byte, len)
-	var cm *ipv6.ControlMessage
-	rlen, cm, srcAddr, err = c.ReadFrom(payload)
-	received = time.Now()
-	if cm != nil {
-		src, dst, ttl = cm.Src, cm.Dst, cm.HopLimit
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if runtime.GOOS == "darwin" && family == syscall.AF_INET {
+		if err = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, sysIPStripHdr, 1); err != nil {
+			_ = syscall.Close(s)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err = syscall.Bind(s, sa); err != nil {
+		_ = syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
 	}
-	return
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	c, err := net.FilePacketConn(f)
+	_ = f.Close()
+	return c, err
+}
+
+// writeBatch writes ms with sendmmsg on linux, other platforms write one
+// message per call.
+func writeBatch(w batchWriter, c net.PacketConn, ms []ipv4.Message) (int, error) {
+	return w.WriteBatch(ms, 0)
 }
@@ -2,47 +2,64 @@
 package conn
 
 import (
+	"errors"
 	"net"
+	"net/netip"
 	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
 
-func setupV4Conn(c *ipv4.PacketConn) error {
+// listenDatagram fails, windows does not have ICMP datagram sockets
+func listenDatagram(network, address string) (net.PacketConn, error) {
+	return nil, errors.New("datagram icmp sockets are not supported on windows")
+}
+
+func enableTimestamps(c net.PacketConn) {}
+
+func setupV4Conn(c *ipv4.PacketConn, datagram bool) error {
 	return nil
 }
 
-func setupV6Conn(c *ipv6.PacketConn) error {
+func setupV6Conn(c *ipv6.PacketConn, datagram bool) error {
 	return nil
 }
 
-func readV4(c *ipv4.PacketConn, len int) (
-	payload []byte,
-	srcAddr net.Addr,
-	src, dst net.IP,
-	rlen, ttl int,
-	received time.Time,
-	err error,
-) {
-	payload = make([]byte, len+ipv4.HeaderLen)
-	rlen, _, srcAddr, err = c.ReadFrom(payload)
-	received = time.Now()
-	src, dst = net.IPv4zero, net.IPv4zero
-	return
+// timestampOOBLen is zero, windows does not use control messages for timestamps
+const timestampOOBLen = 0
+
+// sysBatch is empty, windows reads into the buffers of the readBatch directly
+type sysBatch struct{}
+
+func (s *sysBatch) init(rb *readBatch) {}
+
+// readV4 reads a single packet into rb, windows does not support batch reads
+func readV4(c *v4Conn, rb *readBatch) (int, error) {
+	rlen, _, srcAddr, err := c.p4.ReadFrom(rb.payloads[0])
+	if err != nil {
+		return 0, err
+	}
+	rb.pkts[0] = packet{src: addrOf(srcAddr), dst: netip.IPv4Unspecified(), rlen: rlen, received: time.Now()}
+	return 1, nil
+}
+
+// readV6 reads a single packet into rb, windows does not support batch reads
+func readV6(c *v6Conn, rb *readBatch) (int, error) {
+	rlen, _, srcAddr, err := c.p6.ReadFrom(rb.payloads[0])
+	if err != nil {
+		return 0, err
+	}
+	rb.pkts[0] = packet{src: addrOf(srcAddr), dst: netip.IPv6Unspecified(), rlen: rlen, received: time.Now()}
+	return 1, nil
 }
 
-func readV6(c *ipv6.PacketConn, len int) (
-	payload []byte,
-	srcAddr net.Addr,
-	src, dst net.IP,
-	rlen, ttl int,
-	received time.Time,
-	err error,
-) {
-	payload = make([]byte, len+ipv6.HeaderLen)
-	rlen, _, srcAddr, err = c.ReadFrom(payload)
-	received = time.Now()
-	src, dst = net.IPv6zero, net.IPv6zero
-	return
+// writeBatch writes ms one message at a time, windows does not support batch writes
+func writeBatch(w batchWriter, c net.PacketConn, ms []ipv4.Message) (int, error) {
+	for i := range ms {
+		if _, err := c.WriteTo(ms[i].Buffers[0], ms[i].Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
 }
@@ -0,0 +1,25 @@
+package conn
+
+import (
+	"net"
+	"syscall"
+)
+
+// dropsOOBLen is the room needed for the SO_RXQ_OVFL control message
+var dropsOOBLen = syscall.CmsgSpace(4)
+
+// enableDrops asks the kernel to report with each packet how many packets the
+// socket has dropped because its receive buffer was full
+func enableDrops(c net.PacketConn) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = rc.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import "net"
+
+// dropsOOBLen is zero, dropped packets are only reported on linux
+const dropsOOBLen = 0
+
+func enableDrops(c net.PacketConn) {}
@@ -0,0 +1,108 @@
+package conn
+
+import (
+	"sort"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// maxFilterIDs is the most ids a filter matches. Each id is two instructions,
+// and the kernel limits the size of a filter. With more ids than this
+// everything is accepted, and foreign packets are dropped after parsing.
+const maxFilterIDs = 1024
+
+// filterAccept is returned by a filter to accept the whole packet
+const filterAccept = 1<<32 - 1
+
+// filterV4 returns a filter for a raw ipv4 socket accepting only echo replies
+// to ids, and error messages quoting echo requests from ids. The packets start
+// with the ip header.
+func filterV4(ids []ping.ID) []bpf.Instruction {
+	return idFilter(
+		[]bpf.Instruction{
+			// X is the length of the ip header, A the icmp type
+			bpf.LoadMemShift{Off: 0},
+			bpf.LoadIndirect{Off: 0, Size: 1},
+		},
+		byte(ipv4.ICMPTypeEchoReply),
+		[]byte{
+			byte(ipv4.ICMPTypeDestinationUnreachable),
+			byte(ipv4.ICMPTypeTimeExceeded),
+			byte(ipv4.ICMPTypeParameterProblem),
+		},
+		[]bpf.Instruction{
+			// the quoted ip header follows the 8 byte icmp header, move X past both
+			bpf.LoadIndirect{Off: 8, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 8},
+			bpf.TAX{},
+		},
+		ids,
+	)
+}
+
+// filterV6 returns a filter for a raw ipv6 socket, like filterV4. The kernel
+// strips the ipv6 header, so the packets start with the icmp header.
+func filterV6(ids []ping.ID) []bpf.Instruction {
+	return idFilter(
+		[]bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+		},
+		byte(ipv6.ICMPTypeEchoReply),
+		[]byte{
+			byte(ipv6.ICMPTypeDestinationUnreachable),
+			byte(ipv6.ICMPTypeTimeExceeded),
+			byte(ipv6.ICMPTypeParameterProblem),
+		},
+		[]bpf.Instruction{
+			// the quoted ipv6 header follows the 8 byte icmp header
+			bpf.LoadConstant{Dst: bpf.RegX, Val: 8 + ipv6.HeaderLen},
+		},
+		ids,
+	)
+}
+
+// idFilter builds a filter from load, which leaves the icmp type in A and the
+// offset of the icmp header in X, and embedded, which moves X to the icmp
+// header quoted by an error message. The id is checked at X+4.
+func idFilter(load []bpf.Instruction, echo byte, errs []byte, embedded []bpf.Instruction, ids []ping.ID) []bpf.Instruction {
+	ids = uniqueIDs(ids)
+	if len(ids) > maxFilterIDs {
+		return []bpf.Instruction{bpf.RetConstant{Val: filterAccept}}
+	}
+
+	f := append([]bpf.Instruction(nil), load...)
+	f = append(f, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(echo), SkipTrue: uint8(len(errs) + 1 + len(embedded))})
+	for i, t := range errs {
+		f = append(f, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(t), SkipTrue: uint8(len(errs) - i)})
+	}
+	f = append(f, bpf.RetConstant{Val: 0})
+	f = append(f, embedded...)
+	f = append(f, bpf.LoadIndirect{Off: 4, Size: 2})
+	for _, id := range ids {
+		f = append(f,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipFalse: 1},
+			bpf.RetConstant{Val: filterAccept},
+		)
+	}
+	return append(f, bpf.RetConstant{Val: 0})
+}
+
+// uniqueIDs returns ids sorted, without duplicates
+func uniqueIDs(ids []ping.ID) []ping.ID {
+	u := append([]ping.ID(nil), ids...)
+	sort.Slice(u, func(i, j int) bool { return u[i] < u[j] })
+	for i := 1; i < len(u); i++ {
+		if u[i] == u[i-1] {
+			u = append(u[:i], u[i+1:]...)
+			i--
+		}
+	}
+	return u
+}
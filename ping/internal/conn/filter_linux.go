@@ -0,0 +1,20 @@
+package conn
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// attachFilter attaches f to the socket, replacing any filter it had. If the
+// filter can not be attached one accepting everything is, so the socket
+// does not keep filtering on ids that are out of date.
+func attachFilter(s bpf.Setter, f []bpf.Instruction) error {
+	raw, err := bpf.Assemble(f)
+	if err == nil {
+		err = s.SetBPF(raw)
+	}
+	if err != nil {
+		raw, _ = bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: filterAccept}})
+		_ = s.SetBPF(raw)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestFilterIDs(t *testing.T) {
+	for _, dst := range []string{"127.0.0.1", "::1"} {
+		testFilterIDs(t, &net.IPAddr{IP: net.ParseIP(dst)})
+	}
+}
+
+func testFilterIDs(t *testing.T, dst *net.IPAddr) {
+	assert := assert.New(t)
+	proto := 4
+	if dst.IP.To4() == nil {
+		proto = 6
+	}
+	ids := make(chan ping.ID, 10)
+	c := New(proto, ModeRaw, func(p *ping.Ping, err error) {
+		if err == nil && (p.ID == 4340 || p.ID == 4341) {
+			ids <- p.ID
+		}
+	})
+	if err := c.Run(1); err != nil {
+		t.Logf("skipping ipv%v: %v", proto, err)
+		return
+	}
+	defer func() { assert.NoError(c.Stop()) }()
+	assert.NoError(c.AddID(4340))
+
+	// the reply to the foreign id is read first, if it is read at all
+	for _, id := range []ping.ID{4341, 4340} {
+		c.Send(ping.Ping{Dst: dst, ID: id}, func(_ time.Time, _ int, err error) { assert.NoError(err) })
+	}
+	select {
+	case id := <-ids:
+		assert.Equal(ping.ID(4340), id, "ipv%v", proto)
+	case <-time.After(time.Second):
+		t.Errorf("no reply on ipv%v", proto)
+	}
+
+	// the largest filter fits in the kernel
+	for id := ping.ID(0); id < maxFilterIDs; id++ {
+		assert.NoError(c.AddID(id))
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// attachFilter does nothing, socket filters are only supported on linux
+func attachFilter(s bpf.Setter, f []bpf.Instruction) error {
+	return nil
+}
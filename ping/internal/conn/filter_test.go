@@ -0,0 +1,112 @@
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func testFilter(t *testing.T, f []bpf.Instruction) func([]byte) bool {
+	vm, err := bpf.NewVM(f)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return func(b []byte) bool {
+		n, err := vm.Run(b)
+		assert.NoError(t, err)
+		return n >= len(b)
+	}
+}
+
+func marshal(t *testing.T, m *icmp.Message) []byte {
+	b, err := m.Marshal(nil)
+	assert.NoError(t, err)
+	return b
+}
+
+// withV4Header prepends an ip header with optLen bytes of options to b
+func withV4Header(b []byte, optLen int) []byte {
+	h := make([]byte, ipv4.HeaderLen+optLen)
+	h[0] = 4<<4 | byte(len(h)>>2)
+	h[9] = ping.ProtocolICMP
+	return append(h, b...)
+}
+
+func TestFilterV4(t *testing.T) {
+	assert := assert.New(t)
+	accepts := testFilter(t, filterV4([]ping.ID{1234, 4321, 1234}))
+	dst := net.ParseIP("198.51.100.1")
+
+	reply := func(id ping.ID) []byte {
+		return marshal(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: int(id), Data: make([]byte, ping.HeaderLength)},
+		})
+	}
+	assert.True(accepts(withV4Header(reply(1234), 0)))
+	assert.True(accepts(withV4Header(reply(4321), 0)))
+	assert.True(accepts(withV4Header(reply(4321), 8)))
+	assert.False(accepts(withV4Header(reply(1), 0)))
+	assert.False(accepts(withV4Header(echoRequest(t, ipv4.ICMPTypeEcho, 1234, 1), 0)))
+
+	unreach := func(id ping.ID) []byte {
+		return withV4Header(marshal(t, &icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1,
+			Body: &icmp.DstUnreach{Data: embeddedV4(t, dst, id, 1)},
+		}), 4)
+	}
+	assert.True(accepts(unreach(1234)))
+	assert.False(accepts(unreach(1)))
+	assert.True(accepts(withV4Header(marshal(t, &icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: embeddedV4(t, dst, 4321, 1)},
+	}), 0)))
+
+	// short packets are dropped rather than read past the end
+	assert.False(accepts(withV4Header(reply(1234)[:4], 0)))
+}
+
+func TestFilterV6(t *testing.T) {
+	assert := assert.New(t)
+	accepts := testFilter(t, filterV6([]ping.ID{1234}))
+	dst := net.ParseIP("2001:db8::1")
+
+	reply := func(id ping.ID) []byte {
+		return marshal(t, &icmp.Message{
+			Type: ipv6.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: int(id), Data: make([]byte, ping.HeaderLength)},
+		})
+	}
+	assert.True(accepts(reply(1234)))
+	assert.False(accepts(reply(1)))
+	assert.False(accepts(echoRequest(t, ipv6.ICMPTypeEchoRequest, 1234, 1)))
+
+	exceeded := func(id ping.ID) []byte {
+		return marshal(t, &icmp.Message{
+			Type: ipv6.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: embeddedV6(t, dst, id, 1)},
+		})
+	}
+	assert.True(accepts(exceeded(1234)))
+	assert.False(accepts(exceeded(1)))
+}
+
+func TestFilterTooManyIDs(t *testing.T) {
+	ids := make([]ping.ID, maxFilterIDs+1)
+	for i := range ids {
+		ids[i] = ping.ID(i)
+	}
+	assert.Len(t, filterV4(ids), 1)
+	assert.True(t, testFilter(t, filterV6(ids))([]byte{1}))
+
+	// the largest filter still assembles
+	_, err := bpf.Assemble(filterV4(ids[:maxFilterIDs]))
+	assert.NoError(t, err)
+}
@@ -1,107 +1,254 @@
 package conn
 
 import (
+	"encoding/binary"
 	"errors"
 	"net"
+	"os"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
-func newConn(proto int) conn {
+func newConn(proto int, mode Mode) conn {
 	switch proto {
 	case 4:
-		return &v4Conn{}
+		return &v4Conn{icmpConn: icmpConn{mode: mode}}
 	case 6:
-		return &v6Conn{}
+		return &v6Conn{icmpConn: icmpConn{mode: mode}}
 	default:
 		panic("bad protocol")
 	}
 }
 
 type icmpConn struct {
-	c *icmp.PacketConn
+	c    net.PacketConn
+	rc   syscall.RawConn
+	mode Mode
+	// datagram is set if the connection ended up on an unprivileged
+	// datagram socket, either by request or by falling back from raw.
+	datagram bool
 }
 
-func (c *icmpConn) writeTo(b []byte, dst *net.IPAddr) (int, error) { // nolint: interfacer
-	return c.c.WriteTo(b, dst)
+// listen opens the raw socket on rawNetwork, or the datagram socket on
+// dgramNetwork, depending on the mode. In ModeAuto the datagram socket is
+// only tried if opening the raw socket was not permitted.
+//
+// The sockets are opened here rather than with icmp.ListenPacket so the file
+// descriptor is available to set socket options, such as receive timestamps,
+// and to read from directly.
+func (c *icmpConn) listen(rawNetwork, dgramNetwork, address string) error {
+	err := c.open(rawNetwork, dgramNetwork, address)
+	if err != nil {
+		return err
+	}
+	sc, ok := c.c.(syscall.Conn)
+	if !ok {
+		return errors.New("icmp socket does not provide a raw connection")
+	}
+	c.rc, err = sc.SyscallConn()
+	return err
 }
 
-func (c *icmpConn) close() error {
-	return c.c.Close()
+func (c *icmpConn) open(rawNetwork, dgramNetwork, address string) error {
+	var err error
+	if c.mode != ModeDatagram {
+		c.c, err = net.ListenPacket(rawNetwork, address)
+		if err == nil || c.mode == ModeRaw || !isPermissionErr(err) {
+			return err
+		}
+	}
+	c.datagram = true
+	c.c, err = listenDatagram(dgramNetwork, address)
+	return err
 }
 
-func toPing(
-	srcAddr net.Addr,
-	src, dst net.IP,
-	rlen int,
-	ttl int,
-	received time.Time,
-) *ping.Ping {
-	p := &ping.Ping{
-		// Src and Dst are flipped, cause this is a ping that was sent to dst
-		// which has now come back
-		Src:      &net.IPAddr{IP: dst},
-		Dst:      &net.IPAddr{IP: src},
-		Len:      rlen,
-		TTL:      ttl,
-		Recieved: received,
-	}
-	if srcIPAddr, ok := srcAddr.(*net.IPAddr); ok {
-		if srcIPAddr.IP != nil {
-			p.Src = srcIPAddr
-		}
+func (c *icmpConn) addr(dst *net.IPAddr) net.Addr {
+	if c.datagram {
+		return &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
 	}
+	return dst
+}
 
-	return p
+func (c *icmpConn) isDatagram() bool {
+	return c.datagram
 }
 
-// ErrTooShort is returned if the icmp message is too short
-var ErrTooShort = errors.New("too short")
+func (c *icmpConn) setReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
 
-// ErrWrongType is returned if the packet is not an icmp packet
+func (c *icmpConn) close() error {
+	// nothing was opened if start failed
+	if c.c == nil {
+		return nil
+	}
+	return c.c.Close()
+}
+
+// ErrTooShort is returned if the icmp message is too short. It is the error
+// the ping package returns for an echo payload too short to read.
+var ErrTooShort = ping.ErrTooShort
+
+// ErrMalformed is returned if the icmp message could not be parsed
+var ErrMalformed = errors.New("malformed")
+
+// ErrWrongType is returned if the icmp message is not an echo reply or an error message
 var ErrWrongType = errors.New("wrong type")
 
-// ErrNotEcho is returned if the icmp message is not an echo
+// ErrNotEcho is returned if the icmp message is not an echo, or is an
+// error message for something other than an echo request
 var ErrNotEcho = errors.New("not echo")
 
-func parseEcho(
-	proto int,
-	typ icmp.Type,
-	payload []byte,
-	rlen int,
-) (
-	id ping.ID,
-	seq ping.Seq,
-	sent time.Time,
-	err error,
-) {
+// parse parses a recieved icmp message into p.
+//
+// Echo replies are parsed directly. For error messages the echo request
+// embedded in the message is parsed instead, and the returned error describes
+// the icmp error.
+func parse(p *ping.Ping, proto int, payload []byte, rlen int, datagram bool) error {
 	if len(payload) < rlen {
-		err = ErrTooShort
-		return
+		return ErrTooShort
 	}
 
-	var m *icmp.Message
-	m, err = icmp.ParseMessage(proto, payload[:rlen])
+	// echo replies are parsed in place, icmp.ParseMessage copies the payload
+	b := payload[:rlen]
+	if len(b) >= 8 && (proto == ping.ProtocolICMP && b[0] == byte(ipv4.ICMPTypeEchoReply) ||
+		proto == ping.ProtocolIPv6ICMP && b[0] == byte(ipv6.ICMPTypeEchoReply)) {
+		return parseEcho(p, int(binary.BigEndian.Uint16(b[4:6])), int(binary.BigEndian.Uint16(b[6:8])), b[8:], datagram)
+	}
+
+	m, err := icmp.ParseMessage(proto, b)
 	if err != nil {
-		return
+		return ErrMalformed
 	}
-	if m.Type != typ {
-		err = ErrWrongType
-		return
+
+	switch m.Type {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+		if b, ok := m.Body.(*icmp.DstUnreach); ok {
+			return parseEmbedded(p, proto, b.Data, &ping.UnreachableError{Code: m.Code, From: cloneAddr(p.Src)})
+		}
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		if b, ok := m.Body.(*icmp.TimeExceeded); ok {
+			return parseEmbedded(p, proto, b.Data, &ping.TimeExceededError{Code: m.Code, From: cloneAddr(p.Src)})
+		}
+	case ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem:
+		if b, ok := m.Body.(*icmp.ParamProb); ok {
+			return parseEmbedded(p, proto, b.Data, &ping.ParameterProblemError{Code: m.Code, Pointer: int(b.Pointer), From: cloneAddr(p.Src)})
+		}
 	}
+	return ErrWrongType
+}
 
-	e, ok := m.Body.(*icmp.Echo)
-	if !ok {
-		err = ErrNotEcho
-		return
+// parseEcho parses an echo reply. On datagram sockets the kernel rewrites the
+// ICMP ID to the local port of the socket, so the ID is taken from the payload
+// instead of the header.
+func parseEcho(p *ping.Ping, id, seq int, data []byte, datagram bool) error {
+	var err error
+	p.ID, p.Seq = ping.ID(id), ping.Seq(seq)
+	p.Sent, err = ping.BytesToTime(data)
+	if err != nil {
+		return err
+	}
+	if len(data) > ping.HeaderLength {
+		p.Data = data[ping.HeaderLength:]
+	}
+	if datagram {
+		if p.ID, err = ping.BytesToID(data); err != nil {
+			return err
+		}
+	}
+	p.Count, p.MAC, p.HasCount = parseCount(data)
+	return nil
+}
+
+// parseCount reads the count and MAC from an echo payload.
+// A truncated payload may not have them. The MAC is not copied, it is only
+// checked while the packet is handled.
+func parseCount(b []byte) (int, []byte, bool) {
+	c, err := ping.BytesToCount(b)
+	if err != nil {
+		return 0, nil, false
+	}
+	return c, b[ping.HeaderLength-ping.MACSliceLength : ping.HeaderLength], true
+}
+
+// cloneAddr copies a, so an error can keep it after the ping it came from is reused
+func cloneAddr(a *net.IPAddr) *net.IPAddr {
+	if a == nil {
+		return nil
+	}
+	return &net.IPAddr{IP: append(net.IP(nil), a.IP...), Zone: a.Zone}
+}
+
+// parseEmbedded parses the original datagram included in an icmp error message.
+// If it was one of our echo requests, p is updated to match it and icmpErr is returned.
+func parseEmbedded(p *ping.Ping, proto int, b []byte, icmpErr error) error {
+	var echoType byte
+	switch proto {
+	case ping.ProtocolICMP:
+		h, err := icmp.ParseIPv4Header(b)
+		if err != nil {
+			return ErrTooShort
+		}
+		if h.Protocol != ping.ProtocolICMP {
+			return ErrNotEcho
+		}
+		p.Dst = &net.IPAddr{IP: h.Dst}
+		b, echoType = b[h.Len:], byte(ipv4.ICMPTypeEcho)
+	case ping.ProtocolIPv6ICMP:
+		h, err := ipv6.ParseHeader(b)
+		if err != nil {
+			return ErrTooShort
+		}
+		if h.NextHeader != ping.ProtocolIPv6ICMP {
+			return ErrNotEcho
+		}
+		p.Dst = &net.IPAddr{IP: h.Dst}
+		b, echoType = b[ipv6.HeaderLen:], byte(ipv6.ICMPTypeEchoRequest)
 	}
 
-	id = ping.ID(e.ID)
-	seq = ping.Seq(e.Seq)
+	// type, code, checksum, id, seq
+	if len(b) < 8 {
+		return ErrTooShort
+	}
+	if b[0] != echoType {
+		return ErrNotEcho
+	}
+	p.ID = ping.ID(binary.BigEndian.Uint16(b[4:6]))
+	p.Seq = ping.Seq(binary.BigEndian.Uint16(b[6:8]))
+	// the quoted datagram may be cut short before the payload
+	if p.Count, p.MAC, p.HasCount = parseCount(b[8:]); p.HasCount {
+		p.Sent, _ = ping.BytesToTime(b[8:])
+	}
+	return icmpErr
+}
+
+// isErrno unwraps err and reports whether the underlying errno is one of errnos
+func isErrno(err error, errnos ...syscall.Errno) bool {
+	for {
+		switch e := err.(type) {
+		case syscall.Errno:
+			for _, errno := range errnos {
+				if e == errno {
+					return true
+				}
+			}
+			return false
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
 
-	sent, err = ping.BytesToTime(e.Data)
-	return
+func isPermissionErr(err error) bool {
+	return isErrno(err, syscall.EPERM, syscall.EACCES)
 }
@@ -0,0 +1,185 @@
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func echoRequest(t *testing.T, typ icmp.Type, id ping.ID, seq ping.Seq) []byte {
+	b, err := (&icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: int(id), Seq: int(seq), Data: make([]byte, ping.HeaderLength)},
+	}).Marshal(nil)
+	assert.NoError(t, err)
+	return b
+}
+
+func embeddedV4(t *testing.T, dst net.IP, id ping.ID, seq ping.Seq) []byte {
+	h := make([]byte, ipv4.HeaderLen)
+	h[0] = 4<<4 | ipv4.HeaderLen>>2
+	h[9] = ping.ProtocolICMP
+	copy(h[16:20], dst.To4())
+	return append(h, echoRequest(t, ipv4.ICMPTypeEcho, id, seq)...)
+}
+
+func embeddedV6(t *testing.T, dst net.IP, id ping.ID, seq ping.Seq) []byte {
+	h := make([]byte, ipv6.HeaderLen)
+	h[0] = 6 << 4
+	e := echoRequest(t, ipv6.ICMPTypeEchoRequest, id, seq)
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(e)))
+	h[6] = ping.ProtocolIPv6ICMP
+	copy(h[24:40], dst.To16())
+	return append(h, e...)
+}
+
+func testParse(t *testing.T, proto int, m *icmp.Message) (*ping.Ping, error) {
+	b, err := m.Marshal(nil)
+	assert.NoError(t, err)
+	from := &net.IPAddr{IP: net.ParseIP("192.0.2.254")}
+	p := &ping.Ping{Src: from}
+	return p, parse(p, proto, b, len(b), false)
+}
+
+func TestParseV4Errors(t *testing.T) {
+	assert := assert.New(t)
+	dst := net.ParseIP("198.51.100.1")
+	data := embeddedV4(t, dst, 1234, 56)
+
+	p, err := testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1,
+		Body: &icmp.DstUnreach{Data: data},
+	})
+	if ue, ok := err.(*ping.UnreachableError); assert.True(ok, "unexpected error %v", err) {
+		assert.Equal(1, ue.Code)
+		assert.Equal(p.Src, ue.From)
+	}
+	assert.True(dst.Equal(p.Dst.IP))
+	assert.Equal(ping.ID(1234), p.ID)
+	assert.Equal(ping.Seq(56), p.Seq)
+	assert.True(p.HasCount)
+
+	// quotes of only the ip header and the first 8 bytes do not have the count
+	p, _ = testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1,
+		Body: &icmp.DstUnreach{Data: data[:ipv4.HeaderLen+8]},
+	})
+	assert.Equal(ping.Seq(56), p.Seq)
+	assert.False(p.HasCount)
+
+	p, err = testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: data},
+	})
+	_, ok := err.(*ping.TimeExceededError)
+	assert.True(ok, "unexpected error %v", err)
+	assert.Equal(ping.ID(1234), p.ID)
+
+	p, err = testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeParameterProblem,
+		Body: &icmp.ParamProb{Pointer: 8, Data: data},
+	})
+	if pe, ok := err.(*ping.ParameterProblemError); assert.True(ok, "unexpected error %v", err) {
+		assert.Equal(8, pe.Pointer)
+	}
+	assert.Equal(ping.Seq(56), p.Seq)
+}
+
+func TestParseV6Errors(t *testing.T) {
+	assert := assert.New(t)
+	dst := net.ParseIP("2001:db8::1")
+	data := embeddedV6(t, dst, 4321, 65)
+
+	p, err := testParse(t, ping.ProtocolIPv6ICMP, &icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable, Code: 3,
+		Body: &icmp.DstUnreach{Data: data},
+	})
+	if ue, ok := err.(*ping.UnreachableError); assert.True(ok, "unexpected error %v", err) {
+		assert.Equal(3, ue.Code)
+	}
+	assert.True(dst.Equal(p.Dst.IP))
+	assert.Equal(ping.ID(4321), p.ID)
+	assert.Equal(ping.Seq(65), p.Seq)
+
+	_, err = testParse(t, ping.ProtocolIPv6ICMP, &icmp.Message{
+		Type: ipv6.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: data},
+	})
+	_, ok := err.(*ping.TimeExceededError)
+	assert.True(ok, "unexpected error %v", err)
+}
+
+func TestParseNotEcho(t *testing.T) {
+	assert := assert.New(t)
+	data := embeddedV4(t, net.ParseIP("198.51.100.1"), 1, 1)
+	data[9] = 17 // udp
+	_, err := testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3,
+		Body: &icmp.DstUnreach{Data: data},
+	})
+	assert.Equal(ErrNotEcho, err)
+
+	_, err = testParse(t, ping.ProtocolICMP, &icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{Data: make([]byte, ping.HeaderLength)},
+	})
+	assert.Equal(ErrWrongType, err)
+}
+
+func TestParseShort(t *testing.T) {
+	assert := assert.New(t)
+	// an echo reply whose payload is cut before the sent time
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1234, Seq: 56, Data: make([]byte, 4)},
+	}).Marshal(nil)
+	assert.NoError(err)
+
+	rb := newReadBatch(2)
+	copy(rb.payloads[0], b)
+	rb.pkts[0] = packet{src: netip.MustParseAddr("127.0.0.1"), rlen: len(b), received: time.Now()}
+	rb.parse(0, ping.ProtocolICMP, false)
+	assert.Equal(ErrTooShort, rb.errs[0])
+	assert.True(isParseErr(rb.errs[0]), "a short echo reply should not be handled")
+
+	// too short for icmp to parse at all
+	rb.pkts[1] = packet{src: netip.MustParseAddr("127.0.0.1"), rlen: 2, received: time.Now()}
+	rb.parse(1, ping.ProtocolICMP, false)
+	assert.Equal(ErrMalformed, rb.errs[1])
+	assert.True(isParseErr(rb.errs[1]))
+
+	var st Stats
+	st.read(rb, 2)
+	assert.Equal(uint64(2), st.Read)
+	assert.Equal(uint64(1), st.TooShort)
+	assert.Equal(uint64(1), st.Malformed)
+}
+
+func TestParseAllocs(t *testing.T) {
+	assert := assert.New(t)
+	b, err := (&ping.Ping{Dst: loopback, ID: 1234, Seq: 56, Count: 56, Sent: time.Now()}).ToICMPMsg()
+	assert.NoError(err)
+	b[0] = byte(ipv4.ICMPTypeEchoReply)
+
+	rb := newReadBatch(1)
+	copy(rb.payloads[0], b)
+	rb.pkts[0] = packet{src: netip.MustParseAddr("127.0.0.1"), rlen: len(b), received: time.Now()}
+	allocs := testing.AllocsPerRun(100, func() {
+		rb.parse(0, ping.ProtocolICMP, false)
+	})
+	assert.Zero(allocs)
+	if assert.NoError(rb.errs[0]) {
+		assert.Equal(ping.ID(1234), rb.pings[0].ID)
+		assert.Equal(56, rb.pings[0].Count)
+		assert.Equal("127.0.0.1", rb.pings[0].Src.String())
+	}
+}
@@ -0,0 +1,94 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+package conn
+
+import (
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// sysBatch holds the messages ReadBatch reads into.
+// ipv4.Message and ipv6.Message are the same type, so ms is used by both.
+type sysBatch struct {
+	ms []ipv4.Message
+	// raw and datagram hold the buffers for each message, raw ipv4 sockets
+	// read the ip header into a separate buffer.
+	raw, datagram [][][]byte
+}
+
+func (s *sysBatch) init(rb *readBatch) {
+	n := len(rb.payloads)
+	s.ms = make([]ipv4.Message, n)
+	s.raw = make([][][]byte, n)
+	s.datagram = make([][][]byte, n)
+	for i := range s.ms {
+		s.raw[i] = [][]byte{rb.hdrs[i], rb.payloads[i]}
+		s.datagram[i] = [][]byte{rb.payloads[i]}
+		s.ms[i].OOB = rb.oobs[i]
+	}
+}
+
+// readV4 reads a batch of packets with their control messages into rb.
+// Like ReadFrom, the ip header that raw sockets recieve is stripped.
+// These platforms only read one packet per ReadBatch.
+func readV4(c *v4Conn, rb *readBatch) (int, error) {
+	ms := rb.sys.ms
+	for i := range ms {
+		ms[i].Buffers = rb.sys.raw[i]
+		if c.datagram {
+			ms[i].Buffers = rb.sys.datagram[i]
+		}
+	}
+	n, err := c.p4.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		m, pkt := &ms[i], &rb.pkts[i]
+		*pkt = packet{src: addrOf(m.Addr), rlen: m.N, received: now, source: ping.TimestampUser}
+		if !c.datagram {
+			pkt.rlen = stripHeader(rb.hdrs[i], rb.payloads[i], pkt.rlen)
+		}
+		oob := m.OOB[:m.NN]
+		var cm ipv4.ControlMessage
+		if cm.Parse(oob) == nil {
+			pkt.dst, pkt.ttl = ping.Addr(cm.Dst), cm.TTL
+		}
+		if t, ts, ok := parseTimestamp(oob); ok {
+			pkt.received, pkt.source = t, ts
+		}
+	}
+	return n, nil
+}
+
+// readV6 reads a batch of packets with their control messages into rb.
+func readV6(c *v6Conn, rb *readBatch) (int, error) {
+	ms := rb.sys.ms
+	for i := range ms {
+		ms[i].Buffers = rb.sys.datagram[i]
+	}
+	n, err := c.p6.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		m, pkt := &ms[i], &rb.pkts[i]
+		*pkt = packet{src: addrOf(m.Addr), rlen: m.N, received: now, source: ping.TimestampUser}
+		oob := m.OOB[:m.NN]
+		var cm ipv6.ControlMessage
+		if cm.Parse(oob) == nil {
+			pkt.dst, pkt.ttl = ping.Addr(cm.Dst), cm.HopLimit
+		}
+		if t, ts, ok := parseTimestamp(oob); ok {
+			pkt.received, pkt.source = t, ts
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,170 @@
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// mmsghdr is struct mmsghdr from linux/socket.h
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// sysBatch holds the recvmmsg headers of a readBatch, pointing at its buffers.
+// Reading into them does not allocate, unlike ReadBatch, which allocates the
+// address of every packet and a slice to parse its control messages into.
+type sysBatch struct {
+	hs    []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6
+	zones map[uint32]string
+	// read is passed to RawConn.Read. It is built once, a new closure for
+	// every read would allocate.
+	read func(fd uintptr) bool
+	n    int
+	err  syscall.Errno
+}
+
+func (s *sysBatch) init(rb *readBatch) {
+	n := len(rb.payloads)
+	s.hs = make([]mmsghdr, n)
+	s.iovs = make([]syscall.Iovec, 2*n)
+	s.names = make([]syscall.RawSockaddrInet6, n)
+	s.zones = make(map[uint32]string)
+	for i := range s.hs {
+		s.iovs[2*i].Base = &rb.hdrs[i][0]
+		s.iovs[2*i].SetLen(len(rb.hdrs[i]))
+		s.iovs[2*i+1].Base = &rb.payloads[i][0]
+		s.iovs[2*i+1].SetLen(len(rb.payloads[i]))
+		s.hs[i].hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		s.hs[i].hdr.Control = &rb.oobs[i][0]
+	}
+	s.read = func(fd uintptr) bool {
+		for {
+			n, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.hs[0])), uintptr(len(s.hs)), 0, 0, 0)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+			s.n, s.err = int(n), e
+			return true
+		}
+	}
+}
+
+func readV4(c *v4Conn, rb *readBatch) (int, error) {
+	return readBatchLinux(c.rc, !c.datagram, rb)
+}
+
+func readV6(c *v6Conn, rb *readBatch) (int, error) {
+	return readBatchLinux(c.rc, false, rb)
+}
+
+// readBatchLinux reads a batch of packets with their control messages into rb
+// with recvmmsg. If hdr is set the packets start with an ipv4 header, it is
+// read into rb.hdrs and stripped like ReadFrom does.
+func readBatchLinux(rc syscall.RawConn, hdr bool, rb *readBatch) (int, error) {
+	s := &rb.sys
+	for i := range s.hs {
+		h := &s.hs[i].hdr
+		if hdr {
+			h.Iov, h.Iovlen = &s.iovs[2*i], 2
+		} else {
+			h.Iov, h.Iovlen = &s.iovs[2*i+1], 1
+		}
+		h.Namelen = syscall.SizeofSockaddrInet6
+		h.SetControllen(len(rb.oobs[i]))
+		h.Flags = 0
+	}
+	if err := rc.Read(s.read); err != nil {
+		return 0, err
+	}
+	if s.err != 0 {
+		return 0, os.NewSyscallError("recvmmsg", s.err)
+	}
+
+	now := time.Now()
+	for i := 0; i < s.n; i++ {
+		pkt := &rb.pkts[i]
+		*pkt = packet{src: s.addr(i), rlen: int(s.hs[i].len), received: now, source: ping.TimestampUser}
+		if hdr {
+			pkt.rlen = stripHeader(rb.hdrs[i], rb.payloads[i], pkt.rlen)
+		}
+		parseControl(rb.oobs[i][:s.hs[i].hdr.Controllen], pkt)
+	}
+	return s.n, nil
+}
+
+// addr returns the address a packet came from
+func (s *sysBatch) addr(i int) netip.Addr {
+	sa := &s.names[i]
+	switch sa.Family {
+	case syscall.AF_INET:
+		return netip.AddrFrom4((*syscall.RawSockaddrInet4)(unsafe.Pointer(sa)).Addr)
+	case syscall.AF_INET6:
+		a := netip.AddrFrom16(sa.Addr)
+		if sa.Scope_id != 0 {
+			a = a.WithZone(s.zone(sa.Scope_id))
+		}
+		return a
+	}
+	return netip.Addr{}
+}
+
+// zone returns the name of an interface, the names are cached so link local
+// replies do not need a lookup each time
+func (s *sysBatch) zone(index uint32) string {
+	z, ok := s.zones[index]
+	if !ok {
+		z = strconv.Itoa(int(index))
+		if ifi, err := net.InterfaceByIndex(int(index)); err == nil {
+			z = ifi.Name
+		}
+		s.zones[index] = z
+	}
+	return z
+}
+
+// parseControl reads the destination, ttl, receive timestamp and drop count of a packet
+// from its control messages. It walks them in place, where
+// syscall.ParseSocketControlMessage would allocate.
+func parseControl(oob []byte, pkt *packet) {
+	for len(oob) >= syscall.SizeofCmsghdr {
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		l := int(h.Len)
+		if l < syscall.SizeofCmsghdr || l > len(oob) {
+			return
+		}
+		data := oob[syscall.CmsgLen(0):l]
+		switch {
+		case h.Level == syscall.IPPROTO_IP && h.Type == syscall.IP_PKTINFO && len(data) >= syscall.SizeofInet4Pktinfo:
+			pkt.dst = netip.AddrFrom4((*syscall.Inet4Pktinfo)(unsafe.Pointer(&data[0])).Addr)
+		case h.Level == syscall.IPPROTO_IPV6 && h.Type == syscall.IPV6_PKTINFO && len(data) >= syscall.SizeofInet6Pktinfo:
+			pkt.dst = netip.AddrFrom16((*syscall.Inet6Pktinfo)(unsafe.Pointer(&data[0])).Addr)
+		case h.Level == syscall.IPPROTO_IP && h.Type == syscall.IP_TTL && len(data) >= 4,
+			h.Level == syscall.IPPROTO_IPV6 && h.Type == syscall.IPV6_HOPLIMIT && len(data) >= 4:
+			pkt.ttl = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == syscall.SOL_SOCKET && h.Type == syscall.SO_RXQ_OVFL && len(data) >= 4:
+			pkt.drops = *(*uint32)(unsafe.Pointer(&data[0]))
+		case h.Level == syscall.SOL_SOCKET:
+			if t, ts, ok := timestampOf(int(h.Type), data); ok {
+				pkt.received, pkt.source = t, ts
+			}
+		}
+		next := syscall.CmsgSpace(l - syscall.CmsgLen(0))
+		if next > len(oob) {
+			return
+		}
+		oob = oob[next:]
+	}
+}
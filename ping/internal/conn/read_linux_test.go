@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestReadAllocs(t *testing.T) {
+	for _, mode := range []Mode{ModeRaw, ModeDatagram} {
+		for _, proto := range []int{4, 6} {
+			testReadAllocs(t, mode, proto)
+		}
+	}
+}
+
+func testReadAllocs(t *testing.T, mode Mode, proto int) {
+	assert := assert.New(t)
+	c := newConn(proto, mode)
+	if err := c.start(); err != nil {
+		t.Logf("skipping mode %v ipv%v: %v", mode, proto, err)
+		return
+	}
+	defer func() { _ = c.close() }()
+
+	const runs = 50
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	if proto == 6 {
+		dst = &net.IPAddr{IP: net.ParseIP("::1")}
+	}
+	// every run reads one packet, so they are all sent first
+	rs := make([]*sendReq, runs+1)
+	for i := range rs {
+		rs[i] = &sendReq{p: ping.Ping{Dst: dst, ID: 4325, Seq: ping.Seq(i)}}
+	}
+	sendBatch(c, rs)
+	for _, r := range rs {
+		if !assert.NoError(r.err) {
+			return
+		}
+	}
+
+	rb := newReadBatch(1)
+	var read int
+	allocs := testing.AllocsPerRun(runs, func() {
+		n, err := c.read(rb)
+		assert.NoError(err)
+		read += n
+	})
+	assert.Zero(allocs, "mode %v ipv%v", mode, proto)
+	assert.Equal(runs+1, read, "mode %v ipv%v", mode, proto)
+}
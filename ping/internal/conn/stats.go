@@ -0,0 +1,66 @@
+package conn
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stats are the counters of a Conn, they are kept across restarts
+type Stats struct {
+	// Read is the number of packets read
+	Read uint64
+	// Sent is the number of pings written
+	Sent uint64
+	// TooShort, Malformed, WrongType and NotEcho count the packets that failed to parse with each error
+	TooShort  uint64
+	Malformed uint64
+	WrongType uint64
+	NotEcho   uint64
+	// SendRetries is the number of times a write was retried because the kernel was out of buffer space
+	SendRetries uint64
+}
+
+// Stats returns a snapshot of the counters of the Conn
+func (c *Conn) Stats() Stats {
+	s := &c.stats
+	return Stats{
+		Read:        atomic.LoadUint64(&s.Read),
+		Sent:        atomic.LoadUint64(&s.Sent),
+		TooShort:    atomic.LoadUint64(&s.TooShort),
+		Malformed:   atomic.LoadUint64(&s.Malformed),
+		WrongType:   atomic.LoadUint64(&s.WrongType),
+		NotEcho:     atomic.LoadUint64(&s.NotEcho),
+		SendRetries: atomic.LoadUint64(&s.SendRetries),
+	}
+}
+
+// read counts the packets of a read and their parse errors
+func (s *Stats) read(rb *readBatch, n int) {
+	atomic.AddUint64(&s.Read, uint64(n))
+	for _, err := range rb.errs[:n] {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrTooShort):
+			atomic.AddUint64(&s.TooShort, 1)
+		case errors.Is(err, ErrMalformed):
+			atomic.AddUint64(&s.Malformed, 1)
+		case errors.Is(err, ErrWrongType):
+			atomic.AddUint64(&s.WrongType, 1)
+		case errors.Is(err, ErrNotEcho):
+			atomic.AddUint64(&s.NotEcho, 1)
+		}
+	}
+}
+
+// isParseErr returns true if err is a packet that failed to parse,
+// rather than a reply or an ICMP error for one of our echo requests
+func isParseErr(err error) bool {
+	return errors.Is(err, ErrTooShort) || errors.Is(err, ErrMalformed) ||
+		errors.Is(err, ErrWrongType) || errors.Is(err, ErrNotEcho)
+}
+
+// sent counts the pings written by a batch, and the retries it took
+func (s *Stats) sent(sent, retries int) {
+	atomic.AddUint64(&s.Sent, uint64(sent))
+	atomic.AddUint64(&s.SendRetries, uint64(retries))
+}
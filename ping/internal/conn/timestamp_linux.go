@@ -0,0 +1,66 @@
+package conn
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// SO_TIMESTAMPING flags, from linux/net_tstamp.h
+const (
+	sofTimestampingRxSoftware = 1 << 3
+	sofTimestampingSoftware   = 1 << 4
+)
+
+// timestampOOBLen is the room needed for the largest timestamp control message,
+// the three timespecs of SCM_TIMESTAMPING
+var timestampOOBLen = syscall.CmsgSpace(3 * int(unsafe.Sizeof(syscall.Timespec{})))
+
+// enableTimestamps asks the kernel to timestamp recieved packets with SO_TIMESTAMPING,
+// or SO_TIMESTAMPNS if that can not be enabled. If neither can be enabled packets are
+// timestamped in user space.
+//
+// Only software timestamps are requested. Hardware timestamps come from the clock of
+// the network card, not CLOCK_REALTIME, so they can not be compared with Sent.
+func enableTimestamps(c net.PacketConn) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = rc.Control(func(fd uintptr) {
+		flags := sofTimestampingRxSoftware | sofTimestampingSoftware
+		if syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags) == nil {
+			return
+		}
+		_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// timestampOf returns the receive timestamp in a SOL_SOCKET control message
+func timestampOf(typ int, data []byte) (time.Time, ping.TimestampSource, bool) {
+	tsLen := int(unsafe.Sizeof(syscall.Timespec{}))
+	switch typ {
+	case syscall.SO_TIMESTAMPING:
+		// software, deprecated, raw hardware. Only software is requested.
+		if len(data) < tsLen {
+			break
+		}
+		if sw := (*syscall.Timespec)(unsafe.Pointer(&data[0])); sw.Nano() != 0 {
+			return time.Unix(0, sw.Nano()), ping.TimestampKernel, true
+		}
+	case syscall.SO_TIMESTAMPNS:
+		if len(data) < tsLen {
+			break
+		}
+		ts := (*syscall.Timespec)(unsafe.Pointer(&data[0]))
+		return time.Unix(0, ts.Nano()), ping.TimestampKernel, true
+	}
+	return time.Time{}, ping.TimestampUser, false
+}
@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestKernelTimestamps(t *testing.T) {
+	for _, mode := range []Mode{ModeRaw, ModeDatagram} {
+		for _, proto := range []int{4, 6} {
+			testKernelTimestamp(t, mode, proto)
+		}
+	}
+}
+
+func testKernelTimestamp(t *testing.T, mode Mode, proto int) {
+	assert := assert.New(t)
+	c := newConn(proto, mode)
+	if err := c.start(); err != nil {
+		t.Logf("skipping mode %v ipv%v: %v", mode, proto, err)
+		return
+	}
+	defer func() { _ = c.close() }()
+
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	if proto == 6 {
+		dst.IP = net.ParseIP("::1")
+	}
+	p := &ping.Ping{Dst: dst, ID: 4321, Seq: 1, Count: 1, Sent: time.Now()}
+	b, err := p.ToICMPMsg()
+	assert.NoError(err)
+	_, err = c.writeTo(b, dst, 0)
+	assert.NoError(err)
+
+	// a lost reply fails the test instead of hanging it
+	assert.NoError(c.setReadDeadline(time.Now().Add(5 * time.Second)))
+	rb := newReadBatch(readBatchLen)
+	for {
+		n, err := c.read(rb)
+		if !assert.NoError(err, "mode %v ipv%v", mode, proto) {
+			return
+		}
+		for i := 0; i < n; i++ {
+			rp := rb.pings[i]
+			if rb.errs[i] != nil || rp.Count != p.Count || !rp.HasCount {
+				continue
+			}
+			assert.Equal(ping.TimestampKernel, rp.RecievedSource, "mode %v ipv%v", mode, proto)
+			assert.True(rp.Dst.IP.Equal(dst.IP))
+			assert.False(rp.Recieved.Before(p.Sent))
+			assert.WithinDuration(time.Now(), rp.Recieved, time.Second)
+			return
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package conn
+
+import (
+	"net"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// timestampOOBLen is zero, receive timestamps are only supported on linux
+const timestampOOBLen = 0
+
+func enableTimestamps(c net.PacketConn) {}
+
+func parseTimestamp(oob []byte) (time.Time, ping.TimestampSource, bool) {
+	return time.Time{}, ping.TimestampUser, false
+}
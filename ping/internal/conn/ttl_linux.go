@@ -0,0 +1,24 @@
+package conn
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+)
+
+// writeV4TTL writes b to dst with the ttl set by a control message.
+// golang.org/x/net/ipv4 does not marshal the ttl of outgoing control messages, so it is built here.
+func writeV4TTL(c *ipv4.PacketConn, b []byte, ttl int, dst net.Addr) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_TTL
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = int32(ttl)
+
+	ms := []ipv4.Message{{Buffers: [][]byte{b}, OOB: oob, Addr: dst}}
+	_, err := c.WriteBatch(ms, 0)
+	return ms[0].N, err
+}
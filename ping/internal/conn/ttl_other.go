@@ -0,0 +1,13 @@
+// +build !linux
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+func writeV4TTL(c *ipv4.PacketConn, b []byte, ttl int, dst net.Addr) (int, error) {
+	return 0, ErrTTLNotSupported
+}
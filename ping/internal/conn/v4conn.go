@@ -1,7 +1,8 @@
 package conn
 
 import (
-	"golang.org/x/net/icmp"
+	"net"
+
 	"golang.org/x/net/ipv4"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
@@ -9,25 +10,48 @@ import (
 
 type v4Conn struct {
 	icmpConn
+	p4 *ipv4.PacketConn
 }
 
 func (c *v4Conn) start() error {
-	var err error
-	c.c, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	err := c.listen("ip4:icmp", "udp4", "0.0.0.0")
 	if err != nil {
 		return err
 	}
-	err = setupV4Conn(c.c.IPv4PacketConn())
+	c.p4 = ipv4.NewPacketConn(c.c)
+	enableTimestamps(c.c)
+	enableDrops(c.c)
+	err = setupV4Conn(c.p4, c.datagram)
 	return err
 }
 
-func (c *v4Conn) read() (*ping.Ping, error) {
-	payload, srcAddr, src, dst, rlen, ttl, received, err := readV4(c.c.IPv4PacketConn(), 18)
-	p := toPing(srcAddr, src, dst, rlen, ttl, received)
-	if err != nil {
-		return p, err
+// read reads a batch of packets and parses them
+func (c *v4Conn) read(rb *readBatch) (int, error) {
+	n, err := readV4(c, rb)
+	for i := 0; i < n; i++ {
+		rb.parse(i, ping.ProtocolICMP, c.datagram)
+	}
+	return n, err
+}
+
+// writeTo writes b to dst. If ttl is not zero it overrides the ttl of the packet.
+func (c *v4Conn) writeTo(b []byte, dst *net.IPAddr, ttl int) (int, error) {
+	if ttl == 0 {
+		return c.c.WriteTo(b, c.addr(dst))
+	}
+	return writeV4TTL(c.p4, b, ttl, c.addr(dst))
+}
+
+// writeBatch writes the pings in rs with as few syscalls as possible
+func (c *v4Conn) writeBatch(rs []*sendReq) (int, error) {
+	return writeBatch(c.p4, c.c, c.messages(rs))
+}
+
+// setFilter sets the socket to only recieve replies to ids. Datagram sockets
+// are left alone, the kernel only delivers their own replies to them.
+func (c *v4Conn) setFilter(ids []ping.ID) error {
+	if c.datagram {
+		return nil
 	}
-	p.ID, p.Seq, p.Sent, err = parseEcho(ping.ProtocolICMP,
-		ipv4.ICMPTypeEchoReply, payload, rlen)
-	return p, err
+	return attachFilter(c.p4, filterV4(ids))
 }
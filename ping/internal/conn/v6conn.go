@@ -1,7 +1,8 @@
 package conn
 
 import (
-	"golang.org/x/net/icmp"
+	"net"
+
 	"golang.org/x/net/ipv6"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
@@ -9,25 +10,48 @@ import (
 
 type v6Conn struct {
 	icmpConn
+	p6 *ipv6.PacketConn
 }
 
 func (c *v6Conn) start() error {
-	var err error
-	c.c, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	err := c.listen("ip6:ipv6-icmp", "udp6", "::")
 	if err != nil {
 		return err
 	}
-	err = setupV6Conn(c.c.IPv6PacketConn())
+	c.p6 = ipv6.NewPacketConn(c.c)
+	enableTimestamps(c.c)
+	enableDrops(c.c)
+	err = setupV6Conn(c.p6, c.datagram)
 	return err
 }
 
-func (c *v6Conn) read() (*ping.Ping, error) {
-	payload, srcAddr, src, dst, rlen, ttl, received, err := readV6(c.c.IPv6PacketConn(), 18)
-	p := toPing(srcAddr, src, dst, rlen, ttl, received)
-	if err != nil {
-		return p, err
+// read reads a batch of packets and parses them
+func (c *v6Conn) read(rb *readBatch) (int, error) {
+	n, err := readV6(c, rb)
+	for i := 0; i < n; i++ {
+		rb.parse(i, ping.ProtocolIPv6ICMP, c.datagram)
+	}
+	return n, err
+}
+
+// writeTo writes b to dst. If ttl is not zero it overrides the hop limit of the packet.
+func (c *v6Conn) writeTo(b []byte, dst *net.IPAddr, ttl int) (int, error) {
+	if ttl == 0 {
+		return c.c.WriteTo(b, c.addr(dst))
+	}
+	return c.p6.WriteTo(b, &ipv6.ControlMessage{HopLimit: ttl}, c.addr(dst))
+}
+
+// writeBatch writes the pings in rs with as few syscalls as possible
+func (c *v6Conn) writeBatch(rs []*sendReq) (int, error) {
+	return writeBatch(c.p6, c.c, c.messages(rs))
+}
+
+// setFilter sets the socket to only recieve replies to ids. Datagram sockets
+// are left alone, the kernel only delivers their own replies to them.
+func (c *v6Conn) setFilter(ids []ping.ID) error {
+	if c.datagram {
+		return nil
 	}
-	p.ID, p.Seq, p.Sent, err = parseEcho(ping.ProtocolIPv6ICMP,
-		ipv6.ICMPTypeEchoReply, payload, rlen)
-	return p, err
+	return attachFilter(c.p6, filterV6(ids))
 }
@@ -2,13 +2,154 @@ package conn
 
 import (
 	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
-func (c *Conn) runWorkers(ctx context.Context, workers int, read func() (*ping.Ping, error), handle func(*ping.Ping, error)) {
-	for w := 0; w < workers; w++ {
-		go c.singleWorker(ctx, read, handle)
+// maxPacketLen is the size of each buffer a worker reads into
+const maxPacketLen = 1 << 16
+
+// scaleInterval is how often a scaling pool is resized
+const scaleInterval = time.Second
+
+// pool holds the workers reading one open conn. Workers are started and
+// stopped while it runs to match its size.
+type pool struct {
+	// reads and full count the reads of the workers and the ones that filled
+	// their batch, they are first so they are 64 bit aligned for atomic access
+	reads, full uint64
+	// drops is the last count the kernel reported of packets dropped because
+	// the receive buffer was full
+	drops uint32
+
+	ctx    context.Context
+	conn   conn
+	handle func(*ping.Ping, error)
+	stats  *Stats
+	wg     *sync.WaitGroup
+
+	l       sync.Mutex
+	running int
+	size    int
+	// shrunk is closed once the workers stopped by shrinking the pool have
+	// exited. Until then the read deadline of conn is in the past, so blocked
+	// workers wake up to see if they are still needed.
+	shrunk chan struct{}
+
+	// the counts at the last scale, only used by the scaler
+	lastReads, lastFull uint64
+	lastDrops           uint32
+}
+
+func newPool(ctx context.Context, c conn, handle func(*ping.Ping, error), stats *Stats, wg *sync.WaitGroup) *pool {
+	return &pool{ctx: ctx, conn: c, handle: handle, stats: stats, wg: wg}
+}
+
+// resize starts or stops workers until size are running. Workers that are
+// stopped exit once they have handled their current read.
+func (p *pool) resize(size int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.size = size
+	for ; p.running < p.size; p.running++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	if p.running > p.size && p.shrunk == nil {
+		p.shrunk = make(chan struct{})
+		_ = p.conn.setReadDeadline(time.Now())
+	}
+	p.woken()
+}
+
+// woken clears the read deadline once no more workers need to exit,
+// it is called with the lock held
+func (p *pool) woken() {
+	if p.shrunk == nil || p.running > p.size {
+		return
+	}
+	_ = p.conn.setReadDeadline(time.Time{})
+	close(p.shrunk)
+	p.shrunk = nil
+}
+
+// workers returns the number of running workers
+func (p *pool) workers() int {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.running
+}
+
+// retire returns true if the worker calling it is no longer needed, it must exit
+func (p *pool) retire() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.running <= p.size {
+		return false
+	}
+	p.running--
+	p.woken()
+	return true
+}
+
+// waitShrunk blocks while the pool is shrinking, so the workers staying do
+// not spin on the read deadline
+func (p *pool) waitShrunk() {
+	p.l.Lock()
+	ch := p.shrunk
+	p.l.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	case <-p.ctx.Done():
+	}
+}
+
+// scale returns the size the pool should be, between min and max workers.
+// It grows while the kernel drops packets or most reads fill their batch,
+// meaning more packets were waiting, and shrinks while neither happens.
+func (p *pool) scale(min, max int) int {
+	reads, full := atomic.LoadUint64(&p.reads), atomic.LoadUint64(&p.full)
+	drops := atomic.LoadUint32(&p.drops)
+	reads, full, dropped := reads-p.lastReads, full-p.lastFull, drops != p.lastDrops
+	p.lastReads, p.lastFull, p.lastDrops = p.lastReads+reads, p.lastFull+full, drops
+
+	p.l.Lock()
+	size := p.size
+	p.l.Unlock()
+	switch {
+	case dropped || 2*full > reads:
+		size++
+	case full == 0:
+		size--
+	}
+	if size > max {
+		size = max
+	}
+	if size < min {
+		size = min
+	}
+	return size
+}
+
+// count records a read of n packets for scaling
+func (p *pool) count(rb *readBatch, n int) {
+	atomic.AddUint64(&p.reads, 1)
+	if n == len(rb.pkts) {
+		atomic.AddUint64(&p.full, 1)
+	}
+	for i := 0; i < n; i++ {
+		if d := rb.pkts[i].drops; d != 0 {
+			atomic.StoreUint32(&p.drops, d)
+		}
 	}
 }
 
@@ -21,12 +162,106 @@ func ctxDone(ctx context.Context) bool {
 	return false
 }
 
-func (c *Conn) singleWorker(ctx context.Context, read func() (*ping.Ping, error), handle func(*ping.Ping, error)) {
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (p *pool) worker() {
+	defer p.wg.Done()
+	// the buffers are reused, the parsed pings do not reference them
+	rb := newReadBatch(readBatchLen)
 	for {
-		p, err := read()
-		if ctxDone(ctx) {
+		n, err := p.conn.read(rb)
+		if ctxDone(p.ctx) {
+			return
+		}
+		switch {
+		case isTimeout(err):
+			// woken to shrink the pool
+		case err != nil:
+			p.handle(&ping.Ping{Src: &net.IPAddr{}, Dst: &net.IPAddr{}}, err)
+		default:
+			p.count(rb, n)
+			p.stats.read(rb, n)
+		}
+		for i := 0; i < n; i++ {
+			if isParseErr(rb.errs[i]) {
+				// not a response to an echo request, nothing to match it to.
+				// They are counted in the stats.
+				continue
+			}
+			p.handle(rb.pings[i], rb.errs[i])
+		}
+		if p.retire() {
 			return
 		}
-		handle(p, err)
+		if isTimeout(err) {
+			p.waitShrunk()
+		}
+	}
+}
+
+// SetWorkers sets the number of workers reading from the Conn. If it is
+// running workers are started or stopped to match.
+func (c *Conn) SetWorkers(n int) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.workers = n
+	c.resize()
+}
+
+// SetScaling sets the Conn to scale its workers between min and max.
+// If max is zero the number of workers is only changed by SetWorkers.
+func (c *Conn) SetScaling(min, max int) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.minWorkers, c.maxWorkers = min, max
+	c.resize()
+}
+
+// Workers returns the number of workers reading from the Conn
+func (c *Conn) Workers() int {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.pool == nil {
+		return 0
+	}
+	return c.pool.workers()
+}
+
+// resize resizes the pool to the number of workers, it is called with the lock held
+func (c *Conn) resize() {
+	if c.maxWorkers > 0 {
+		if c.workers > c.maxWorkers {
+			c.workers = c.maxWorkers
+		}
+		if c.workers < c.minWorkers {
+			c.workers = c.minWorkers
+		}
+	}
+	if c.workers < 1 {
+		c.workers = 1
+	}
+	if c.pool != nil {
+		c.pool.resize(c.workers)
+	}
+}
+
+// scaler resizes the pool p while scaling is set, until ctx is done
+func (c *Conn) scaler(ctx context.Context, p *pool) {
+	t := time.NewTicker(scaleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.l.Lock()
+		if c.pool == p && c.maxWorkers > 0 {
+			c.workers = p.scale(c.minWorkers, c.maxWorkers)
+			c.resize()
+		}
+		c.l.Unlock()
 	}
 }
@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestSetWorkers(t *testing.T) {
+	assert := assert.New(t)
+	const id = 4325
+	var recieved int64
+	c := New(4, ModeAuto, func(p *ping.Ping, err error) {
+		if err == nil && p.ID == id {
+			atomic.AddInt64(&recieved, 1)
+		}
+	})
+	if err := c.Run(1); err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer func() { assert.NoError(c.Stop()) }()
+	assert.Equal(1, c.Workers())
+
+	c.SetWorkers(4)
+	assert.Equal(4, c.Workers())
+
+	// idle workers are woken to exit
+	c.SetWorkers(2)
+	assert.Eventually(func() bool { return c.Workers() == 2 }, time.Second, time.Millisecond)
+
+	// the workers left still read once the pool has shrunk
+	for i := 0; i < 3; i++ {
+		c.Send(ping.Ping{Dst: loopback, ID: id, Seq: ping.Seq(i), TimeOut: time.Second}, func(time.Time, int, error) {})
+	}
+	assert.Eventually(func() bool { return atomic.LoadInt64(&recieved) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(2, c.Workers())
+
+	c.SetWorkers(0)
+	assert.Eventually(func() bool { return c.Workers() == 1 }, time.Second, time.Millisecond, "at least one worker runs")
+}
+
+func TestScale(t *testing.T) {
+	assert := assert.New(t)
+	p := &pool{size: 2}
+	read := func(reads, full uint64, drops uint32) {
+		p.reads += reads
+		p.full += full
+		p.drops = drops
+	}
+
+	read(10, 6, 0)
+	assert.Equal(3, p.scale(1, 4), "most reads were full")
+	read(10, 1, 0)
+	assert.Equal(2, p.scale(1, 4), "some reads were full")
+	read(10, 1, 5)
+	assert.Equal(3, p.scale(1, 4), "the kernel dropped packets")
+	read(10, 1, 5)
+	assert.Equal(2, p.scale(1, 4), "no new drops")
+	read(10, 0, 5)
+	assert.Equal(1, p.scale(1, 4), "no reads were full")
+	read(0, 0, 5)
+	assert.Equal(2, p.scale(2, 4), "below min")
+	read(10, 10, 5)
+	assert.Equal(1, p.scale(0, 1), "above max")
+}
@@ -0,0 +1,252 @@
+// Package dispatch runs handlers on a pool of goroutines fed by a bounded queue,
+// so a slow handler does not stop replies being read
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
+)
+
+// Policy is what a Queue does with an item pushed while it is full
+type Policy int
+
+const (
+	// Block waits for room in the queue
+	Block Policy = iota
+	// DropOldest drops the item at the front of the queue to make room
+	DropOldest
+	// DropNewest drops the item being pushed
+	DropNewest
+)
+
+// DefaultSize is the size of a Queue if none is set
+const DefaultSize = 1024
+
+// Item is a ping waiting for its handler
+type Item struct {
+	Map  *seqmap.Map
+	Ping *ping.Ping
+	Err  error
+	// Again is set for late and duplicate replies, see seqmap.HandleAgain
+	Again bool
+}
+
+func (i *Item) run() {
+	if i.Again {
+		i.Map.HandleAgain(i.Ping, i.Err)
+		return
+	}
+	i.Map.Handle(i.Ping, i.Err)
+}
+
+func (i *Item) drop() {
+	if !i.Again {
+		i.Map.Discard(i.Ping)
+	}
+}
+
+// Queue is a bounded queue of items, handled in order by a pool of workers.
+// Items are stored by value so pushing does not allocate.
+type Queue struct {
+	// dropped is first so it is 64 bit aligned for atomic access
+	dropped uint64
+
+	l        sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    []Item
+	head     int
+	n        int
+	size     int
+	policy   Policy
+	// workers is the number of running workers, want is the number wanted,
+	// zero once the queue is stopped
+	workers int
+	want    int
+	// wg is done once every worker has exited
+	wg sync.WaitGroup
+}
+
+// New returns a new Queue holding up to size items
+func New(size int, policy Policy) *Queue {
+	if size < 1 {
+		size = DefaultSize
+	}
+	q := &Queue{
+		items:  make([]Item, size),
+		size:   size,
+		policy: policy,
+	}
+	q.notEmpty = sync.NewCond(&q.l)
+	q.notFull = sync.NewCond(&q.l)
+	return q
+}
+
+// SetSize sets how many items the queue holds. Items already queued are kept.
+func (q *Queue) SetSize(size int) {
+	if size < 1 {
+		size = DefaultSize
+	}
+	q.l.Lock()
+	q.size = size
+	if size > len(q.items) {
+		q.resize(size)
+	}
+	q.notFull.Broadcast()
+	q.l.Unlock()
+}
+
+// resize moves the queued items to a new buffer of length l
+func (q *Queue) resize(l int) {
+	items := make([]Item, l)
+	for i := 0; i < q.n; i++ {
+		items[i] = q.items[(q.head+i)%len(q.items)]
+	}
+	q.items, q.head = items, 0
+}
+
+// SetPolicy sets what is done with items pushed while the queue is full
+func (q *Queue) SetPolicy(p Policy) {
+	q.l.Lock()
+	q.policy = p
+	q.notFull.Broadcast()
+	q.l.Unlock()
+}
+
+// Len returns the number of items waiting in the queue
+func (q *Queue) Len() int {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return q.n
+}
+
+// Dropped returns the number of items dropped because the queue was full
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Push queues an item. If no workers are running it is handled before Push returns.
+func (q *Queue) Push(it Item) {
+	q.push(it, true)
+}
+
+// PushNoWait queues an item like Push, but never waits. If the queue is full under
+// the Block policy the item is dropped, as under DropNewest. It is used where waiting
+// could deadlock or stall others, such as from a handler running on a worker or from
+// the sender of a conn.
+func (q *Queue) PushNoWait(it Item) {
+	q.push(it, false)
+}
+
+func (q *Queue) push(it Item, wait bool) {
+	q.l.Lock()
+	for q.workers > 0 && q.n >= q.size {
+		switch {
+		case q.policy == DropNewest, q.policy == Block && !wait:
+			q.l.Unlock()
+			atomic.AddUint64(&q.dropped, 1)
+			it.drop()
+			return
+		case q.policy == DropOldest:
+			old := q.pop()
+			q.l.Unlock()
+			atomic.AddUint64(&q.dropped, 1)
+			old.drop()
+			q.l.Lock()
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.workers == 0 {
+		q.l.Unlock()
+		it.run()
+		return
+	}
+	q.items[(q.head+q.n)%len(q.items)] = it
+	q.n++
+	q.notEmpty.Signal()
+	q.l.Unlock()
+}
+
+// pop removes the item at the front of the queue, it is called with the lock held
+func (q *Queue) pop() Item {
+	it := q.items[q.head]
+	q.items[q.head] = Item{}
+	q.head = (q.head + 1) % len(q.items)
+	q.n--
+	return it
+}
+
+// Start starts n workers handling queued items. They stop once stop is called
+// and the queue is empty. Stop does not wait for them, a handler may be the
+// one stopping its workers.
+func (q *Queue) Start(n int) (stop func()) {
+	q.l.Lock()
+	q.setWorkers(n)
+	q.l.Unlock()
+	return func() {
+		q.l.Lock()
+		q.want = 0
+		q.notEmpty.Broadcast()
+		q.l.Unlock()
+	}
+}
+
+// SetWorkers resizes the running workers to n. Workers over n exit once the item
+// they are handling returns. It does nothing while the queue is stopped.
+func (q *Queue) SetWorkers(n int) {
+	q.l.Lock()
+	if q.want > 0 {
+		q.setWorkers(n)
+	}
+	q.l.Unlock()
+}
+
+// setWorkers starts workers until n are running, it is called with the lock held
+func (q *Queue) setWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	q.want = n
+	for ; q.workers < n; q.workers++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	q.notEmpty.Broadcast()
+}
+
+// Wait blocks until every worker has exited
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	q.l.Lock()
+	for {
+		// stopped workers exit once the queue is empty, workers over want exit straight away
+		if q.workers > q.want && (q.want > 0 || q.n == 0) {
+			q.workers--
+			if q.n > 0 {
+				// the item this worker was woken for is left to the others
+				q.notEmpty.Signal()
+			}
+			// pushers waiting for room handle their items themselves once no workers are left
+			q.notFull.Broadcast()
+			q.l.Unlock()
+			return
+		}
+		if q.n == 0 {
+			q.notEmpty.Wait()
+			continue
+		}
+		it := q.pop()
+		q.notFull.Signal()
+		q.l.Unlock()
+		it.run()
+		q.l.Lock()
+	}
+}
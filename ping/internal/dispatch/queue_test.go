@@ -0,0 +1,163 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
+)
+
+// blockedQueue returns a queue of size 2 whose single worker is blocked
+// handling count 0 until release is closed, and the counts handled
+func blockedQueue(t *testing.T, policy Policy) (q *Queue, sm *seqmap.Map, handled chan int, release chan struct{}) {
+	handled, release = make(chan int, 10), make(chan struct{})
+	sm = seqmap.New(func(p *ping.Ping, err error) {
+		if p.Count == 0 {
+			<-release
+		}
+		handled <- p.Count
+	})
+	q = New(2, policy)
+	push(q, sm, -1)
+	assert.Equal(t, -1, <-handled, "pushed with no workers is handled inline")
+	t.Cleanup(q.Start(1))
+	push(q, sm, 0)
+	for q.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return q, sm, handled, release
+}
+
+func push(q *Queue, sm *seqmap.Map, counts ...int) {
+	for _, c := range counts {
+		q.Push(Item{Map: sm, Ping: &ping.Ping{Count: c}, Again: true})
+	}
+}
+
+func recieve(handled chan int, n int) []int {
+	var r []int
+	for i := 0; i < n; i++ {
+		r = append(r, <-handled)
+	}
+	return r
+}
+
+func TestDropNewest(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, DropNewest)
+	push(q, sm, 1, 2, 3, 4)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, uint64(2), q.Dropped())
+	close(release)
+	assert.Equal(t, []int{0, 1, 2}, recieve(handled, 3))
+}
+
+func TestDropOldest(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, DropOldest)
+	push(q, sm, 1, 2, 3, 4)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, uint64(2), q.Dropped())
+	close(release)
+	assert.Equal(t, []int{0, 3, 4}, recieve(handled, 3))
+}
+
+func TestBlock(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, Block)
+	push(q, sm, 1, 2)
+	pushed := make(chan struct{})
+	go func() {
+		push(q, sm, 3)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Error("push did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-pushed
+	assert.Equal(t, []int{0, 1, 2, 3}, recieve(handled, 4))
+	assert.Zero(t, q.Dropped())
+}
+
+func TestPushNoWait(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, Block)
+	push(q, sm, 1, 2)
+	pushed := make(chan struct{})
+	go func() {
+		q.PushNoWait(Item{Map: sm, Ping: &ping.Ping{Count: 3}, Again: true})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Error("push did not return on a full queue")
+	}
+	assert.Equal(t, uint64(1), q.Dropped())
+	q.PushNoWait(Item{Map: sm, Ping: &ping.Ping{Count: 4}, Again: true})
+	assert.Equal(t, uint64(2), q.Dropped())
+	close(release)
+	assert.Equal(t, []int{0, 1, 2}, recieve(handled, 3))
+}
+
+func TestSetWorkers(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, Block)
+	push(q, sm, 1)
+	// a new worker handles 1 while the first is still blocked
+	q.SetWorkers(2)
+	assert.Equal(t, 1, <-handled)
+	q.SetWorkers(1)
+	close(release)
+	assert.Equal(t, 0, <-handled)
+	assert.Eventually(t, func() bool {
+		q.l.Lock()
+		defer q.l.Unlock()
+		return q.workers == 1
+	}, time.Second, time.Millisecond)
+	push(q, sm, 2, 3)
+	assert.Equal(t, []int{2, 3}, recieve(handled, 2))
+}
+
+func TestSetWorkersStopped(t *testing.T) {
+	q := New(1, Block)
+	q.SetWorkers(2)
+	q.l.Lock()
+	assert.Zero(t, q.workers, "workers started before Start")
+	q.l.Unlock()
+	q.Start(1)()
+	q.Wait()
+}
+
+func TestDropDrains(t *testing.T) {
+	q, sm, _, release := blockedQueue(t, DropNewest)
+	defer close(release)
+	push(q, sm, 1, 2)
+	p := &ping.Ping{Count: 3}
+	sm.Add(p)
+	rp, _, _ := sm.Pop(p.Seq)
+	q.Push(Item{Map: sm, Ping: rp})
+	assert.Equal(t, uint64(1), q.Dropped())
+
+	drained := make(chan struct{})
+	go func() {
+		sm.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Error("a dropped ping was not marked handled")
+	}
+}
+
+func TestSetSize(t *testing.T) {
+	q, sm, handled, release := blockedQueue(t, DropNewest)
+	push(q, sm, 1, 2)
+	q.SetSize(3)
+	push(q, sm, 3, 4)
+	assert.Equal(t, uint64(1), q.Dropped())
+	close(release)
+	assert.Equal(t, []int{0, 1, 2, 3}, recieve(handled, 4))
+}
@@ -3,6 +3,7 @@ package endpointmap
 import (
 	"errors"
 	"net"
+	"net/netip"
 	"sync"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
@@ -12,28 +13,20 @@ import (
 // Map holds an endpoint map mapping endpoints to sequence maps
 type Map struct {
 	l sync.RWMutex
-	m iMap
+	m map[key]*seqmap.Map
+}
+
+type key struct {
+	ip netip.Addr
+	id ping.ID
 }
 
 // New creates a new endpoint map
 func New(proto int) *Map {
-	m := &Map{}
-	switch proto {
-	case 4:
-		m.m = make(ip4m)
-	case 6:
-		m.m = make(ip6m)
-	default:
+	if proto != 4 && proto != 6 {
 		panic("invalid protocol")
 	}
-	return m
-}
-
-type iMap interface {
-	add(net.IP, ping.ID, *seqmap.Map)
-	del(net.IP, ping.ID)
-	get(net.IP, ping.ID) (*seqmap.Map, bool)
-	length() int
+	return &Map{m: make(map[key]*seqmap.Map)}
 }
 
 // ErrAlreadyExists is returned if you attempt to add an endpoint to the map that already exists.
@@ -46,14 +39,15 @@ var ErrDoesNotExist = errors.New("does not exist")
 func (m *Map) Add(ip net.IP, id ping.ID, h func(*ping.Ping, error)) (sm *seqmap.Map, l int, err error) {
 	var ok bool
 	m.l.Lock()
-	sm, ok = m.m.get(ip, id)
+	k := toKey(ip, id)
+	sm, ok = m.m[k]
 	if ok {
 		err = ErrAlreadyExists
 	} else {
 		sm = seqmap.New(h)
-		m.m.add(ip, id, sm)
+		m.m[k] = sm
 	}
-	l = m.m.length()
+	l = len(m.m)
 	m.l.Unlock()
 	return sm, l, err
 }
@@ -62,12 +56,13 @@ func (m *Map) Add(ip net.IP, id ping.ID, h func(*ping.Ping, error)) (sm *seqmap.
 func (m *Map) Pop(ip net.IP, id ping.ID) (sm *seqmap.Map, l int, err error) {
 	var ok bool
 	m.l.Lock()
-	sm, ok = m.m.get(ip, id)
+	k := toKey(ip, id)
+	sm, ok = m.m[k]
 	if !ok {
 		err = ErrDoesNotExist
 	}
-	m.m.del(ip, id)
-	l = m.m.length()
+	delete(m.m, k)
+	l = len(m.m)
 	m.l.Unlock()
 	return sm, l, err
 }
@@ -75,8 +70,46 @@ func (m *Map) Pop(ip net.IP, id ping.ID) (sm *seqmap.Map, l int, err error) {
 // Get gets a sequence map
 func (m *Map) Get(ip net.IP, id ping.ID) (sm *seqmap.Map, ok bool, length int) {
 	m.l.RLock()
-	sm, ok = m.m.get(ip, id)
-	length = m.m.length()
+	sm, ok = m.m[toKey(ip, id)]
+	length = len(m.m)
 	m.l.RUnlock()
 	return sm, ok, length
 }
+
+// Len returns the number of endpoints in the map
+func (m *Map) Len() int {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return len(m.m)
+}
+
+// Pending returns the number of pings waiting for a reply or timeout, across every endpoint
+func (m *Map) Pending() int {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	n := 0
+	for _, sm := range m.m {
+		n += sm.Len()
+	}
+	return n
+}
+
+// Maps returns the sequence maps of every endpoint
+func (m *Map) Maps() []*seqmap.Map {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	sms := make([]*seqmap.Map, 0, len(m.m))
+	for _, sm := range m.m {
+		sms = append(sms, sm)
+	}
+	return sms
+}
+
+// Clear removes every endpoint, returning how many there were
+func (m *Map) Clear() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	n := len(m.m)
+	m.m = make(map[key]*seqmap.Map)
+	return n
+}
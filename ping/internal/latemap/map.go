@@ -0,0 +1,110 @@
+// Package latemap remembers pings that have timed out, so replies that arrive
+// shortly after the timeout can still be matched to them.
+package latemap
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+type key struct {
+	ip  netip.Addr
+	id  ping.ID
+	seq ping.Seq
+}
+
+func toKey(ip net.IP, id ping.ID, seq ping.Seq) key {
+	return key{ip: ping.Addr(ip), id: id, seq: seq}
+}
+
+type entry struct {
+	p   *ping.Ping
+	exp time.Time
+}
+
+type qEntry struct {
+	k   key
+	exp time.Time
+}
+
+// Map holds timed out pings for a window after they time out
+type Map struct {
+	l      sync.Mutex
+	window time.Duration
+	m      map[key]*entry
+	// q is in the order pings were added, so entries expire from the front
+	q []qEntry
+}
+
+// New returns a new Map with a window of zero, which remembers nothing
+func New() *Map {
+	return &Map{
+		m: make(map[key]*entry),
+	}
+}
+
+// SetWindow sets how long timed out pings are remembered
+func (m *Map) SetWindow(d time.Duration) {
+	m.l.Lock()
+	m.window = d
+	if d <= 0 {
+		m.m = make(map[key]*entry)
+		m.q = nil
+	}
+	m.l.Unlock()
+}
+
+func (m *Map) expire(now time.Time) {
+	i := 0
+	for ; i < len(m.q) && !m.q[i].exp.After(now); i++ {
+		// the key may have been reused by a later ping, which must be kept
+		if e, ok := m.m[m.q[i].k]; ok && !e.exp.After(now) {
+			delete(m.m, m.q[i].k)
+		}
+	}
+	m.q = m.q[i:]
+}
+
+// Add remembers a ping that timed out
+func (m *Map) Add(p *ping.Ping) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.window <= 0 || p.Dst == nil {
+		return
+	}
+	now := time.Now()
+	m.expire(now)
+	k := toKey(p.Dst.IP, p.ID, p.Seq)
+	exp := now.Add(m.window)
+	m.m[k] = &entry{p: p, exp: exp}
+	m.q = append(m.q, qEntry{k: k, exp: exp})
+}
+
+// Pop removes and returns the timed out ping rp is a reply to, if it timed out within the window
+func (m *Map) Pop(rp *ping.Ping) (*ping.Ping, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if len(m.m) == 0 {
+		return nil, false
+	}
+	m.expire(time.Now())
+	k := toKey(rp.Dst.IP, rp.ID, rp.Seq)
+	e, ok := m.m[k]
+	if !ok || !e.p.Matches(rp) {
+		return nil, false
+	}
+	delete(m.m, k)
+	return e.p, true
+}
+
+// Len returns the number of pings remembered
+func (m *Map) Len() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.expire(time.Now())
+	return len(m.m)
+}
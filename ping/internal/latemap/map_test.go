@@ -0,0 +1,75 @@
+package latemap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/stretchr/testify/assert"
+)
+
+func reply(ip net.IP, id ping.ID, seq ping.Seq) *ping.Ping {
+	return &ping.Ping{Dst: &net.IPAddr{IP: ip}, ID: id, Seq: seq}
+}
+
+func TestLateMap(t *testing.T) {
+	assert := assert.New(t)
+	m := New()
+	dst := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	p := &ping.Ping{Dst: dst, ID: 1, Seq: 2}
+
+	m.Add(p)
+	_, ok := m.Pop(reply(dst.IP, 1, 2))
+	assert.False(ok, "nothing is remembered with a zero window")
+
+	m.SetWindow(50 * time.Millisecond)
+	m.Add(p)
+	m.Add(&ping.Ping{Dst: dst, ID: 1, Seq: 3})
+	assert.Equal(2, m.Len())
+	_, ok = m.Pop(reply(dst.IP, 1, 4))
+	assert.False(ok)
+	rp, ok := m.Pop(reply(net.ParseIP("192.0.2.1"), 1, 2))
+	assert.True(ok)
+	assert.Equal(p, rp)
+	_, ok = m.Pop(reply(dst.IP, 1, 2))
+	assert.False(ok, "pings are only returned once")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Zero(m.Len())
+	_, ok = m.Pop(reply(dst.IP, 1, 3))
+	assert.False(ok, "pings should expire after the window")
+}
+
+func TestLateMapReuse(t *testing.T) {
+	assert := assert.New(t)
+	m := New()
+	m.SetWindow(50 * time.Millisecond)
+	dst := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	m.Add(&ping.Ping{Dst: dst, ID: 1, Seq: 1})
+	time.Sleep(30 * time.Millisecond)
+	p := &ping.Ping{Dst: dst, ID: 1, Seq: 1, Count: 1 << 16}
+	m.Add(p)
+	time.Sleep(30 * time.Millisecond)
+	// the first entry has expired, but the key was reused by the second
+	rp, ok := m.Pop(reply(dst.IP, 1, 1))
+	assert.True(ok)
+	assert.Equal(p, rp)
+}
+
+func TestLateMapCount(t *testing.T) {
+	assert := assert.New(t)
+	m := New()
+	m.SetWindow(time.Second)
+	dst := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	p := &ping.Ping{Dst: dst, ID: 1, Seq: 1, Count: 1 << 16}
+	m.Add(p)
+	rp := reply(dst.IP, 1, 1)
+	rp.Count, rp.HasCount = 1, true
+	_, ok := m.Pop(rp)
+	assert.False(ok, "a reply to an earlier ping with the same seq should not match")
+	rp.Count = 1 << 16
+	lp, ok := m.Pop(rp)
+	assert.True(ok)
+	assert.Equal(p, lp)
+}
@@ -0,0 +1,48 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+)
+
+// UnreachableError is returned when a destination unreachable message is
+// recieved in response to an echo request
+type UnreachableError struct {
+	// Code is the ICMP code of the destination unreachable message
+	Code int
+	// From is the address that sent the destination unreachable message
+	From *net.IPAddr
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("destination unreachable (code %v) from %v", e.Code, e.From)
+}
+
+// TimeExceededError is returned when a time exceeded message is
+// recieved in response to an echo request
+type TimeExceededError struct {
+	// Code is the ICMP code of the time exceeded message.
+	// Zero is TTL or hop limit exceeded in transit, one is fragment reassembly time exceeded.
+	Code int
+	// From is the address that sent the time exceeded message
+	From *net.IPAddr
+}
+
+func (e *TimeExceededError) Error() string {
+	return fmt.Sprintf("time exceeded (code %v) from %v", e.Code, e.From)
+}
+
+// ParameterProblemError is returned when a parameter problem message is
+// recieved in response to an echo request
+type ParameterProblemError struct {
+	// Code is the ICMP code of the parameter problem message
+	Code int
+	// Pointer is the offset in the echo request where the problem was found
+	Pointer int
+	// From is the address that sent the parameter problem message
+	From *net.IPAddr
+}
+
+func (e *ParameterProblemError) Error() string {
+	return fmt.Sprintf("parameter problem (code %v, pointer %v) from %v", e.Code, e.Pointer, e.From)
+}
@@ -1,9 +1,13 @@
 package ping
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/netip"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -14,6 +18,16 @@ import (
 const (
 	// TimeSliceLength is the length of the icmp payload holding the timestamp
 	TimeSliceLength = 8
+	// IDSliceLength is the length of the icmp payload holding the ICMP ID
+	IDSliceLength = 2
+	// CountSliceLength is the length of the icmp payload holding the count
+	CountSliceLength = 8
+	// MACSliceLength is the length of the icmp payload holding the MAC
+	MACSliceLength = 8
+	// HeaderLength is the length of the start of the icmp payload, before any fill data
+	HeaderLength = TimeSliceLength + IDSliceLength + CountSliceLength + MACSliceLength
+	// MaxPayloadLength is the largest icmp payload that fits in an ipv4 packet
+	MaxPayloadLength = 1<<16 - 1 - ipv4.HeaderLen - 8
 )
 
 // see https://godoc.org/golang.org/x/net/ping/internal/iana#pkg-constants
@@ -28,6 +42,30 @@ type Seq uint16
 // ID is an ICMP ID
 type ID uint16
 
+// TimestampSource is where the recieved time of a ping came from
+type TimestampSource int
+
+const (
+	// TimestampUser is a time taken in user space after the read returned.
+	// It includes any delay in scheduling the worker that read the packet.
+	TimestampUser TimestampSource = iota
+	// TimestampKernel is a software timestamp taken by the kernel when the packet arrived
+	TimestampKernel
+	// TimestampHardware is a timestamp taken by the network card when the packet arrived.
+	// It is not reported yet, it needs a hardware send timestamp to compare against.
+	TimestampHardware
+)
+
+func (s TimestampSource) String() string {
+	switch s {
+	case TimestampKernel:
+		return "kernel"
+	case TimestampHardware:
+		return "hardware"
+	}
+	return "user"
+}
+
 // Ping is an ICMP packet that has been received
 type Ping struct {
 	// Host is the hostname that was pinged
@@ -40,8 +78,14 @@ type Ping struct {
 	// the recieve function does not provide the source address
 	// on windows ICMP messages are mathed only by the 16 bit ICMP id.
 	Dst *net.IPAddr
-	// Count is the ICMP count
+	// Count is the ICMP count. It is carried in the payload, so unlike Seq it does not wrap.
 	Count int
+	// HasCount is true for recieved pings whose payload carried the count and MAC
+	HasCount bool
+	// Key is the secret the payload of a sent ping is authenticated with. Nil sends a zero MAC.
+	Key []byte
+	// MAC is the MAC carried in the payload of a recieved ping
+	MAC []byte
 	// ID is the ICMP ID
 	ID ID
 	// Seq is the ICMP Sequence
@@ -50,6 +94,8 @@ type Ping struct {
 	Sent time.Time
 	// Recieved is the time the echo was recieved.
 	Recieved time.Time
+	// RecievedSource is where Recieved came from
+	RecievedSource TimestampSource
 	// TimeOut is timeout duration
 	TimeOut time.Duration
 	// TTL is the ttl on the recieved packet.
@@ -57,6 +103,47 @@ type Ping struct {
 	TTL int
 	// Len is the length of the recieved packet
 	Len int
+	// SendTTL is the ttl or hop limit the echo is sent with.
+	// Zero uses the default of the socket.
+	SendTTL int
+	// Data is the fill data following the header in the icmp payload.
+	// For sent pings this is what was sent, for recieved pings it is what came back.
+	Data []byte
+	// HeaderLen is how much of the header a sent ping carries, zero is all of it.
+	// A shorter header leaves out the MAC and count, then the ID. It can not carry Data.
+	HeaderLen int
+	// Late is true for a reply recieved after the ping already timed out
+	Late bool
+	// Duplicate is true for a reply to a ping that was already replied to
+	Duplicate bool
+	// OutOfOrder is true for a reply recieved after the reply to a later ping
+	OutOfOrder bool
+}
+
+// Addr returns ip as a netip.Addr for use in map keys. IPv4 addresses are
+// unmapped, so the 4 and 16 byte forms of an address are the same key.
+func Addr(ip net.IP) netip.Addr {
+	a, _ := netip.AddrFromSlice(ip)
+	return a.Unmap()
+}
+
+// Again returns true if the ping has already been handled, and is being handled again
+// for a late or duplicate reply
+func (p *Ping) Again() bool {
+	return p.Late || p.Duplicate
+}
+
+// Clone returns a copy of p that does not share its addresses,
+// so the copy can be updated while p is still being read
+func (p *Ping) Clone() *Ping {
+	c := *p
+	if p.Src != nil {
+		c.Src = &net.IPAddr{IP: append(net.IP(nil), p.Src.IP...), Zone: p.Src.Zone}
+	}
+	if p.Dst != nil {
+		c.Dst = &net.IPAddr{IP: append(net.IP(nil), p.Dst.IP...), Zone: p.Dst.Zone}
+	}
+	return &c
 }
 
 // UpdateFrom is for updating a sent ping with attributes from a recieved ping
@@ -69,24 +156,18 @@ func (p *Ping) UpdateFrom(rp *Ping) {
 		p.Host = rp.Host
 	}
 
-	if p.Src == nil && rp.Src != nil {
-		p.Src = rp.Src
-	}
-
-	if p.Src != nil && rp.Src != nil {
-		if p.Src.IP.IsUnspecified() && !rp.Src.IP.IsUnspecified() {
-			p.Src = rp.Src
+	// the addresses are copied, so a recieved ping can be reused once it has been handled
+	if rp.Src != nil && (p.Src == nil || len(p.Src.IP) == 0 || p.Src.IP.IsUnspecified() && !rp.Src.IP.IsUnspecified()) {
+		if p.Src == nil {
+			p.Src = &net.IPAddr{}
 		}
+		p.Src.IP = append(p.Src.IP[:0], rp.Src.IP...)
+		p.Src.Zone = rp.Src.Zone
 	}
 
-	if p.Dst == nil && rp.Dst != nil {
-		p.Dst = rp.Dst
-	}
-
-	if p.Dst != nil && rp.Dst != nil {
-		if p.Dst.IP.IsUnspecified() && !rp.Dst.IP.IsUnspecified() {
-			p.Dst = rp.Dst
-		}
+	// Dst may be shared with the connection that sent p, so it is replaced rather than written to
+	if rp.Dst != nil && (p.Dst == nil || p.Dst.IP.IsUnspecified() && !rp.Dst.IP.IsUnspecified()) {
+		p.Dst = &net.IPAddr{IP: append(net.IP(nil), rp.Dst.IP...), Zone: rp.Dst.Zone}
 	}
 
 	if p.ID == 0 {
@@ -101,12 +182,14 @@ func (p *Ping) UpdateFrom(rp *Ping) {
 		p.Count = rp.Count
 	}
 
-	if p.Sent.Before(rp.Sent) {
+	// the sent time in a reply comes from the payload, the local one is trusted over it
+	if p.Sent.IsZero() {
 		p.Sent = rp.Sent
 	}
 
 	if p.Recieved.Before(rp.Recieved) {
 		p.Recieved = rp.Recieved
+		p.RecievedSource = rp.RecievedSource
 	}
 
 	if p.TimeOut == 0 {
@@ -122,6 +205,12 @@ func (p *Ping) UpdateFrom(rp *Ping) {
 	}
 }
 
+// Matches returns true if rp is a reply to p.
+// Replies that carry the count must match it, others are matched by Seq alone.
+func (p *Ping) Matches(rp *Ping) bool {
+	return p.Seq == rp.Seq && (!rp.HasCount || p.Count == rp.Count)
+}
+
 // RTT returns the RTT of the ping
 func (p *Ping) RTT() time.Duration {
 	if !p.Recieved.Before(p.Sent) {
@@ -142,19 +231,41 @@ func (p *Ping) sendType() icmp.Type {
 	return ipv6.ICMPTypeEchoRequest
 }
 
+// ErrPayloadTooSmall is returned if a ping is sent with a header too short for what it must carry
+var ErrPayloadTooSmall = errors.New("payload too small")
+
 // ToICMPMsg returns a byte array ready to send on the wire
 func (p *Ping) ToICMPMsg() ([]byte, error) {
+	if len(p.Key) > 0 && p.HeaderLen > 0 && p.HeaderLen < HeaderLength {
+		// there is no room for the MAC
+		return nil, ErrPayloadTooSmall
+	}
 	return (&icmp.Message{
 		Code: 0,
 		Type: p.sendType(),
 		Body: &icmp.Echo{
 			ID:   int(p.ID),
 			Seq:  int(p.Seq),
-			Data: TimeToBytes(p.Sent),
+			Data: p.payload(),
 		},
 	}).Marshal(nil)
 }
 
+func (p *Ping) payload() []byte {
+	b := make([]byte, HeaderLength+len(p.Data))
+	copy(b, TimeToBytes(p.Sent))
+	copy(b[TimeSliceLength:], IDToBytes(p.ID))
+	copy(b[TimeSliceLength+IDSliceLength:], CountToBytes(p.Count))
+	if len(p.Key) > 0 {
+		copy(b[HeaderLength-MACSliceLength:], p.Sign(p.Key))
+	}
+	copy(b[HeaderLength:], p.Data)
+	if p.HeaderLen > 0 && p.HeaderLen < HeaderLength {
+		return b[:p.HeaderLen]
+	}
+	return b
+}
+
 // TimeToBytes converts a time.Time into a []byte for inclusion in the ICMP payload
 func TimeToBytes(t time.Time) []byte {
 	b := make([]byte, TimeSliceLength)
@@ -162,6 +273,43 @@ func TimeToBytes(t time.Time) []byte {
 	return b
 }
 
+// IDToBytes converts an ID into a []byte for inclusion in the ICMP payload.
+//
+// The ID is carried in the payload because datagram sockets have the ICMP ID
+// in the header replaced by the kernel.
+func IDToBytes(id ID) []byte {
+	b := make([]byte, IDSliceLength)
+	binary.LittleEndian.PutUint16(b, uint16(id))
+	return b
+}
+
+// CountToBytes converts a count into a []byte for inclusion in the ICMP payload.
+//
+// The count is carried in the payload because the 16 bit ICMP sequence wraps,
+// and a very late reply could otherwise be matched to the wrong ping.
+func CountToBytes(c int) []byte {
+	b := make([]byte, CountSliceLength)
+	binary.LittleEndian.PutUint64(b, uint64(c))
+	return b
+}
+
+// Sign returns the MAC of the sent time, ID, count and destination of p
+func (p *Ping) Sign(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(TimeToBytes(p.Sent))
+	_, _ = h.Write(IDToBytes(p.ID))
+	_, _ = h.Write(CountToBytes(p.Count))
+	if p.Dst != nil {
+		_, _ = h.Write(p.Dst.IP.To16())
+	}
+	return h.Sum(nil)[:MACSliceLength]
+}
+
+// Verify returns true if the payload of a recieved ping carried a valid MAC for key
+func (p *Ping) Verify(key []byte) bool {
+	return p.HasCount && hmac.Equal(p.MAC, p.Sign(key))
+}
+
 // ErrTooShort is returned if an echo body holding the timeslice is too short
 var ErrTooShort = errors.New("too short")
 
@@ -172,3 +320,46 @@ func BytesToTime(b []byte) (time.Time, error) {
 	}
 	return time.Unix(0, int64(binary.LittleEndian.Uint64(b[:TimeSliceLength]))), nil
 }
+
+// ErrTruncated is returned if a reply came back with less data than was sent
+var ErrTruncated = errors.New("truncated reply")
+
+// ErrCorrupted is returned if a reply came back with different data than was sent
+var ErrCorrupted = errors.New("corrupted reply")
+
+// CheckData compares the data of a recieved ping against the sent ping
+func (p *Ping) CheckData(rp *Ping) error {
+	switch {
+	case len(rp.Data) < len(p.Data):
+		return ErrTruncated
+	case !bytes.Equal(rp.Data, p.Data):
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// BytesToID reads the ID following the timeslice in an ICMP payload
+func BytesToID(b []byte) (ID, error) {
+	if len(b) < TimeSliceLength+IDSliceLength {
+		return 0, ErrTooShort
+	}
+	return ID(binary.LittleEndian.Uint16(b[TimeSliceLength:])), nil
+}
+
+// BytesToCount reads the count following the ID in an ICMP payload
+func BytesToCount(b []byte) (int, error) {
+	if len(b) < HeaderLength {
+		return 0, ErrTooShort
+	}
+	return int(binary.LittleEndian.Uint64(b[TimeSliceLength+IDSliceLength:])), nil
+}
+
+// BytesToMAC reads the MAC following the count in an ICMP payload
+func BytesToMAC(b []byte) ([]byte, error) {
+	if len(b) < HeaderLength {
+		return nil, ErrTooShort
+	}
+	mac := make([]byte, MACSliceLength)
+	copy(mac, b[HeaderLength-MACSliceLength:HeaderLength])
+	return mac, nil
+}
@@ -2,6 +2,7 @@ package ping
 
 import (
 	"bytes"
+	"net"
 	"testing"
 	"time"
 )
@@ -46,3 +47,147 @@ func TestTimeToBytesMax(t *testing.T) {
 	tm := time.Unix(0, 1<<63-1)
 	testValidTime(t, tm)
 }
+
+func TestIDToBytes(t *testing.T) {
+	for _, id := range []ID{0, 1, 1<<16 - 1} {
+		b := append(TimeToBytes(time.Now()), IDToBytes(id)...)
+		nid, err := BytesToID(b)
+		if err != nil {
+			t.Error("Expected no error from BytesToID")
+		}
+		if nid != id {
+			t.Errorf("Expected %v equal %v", id, nid)
+		}
+	}
+}
+
+func TestBytesToIDTooShort(t *testing.T) {
+	b := make([]byte, TimeSliceLength+IDSliceLength-1)
+	_, err := BytesToID(b)
+	if err == nil {
+		t.Errorf("Expected error from too short bytes")
+	}
+}
+
+func TestCheckData(t *testing.T) {
+	sp := &Ping{Data: []byte{1, 2, 3}}
+	if err := sp.CheckData(&Ping{Data: []byte{1, 2, 3}}); err != nil {
+		t.Errorf("Expected no error from matching data, got %v", err)
+	}
+	if err := sp.CheckData(&Ping{Data: []byte{1, 2}}); err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	if err := sp.CheckData(&Ping{Data: []byte{1, 2, 4}}); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	if err := sp.CheckData(&Ping{Data: []byte{1, 2, 3, 4}}); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestToICMPMsgLength(t *testing.T) {
+	p := &Ping{Dst: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, Data: make([]byte, 100)}
+	b, err := p.ToICMPMsg()
+	if err != nil {
+		t.Fatalf("Expected no error from ToICMPMsg, got %v", err)
+	}
+	if len(b) != 8+HeaderLength+100 {
+		t.Errorf("Expected message length %v, got %v", 8+HeaderLength+100, len(b))
+	}
+}
+
+func TestToICMPMsgShortHeader(t *testing.T) {
+	p := &Ping{Dst: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, HeaderLen: TimeSliceLength}
+	b, err := p.ToICMPMsg()
+	if err != nil {
+		t.Fatalf("Expected no error from ToICMPMsg, got %v", err)
+	}
+	if len(b) != 8+TimeSliceLength {
+		t.Errorf("Expected message length %v, got %v", 8+TimeSliceLength, len(b))
+	}
+	p.Key = []byte("secret")
+	if _, err := p.ToICMPMsg(); err != ErrPayloadTooSmall {
+		t.Errorf("Expected ErrPayloadTooSmall with a key, got %v", err)
+	}
+	p.HeaderLen = HeaderLength
+	if _, err := p.ToICMPMsg(); err != nil {
+		t.Errorf("Expected no error with the full header, got %v", err)
+	}
+}
+
+func TestCountBytes(t *testing.T) {
+	p := &Ping{Count: 1<<16 + 5}
+	b := p.payload()
+	c, err := BytesToCount(b)
+	if err != nil {
+		t.Fatalf("Expected no error from BytesToCount, got %v", err)
+	}
+	if c != p.Count {
+		t.Errorf("Expected count %v, got %v", p.Count, c)
+	}
+	if _, err := BytesToCount(b[:HeaderLength-1]); err != ErrTooShort {
+		t.Errorf("Expected ErrTooShort, got %v", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	p := &Ping{Seq: 5, Count: 1<<16 + 5}
+	if !p.Matches(&Ping{Seq: 5}) {
+		t.Errorf("Expected a reply without a count to match on seq")
+	}
+	if !p.Matches(&Ping{Seq: 5, Count: 1<<16 + 5, HasCount: true}) {
+		t.Errorf("Expected a reply with the same count to match")
+	}
+	if p.Matches(&Ping{Seq: 5, Count: 5, HasCount: true}) {
+		t.Errorf("Expected a reply with a wrapped seq not to match")
+	}
+	if p.Matches(&Ping{Seq: 6}) {
+		t.Errorf("Expected a reply with a different seq not to match")
+	}
+}
+
+func TestClone(t *testing.T) {
+	p := &Ping{
+		Src:   &net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+		Dst:   &net.IPAddr{IP: net.ParseIP("192.0.2.2")},
+		Count: 5,
+	}
+	c := p.Clone()
+	if c.Count != p.Count || !c.Src.IP.Equal(p.Src.IP) || !c.Dst.IP.Equal(p.Dst.IP) {
+		t.Errorf("Expected clone to equal the ping")
+	}
+	c.UpdateFrom(&Ping{Src: &net.IPAddr{IP: net.ParseIP("192.0.2.3")}})
+	c.Src.IP[len(c.Src.IP)-1] = 4
+	c.Dst.IP[len(c.Dst.IP)-1] = 4
+	if !p.Src.IP.Equal(net.ParseIP("192.0.2.1")) || !p.Dst.IP.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Expected clone not to share addresses, got %v %v", p.Src, p.Dst)
+	}
+	if (&Ping{}).Clone().Src != nil {
+		t.Errorf("Expected nil addresses to stay nil")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret")
+	sp := &Ping{Dst: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, ID: 7, Count: 3, Sent: time.Now(), Key: key}
+	b := sp.payload()
+	mac, err := BytesToMAC(b)
+	if err != nil {
+		t.Fatalf("Expected no error from BytesToMAC, got %v", err)
+	}
+	sent, _ := BytesToTime(b)
+	rp := &Ping{Dst: sp.Dst, ID: 7, Count: 3, HasCount: true, Sent: sent, MAC: mac}
+	if !rp.Verify(key) {
+		t.Errorf("Expected reply to verify")
+	}
+	if rp.Verify([]byte("other")) {
+		t.Errorf("Expected reply not to verify with another key")
+	}
+	rp.Sent = sent.Add(-time.Second)
+	if rp.Verify(key) {
+		t.Errorf("Expected reply with a forged sent time not to verify")
+	}
+	if (&Ping{Dst: sp.Dst, ID: 7, Count: 3, Sent: sent, MAC: mac}).Verify(key) {
+		t.Errorf("Expected reply without a payload header not to verify")
+	}
+}
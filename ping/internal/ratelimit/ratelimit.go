@@ -0,0 +1,189 @@
+// Package ratelimit limits the rate pings are sent with token buckets
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrLimited is returned when a ping is not sent because it would exceed a rate limit
+var ErrLimited = errors.New("rate limited")
+
+// Limit is a token bucket. A zero Rate is unlimited.
+type Limit struct {
+	// Rate is the sustained rate in packets per second
+	Rate float64
+	// Burst is the number of packets that can be sent at once. Values less than one are treated as one.
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// Config configures a Limiter
+type Config struct {
+	// Total limits all pings sent on the socket
+	Total Limit
+	// Destination limits the pings sent to each destination address
+	Destination Limit
+	// Prefix limits the pings sent to each network of PrefixLen4 or PrefixLen6 bits
+	Prefix Limit
+	// PrefixLen4 is the length of the ipv4 prefixes limited by Prefix
+	PrefixLen4 int
+	// PrefixLen6 is the length of the ipv6 prefixes limited by Prefix
+	PrefixLen6 int
+	// Wait delays pings until they can be sent within the limits.
+	// If false pings that would exceed a limit fail immediately with ErrLimited.
+	Wait bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit, now time.Time) *bucket {
+	return &bucket{tokens: l.burst(), last: now}
+}
+
+func (b *bucket) refill(l Limit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if max := l.burst(); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// delay returns how long until a token is available
+func (b *bucket) delay(l Limit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweepInterval is how often idle per destination and per prefix buckets are removed
+const sweepInterval = 10 * time.Second
+
+// Limiter enforces a Config
+type Limiter struct {
+	l         sync.Mutex
+	c         Config
+	total     *bucket
+	dsts      map[string]*bucket
+	prefixes  map[string]*bucket
+	lastSweep time.Time
+	limited   uint64
+}
+
+// New returns a Limiter with no limits
+func New() *Limiter {
+	return &Limiter{
+		dsts:     make(map[string]*bucket),
+		prefixes: make(map[string]*bucket),
+	}
+}
+
+// Set replaces the limits, resetting all buckets
+func (r *Limiter) Set(c Config) {
+	r.l.Lock()
+	r.c = c
+	r.total = nil
+	r.dsts = make(map[string]*bucket)
+	r.prefixes = make(map[string]*bucket)
+	r.l.Unlock()
+}
+
+func (r *Limiter) get(m map[string]*bucket, k string, l Limit, now time.Time) *bucket {
+	b, ok := m[k]
+	if !ok {
+		b = newBucket(l, now)
+		m[k] = b
+	}
+	return b
+}
+
+// sweep removes buckets that have refilled, they are the same as new buckets
+func (r *Limiter) sweep(m map[string]*bucket, l Limit, now time.Time) {
+	for k, b := range m {
+		b.refill(l, now)
+		if b.tokens >= l.burst() {
+			delete(m, k)
+		}
+	}
+}
+
+type limitBucket struct {
+	l Limit
+	b *bucket
+}
+
+// Take takes a token for a ping to ip from every bucket that applies.
+//
+// If the limits are exceeded it either blocks until the ping can be sent, or returns ErrLimited.
+func (r *Limiter) Take(ip net.IP) error {
+	r.l.Lock()
+	now := time.Now()
+	if now.Sub(r.lastSweep) > sweepInterval {
+		r.sweep(r.dsts, r.c.Destination, now)
+		r.sweep(r.prefixes, r.c.Prefix, now)
+		r.lastSweep = now
+	}
+
+	var bs []limitBucket
+	if r.c.Total.Rate > 0 {
+		if r.total == nil {
+			r.total = newBucket(r.c.Total, now)
+		}
+		bs = append(bs, limitBucket{r.c.Total, r.total})
+	}
+	if r.c.Destination.Rate > 0 {
+		bs = append(bs, limitBucket{r.c.Destination, r.get(r.dsts, string(ip.To16()), r.c.Destination, now)})
+	}
+	if r.c.Prefix.Rate > 0 {
+		plen, bits := r.c.PrefixLen6, 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, plen, bits = ip4, r.c.PrefixLen4, 32
+		}
+		k := ip.Mask(net.CIDRMask(plen, bits)).String()
+		bs = append(bs, limitBucket{r.c.Prefix, r.get(r.prefixes, k, r.c.Prefix, now)})
+	}
+
+	var wait time.Duration
+	for _, lb := range bs {
+		lb.b.refill(lb.l, now)
+		if d := lb.b.delay(lb.l); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		r.limited++
+		if !r.c.Wait {
+			r.l.Unlock()
+			return ErrLimited
+		}
+	}
+	// when waiting the tokens are reserved now, so later pings wait behind this one
+	for _, lb := range bs {
+		lb.b.tokens--
+	}
+	r.l.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// Limited returns the number of pings that were delayed or failed by the limits
+func (r *Limiter) Limited() uint64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.limited
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlimited(t *testing.T) {
+	assert := assert.New(t)
+	r := New()
+	for i := 0; i < 1000; i++ {
+		assert.NoError(r.Take(net.ParseIP("192.0.2.1")))
+	}
+	assert.Zero(r.Limited())
+}
+
+func TestFailFast(t *testing.T) {
+	assert := assert.New(t)
+	r := New()
+	r.Set(Config{Destination: Limit{Rate: 1, Burst: 2}})
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	assert.NoError(r.Take(a))
+	assert.NoError(r.Take(a))
+	assert.Equal(ErrLimited, r.Take(a))
+	assert.NoError(r.Take(b), "destinations should be limited separately")
+	assert.Equal(uint64(1), r.Limited())
+}
+
+func TestPrefix(t *testing.T) {
+	assert := assert.New(t)
+	r := New()
+	r.Set(Config{Prefix: Limit{Rate: 1}, PrefixLen4: 24, PrefixLen6: 64})
+	assert.NoError(r.Take(net.ParseIP("192.0.2.1")))
+	assert.Equal(ErrLimited, r.Take(net.ParseIP("192.0.2.200")))
+	assert.NoError(r.Take(net.ParseIP("198.51.100.1")))
+	assert.NoError(r.Take(net.ParseIP("2001:db8::1")))
+	assert.Equal(ErrLimited, r.Take(net.ParseIP("2001:db8::ffff")))
+	assert.NoError(r.Take(net.ParseIP("2001:db8:0:1::1")))
+}
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+	r := New()
+	r.Set(Config{Total: Limit{Rate: 100}, Wait: true})
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		assert.NoError(r.Take(net.ParseIP("192.0.2.1")))
+	}
+	assert.True(time.Since(start) >= 90*time.Millisecond, "took %v", time.Since(start))
+	assert.Equal(uint64(10), r.Limited())
+}
+
+func TestSweep(t *testing.T) {
+	assert := assert.New(t)
+	r := New()
+	r.Set(Config{Destination: Limit{Rate: 1000}})
+	assert.NoError(r.Take(net.ParseIP("192.0.2.1")))
+	assert.Len(r.dsts, 1)
+	r.lastSweep = time.Now().Add(-2 * sweepInterval)
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(r.Take(net.ParseIP("192.0.2.2")))
+	assert.Len(r.dsts, 1, "the refilled bucket should be removed")
+}
@@ -0,0 +1,52 @@
+package seqmap
+
+import (
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// countHeap is a min-heap of ping counts
+type countHeap []int
+
+func (h countHeap) Len() int { return len(h) }
+
+func (h countHeap) Less(i, j int) bool { return h[i] < h[j] }
+
+func (h countHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *countHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+
+func (h *countHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+// result is a handled ping waiting for its turn to be passed to the handler
+type result struct {
+	// m is the map the ping was sent from, if it is waited on by Drain
+	m   *Map
+	p   *ping.Ping
+	err error
+}
+
+// resultHeap is a min-heap of results ordered by count
+type resultHeap []result
+
+func (h resultHeap) Len() int { return len(h) }
+
+func (h resultHeap) Less(i, j int) bool { return h[i].p.Count < h[j].p.Count }
+
+func (h resultHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *resultHeap) Push(x interface{}) { *h = append(*h, x.(result)) }
+
+func (h *resultHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = result{}
+	*h = old[:n-1]
+	return r
+}
@@ -3,10 +3,23 @@ package seqmap
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
+// recentLen is how many answered pings are remembered to recognise duplicate replies
+const recentLen = 16
+
+// recentPing is the part of an answered ping needed to report a duplicate reply
+type recentPing struct {
+	seq   ping.Seq
+	count int
+	host  string
+	sent  time.Time
+	ok    bool
+}
+
 // Map holds a sequence map. A sequence map the sent ping object
 // indexed by the ICMP Sequence.
 type Map struct {
@@ -17,6 +30,14 @@ type Map struct {
 	fullWaiting  bool
 	unfullNotify chan struct{}
 	wg           sync.WaitGroup
+	order        *Order
+	// closed is set by Close, no more pings can be added
+	closed bool
+
+	recent    [recentLen]recentPing
+	recentIdx int
+	maxCount  int
+	replied   bool
 }
 
 // New returns a new sequence map
@@ -31,18 +52,90 @@ func New(h func(*ping.Ping, error)) *Map {
 // Handle is a wrapper for the upstream handler. It decrements the
 // waitgroup when the upstream handler is done, providing the drain capability.
 func (m *Map) Handle(p *ping.Ping, err error) {
+	if o := m.getOrder(); o != nil {
+		o.handle(m, p, err)
+		return
+	}
 	m.handle(p, err)
 	m.wg.Done()
 }
 
+// SetOrder sets the Order handler calls are made in.
+// It must be set before any pings are added.
+func (m *Map) SetOrder(o *Order) {
+	m.l.Lock()
+	m.order = o
+	m.l.Unlock()
+}
+
+func (m *Map) getOrder() *Order {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return m.order
+}
+
+// Discard marks a ping as handled without running the handler, for a ping
+// that was dropped instead of handled.
+func (m *Map) Discard(p *ping.Ping) {
+	if o := m.getOrder(); o != nil {
+		o.discard(p.Count)
+	}
+	m.wg.Done()
+}
+
+// HandleAgain runs the upstream handler for a reply to a ping that has already been handled,
+// a late or duplicate reply. It does not affect draining.
+func (m *Map) HandleAgain(p *ping.Ping, err error) {
+	if o := m.getOrder(); o != nil {
+		o.handleAgain(p, err)
+		return
+	}
+	m.handle(p, err)
+}
+
+// Replied records that a reply was recieved for p.
+// It returns true if a reply to a ping sent after p was recieved first.
+func (m *Map) Replied(p *ping.Ping) (outOfOrder bool) {
+	m.l.Lock()
+	m.recent[m.recentIdx] = recentPing{seq: p.Seq, count: p.Count, host: p.Host, sent: p.Sent, ok: true}
+	m.recentIdx = (m.recentIdx + 1) % recentLen
+	if m.replied && p.Count < m.maxCount {
+		outOfOrder = true
+	} else {
+		m.maxCount, m.replied = p.Count, true
+	}
+	m.l.Unlock()
+	return outOfOrder
+}
+
+// Answered returns the ping rp replies to if it was recently replied to, so a duplicate reply can be handled
+func (m *Map) Answered(rp *ping.Ping) (*ping.Ping, bool) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	for _, r := range m.recent {
+		if !r.ok {
+			continue
+		}
+		// compared in place, so only a match allocates
+		if (&ping.Ping{Seq: r.seq, Count: r.count}).Matches(rp) {
+			return &ping.Ping{Seq: r.seq, Count: r.count, Host: r.host, Sent: r.sent}, true
+		}
+	}
+	return nil, false
+}
+
 // ErrDoesNotExist is returned if you attempt to pop a sequence that does not exist.
 var ErrDoesNotExist = errors.New("does not exist")
 
-// Add adds a sequence to the seqmap
+// Add adds a sequence to the seqmap. It returns zero if the map is closed.
 func (m *Map) Add(p *ping.Ping) (length int) {
 	var idx ping.Seq
 	m.l.Lock()
 	for {
+		if m.closed {
+			m.l.Unlock()
+			return 0
+		}
 		if len(m.m) >= 1<<16 {
 			m.fullWaiting = true
 			m.l.Unlock()
@@ -63,6 +156,9 @@ func (m *Map) Add(p *ping.Ping) (length int) {
 		m.m[idx] = p
 		length = len(m.m)
 		m.wg.Add(1) // wg.done is called after handler is run, so handler must be run for every pop
+		if m.order != nil {
+			m.order.add(p.Count)
+		}
 		break
 	}
 	m.l.Unlock()
@@ -71,16 +167,28 @@ func (m *Map) Add(p *ping.Ping) (length int) {
 
 // Pop removes and returns a ping from the seq map
 func (m *Map) Pop(seq ping.Seq) (*ping.Ping, int, error) {
-	idx := seq
-	var l int
-	var err error
 	m.l.Lock()
-	p, ok := m.m[idx]
+	p, ok := m.m[seq]
+	return m.pop(p, ok)
+}
+
+// PopReply removes and returns the ping rp is a reply to.
+// A ping with the same Seq but a different count is left in place, and ErrDoesNotExist is returned.
+func (m *Map) PopReply(rp *ping.Ping) (*ping.Ping, int, error) {
+	m.l.Lock()
+	p, ok := m.m[rp.Seq]
+	return m.pop(p, ok && p.Matches(rp))
+}
+
+// pop is called with the lock held, and releases it
+func (m *Map) pop(p *ping.Ping, ok bool) (*ping.Ping, int, error) {
+	var err error
 	if !ok {
-		err = ErrDoesNotExist
+		p, err = nil, ErrDoesNotExist
+	} else {
+		delete(m.m, p.Seq)
 	}
-	delete(m.m, idx)
-	l = len(m.m)
+	l := len(m.m)
 	if m.fullWaiting && l < 1<<16 {
 		m.fullWaiting = false
 		m.unfullNotify <- struct{}{}
@@ -89,12 +197,49 @@ func (m *Map) Pop(seq ping.Seq) (*ping.Ping, int, error) {
 	return p, l, err
 }
 
+// SetSent sets the sent time and length of p, added with seq, if it is still
+// waiting. Once p is popped it belongs to its handler and is not written to.
+func (m *Map) SetSent(seq ping.Seq, p *ping.Ping, sent time.Time, l int) {
+	m.l.Lock()
+	if m.m[seq] == p {
+		p.Sent, p.Len = sent, l
+	}
+	m.l.Unlock()
+}
+
+// Len returns the number of pings waiting for a reply or timeout
+func (m *Map) Len() int {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return len(m.m)
+}
+
+// PopAll removes and returns every ping in the seq map
+func (m *Map) PopAll() []*ping.Ping {
+	m.l.Lock()
+	ps := make([]*ping.Ping, 0, len(m.m))
+	for seq, p := range m.m {
+		ps = append(ps, p)
+		delete(m.m, seq)
+	}
+	if m.fullWaiting {
+		m.fullWaiting = false
+		m.unfullNotify <- struct{}{}
+	}
+	m.l.Unlock()
+	return ps
+}
+
 // Close is called when a connection is closed, unblocking any blocked
-// sends that were waiting on a free sequence number.
+// sends that were waiting on a free sequence number. No pings can be added
+// after it is closed. Close can be called more than once.
 func (m *Map) Close() {
 	m.l.Lock()
-	m.fullWaiting = false
-	close(m.unfullNotify)
+	if !m.closed {
+		m.closed = true
+		m.fullWaiting = false
+		close(m.unfullNotify)
+	}
 	m.l.Unlock()
 }
 
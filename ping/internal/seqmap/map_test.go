@@ -31,3 +31,42 @@ func TestDrain(t *testing.T) {
 	sm.Drain() // this should block until handle is done
 	assert.Equal(int64(1), atomic.LoadInt64(&received))
 }
+
+func TestPopReply(t *testing.T) {
+	assert := assert.New(t)
+	sm := New(func(*ping.Ping, error) {})
+	p := &ping.Ping{Count: 1<<16 + 3}
+	sm.Add(p)
+
+	_, _, err := sm.PopReply(&ping.Ping{Seq: p.Seq, Count: 3, HasCount: true})
+	assert.Equal(ErrDoesNotExist, err, "a reply to a ping with a wrapped seq should not match")
+	rp, l, err := sm.PopReply(&ping.Ping{Seq: p.Seq, Count: p.Count, HasCount: true})
+	assert.NoError(err)
+	assert.Equal(0, l)
+	assert.Equal(p, rp)
+	sm.Handle(rp, err)
+
+	sm.Replied(rp)
+	_, ok := sm.Answered(&ping.Ping{Seq: p.Seq, Count: 3, HasCount: true})
+	assert.False(ok)
+	dp, ok := sm.Answered(&ping.Ping{Seq: p.Seq, Count: p.Count, HasCount: true})
+	assert.True(ok)
+	assert.Equal(p.Count, dp.Count)
+}
+
+func TestSetSent(t *testing.T) {
+	assert := assert.New(t)
+	sm := New(func(*ping.Ping, error) {})
+	p := &ping.Ping{Count: 1}
+	sm.Add(p)
+	sent := time.Now()
+	sm.SetSent(p.Seq, p, sent, 42)
+	assert.Equal(sent, p.Sent)
+	assert.Equal(42, p.Len)
+
+	// once popped the ping belongs to its handler
+	rp, _, _ := sm.Pop(p.Seq)
+	sm.SetSent(p.Seq, p, sent.Add(time.Second), 1)
+	assert.Equal(sent, rp.Sent)
+	assert.Equal(42, rp.Len)
+}
@@ -0,0 +1,117 @@
+package seqmap
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// Order serializes the handler calls of one connection in Count order. It can
+// be shared by several maps, when a connection sends to more than one address.
+//
+// A ping is only handled once every ping with a lower count added to the maps
+// has been handled, so a reply waits for the replies or timeouts of the pings
+// sent before it. Late and duplicate replies are handled as soon as no other
+// handler call of the connection is running.
+type Order struct {
+	l sync.Mutex
+	h func(*ping.Ping, error)
+	// pending are the counts added and not yet handled, discarded holds the
+	// counts of pings dropped without being handled, until they reach the top
+	pending    countHeap
+	discarded  map[int]int
+	ready      resultHeap
+	again      []result
+	delivering bool
+}
+
+// NewOrder returns an Order running h
+func NewOrder(h func(*ping.Ping, error)) *Order {
+	return &Order{h: h, discarded: make(map[int]int)}
+}
+
+// Handle runs the handler for a ping that was never added to a map, such as
+// one that failed before it was sent, in order with the pings that were.
+func (o *Order) Handle(p *ping.Ping, err error) {
+	o.l.Lock()
+	heap.Push(&o.pending, p.Count)
+	heap.Push(&o.ready, result{p: p, err: err})
+	o.deliver()
+}
+
+func (o *Order) add(count int) {
+	o.l.Lock()
+	heap.Push(&o.pending, count)
+	o.l.Unlock()
+}
+
+func (o *Order) handle(m *Map, p *ping.Ping, err error) {
+	o.l.Lock()
+	heap.Push(&o.ready, result{m: m, p: p, err: err})
+	o.deliver()
+}
+
+func (o *Order) handleAgain(p *ping.Ping, err error) {
+	o.l.Lock()
+	o.again = append(o.again, result{p: p, err: err})
+	o.deliver()
+}
+
+func (o *Order) discard(count int) {
+	o.l.Lock()
+	o.discarded[count]++
+	o.deliver()
+}
+
+// deliver runs the handler for every result whose turn it is. It is called
+// with the lock held and releases it. Only one goroutine delivers at a time,
+// the others leave their results for it.
+func (o *Order) deliver() {
+	if o.delivering {
+		o.l.Unlock()
+		return
+	}
+	o.delivering = true
+	for {
+		r, ok := o.next()
+		if !ok {
+			o.delivering = false
+			o.l.Unlock()
+			return
+		}
+		o.l.Unlock()
+		o.h(r.p, r.err)
+		if r.m != nil {
+			r.m.wg.Done()
+		}
+		o.l.Lock()
+	}
+}
+
+// next returns the next result to be handled, it is called with the lock held
+func (o *Order) next() (result, bool) {
+	if len(o.again) > 0 {
+		r := o.again[0]
+		o.again[0] = result{}
+		o.again = o.again[1:]
+		return r, true
+	}
+	for len(o.pending) > 0 && o.discarded[o.pending[0]] > 0 {
+		c := heap.Pop(&o.pending).(int)
+		if o.discarded[c]--; o.discarded[c] == 0 {
+			delete(o.discarded, c)
+		}
+	}
+	if len(o.ready) == 0 {
+		return result{}, false
+	}
+	switch c := o.ready[0].p.Count; {
+	case len(o.pending) > 0 && c == o.pending[0]:
+		heap.Pop(&o.pending)
+	case len(o.pending) > 0 && c > o.pending[0]:
+		// an earlier ping has not been handled yet
+		return result{}, false
+	}
+	return heap.Pop(&o.ready).(result), true
+}
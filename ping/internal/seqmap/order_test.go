@@ -0,0 +1,103 @@
+package seqmap
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func TestOrder(t *testing.T) {
+	assert := assert.New(t)
+	var counts []int
+	o := NewOrder(func(p *ping.Ping, err error) { counts = append(counts, p.Count) })
+	sm := New(nil)
+	sm.SetOrder(o)
+	ps := make([]*ping.Ping, 5)
+	for i := range ps {
+		ps[i] = &ping.Ping{Count: i}
+		sm.Add(ps[i])
+	}
+	pop := func(i int) *ping.Ping {
+		p, _, err := sm.Pop(ps[i].Seq)
+		assert.NoError(err)
+		return p
+	}
+
+	sm.Handle(pop(2), nil)
+	sm.Handle(pop(1), nil)
+	assert.Empty(counts, "pings are held until the ones before them are handled")
+	sm.Handle(pop(0), nil)
+	assert.Equal([]int{0, 1, 2}, counts)
+
+	// a late or duplicate reply is not held
+	sm.HandleAgain(ps[0], nil)
+	assert.Equal([]int{0, 1, 2, 0}, counts)
+
+	sm.Handle(pop(4), nil)
+	sm.Discard(pop(3))
+	assert.Equal([]int{0, 1, 2, 0, 4}, counts)
+	sm.Drain()
+
+	// pings that were never added are handled in order too
+	p := &ping.Ping{Count: 5}
+	sm.Add(p)
+	o.Handle(&ping.Ping{Count: 6}, errors.New("not sent"))
+	o.Handle(&ping.Ping{Count: 7}, errors.New("not sent"))
+	assert.Equal([]int{0, 1, 2, 0, 4}, counts)
+	rp, _, err := sm.Pop(p.Seq)
+	assert.NoError(err)
+	sm.Handle(rp, nil)
+	assert.Equal([]int{0, 1, 2, 0, 4, 5, 6, 7}, counts)
+}
+
+func TestOrderConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	const pings = 1000
+	var running int32
+	var counts []int
+	o := NewOrder(func(p *ping.Ping, err error) {
+		assert.Equal(int32(1), atomic.AddInt32(&running, 1), "handler called concurrently")
+		counts = append(counts, p.Count)
+		atomic.AddInt32(&running, -1)
+	})
+	// two maps, like a host that resolved to a new address
+	sms := []*Map{New(nil), New(nil)}
+	ps := make([]*ping.Ping, pings)
+	for i := range ps {
+		sm := sms[i%2]
+		sm.SetOrder(o)
+		ps[i] = &ping.Ping{Count: i}
+		sm.Add(ps[i])
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := pings - 1 - w; i >= 0; i -= 4 {
+				sm := sms[i%2]
+				p, _, err := sm.Pop(ps[i].Seq)
+				if assert.NoError(err) {
+					sm.Handle(p, nil)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	sms[0].Drain()
+	sms[1].Drain()
+
+	if assert.Len(counts, pings) {
+		for i, c := range counts {
+			if !assert.Equal(i, c) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package socket
+
+import (
+	"context"
+	"errors"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/dispatch"
+	"github.com/TrilliumIT/go-multiping/ping/internal/endpointmap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/timeoutmap"
+)
+
+// ErrClosed is returned when using a closed socket. Pings still pending when
+// the socket is closed are handled with it.
+var ErrClosed = errors.New("socket closed")
+
+// closedErr returns ErrClosed if the socket is closed
+func (s *Socket) closedErr() error {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close closes the socket. Endpoints can no longer be added and pings are no
+// longer sent. Pending pings are waited for until ctx is done, then the rest
+// are handled with ErrClosed and ctx.Err() is returned.
+//
+// Once every endpoint is removed and both conns are stopped, Close waits for
+// the goroutines of the socket to exit, including handlers that are running.
+func (s *Socket) Close(ctx context.Context) error {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.l.Unlock()
+
+	// no endpoints are added once closed, so these are all of them
+	v4, v6 := s.v4em.Maps(), s.v6em.Maps()
+	for _, sm := range append(v4, v6...) {
+		sm.Close()
+	}
+	drained := make(chan struct{})
+	go func() {
+		for _, sm := range append(v4, v6...) {
+			sm.Drain()
+		}
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.fail(s.v4tm, v4)
+		s.fail(s.v6tm, v6)
+	}
+
+	s.l.Lock()
+	for _, f := range []struct {
+		conn   *conn.Conn
+		em     *endpointmap.Map
+		cancel func()
+	}{{s.v4conn, s.v4em, s.v4tmCancel}, {s.v6conn, s.v6em, s.v6tmCancel}} {
+		if f.em.Clear() == 0 {
+			continue
+		}
+		if stopErr := f.conn.Stop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+		f.cancel()
+		if s.running--; s.running == 0 {
+			s.stopQueue()
+		}
+	}
+	s.l.Unlock()
+
+	s.wg.Wait()
+	s.queue.Wait()
+	s.v4conn.Wait()
+	s.v6conn.Wait()
+	return err
+}
+
+// fail handles every ping still pending in sms with ErrClosed
+func (s *Socket) fail(tm *timeoutmap.Map, sms []*seqmap.Map) {
+	for _, sm := range sms {
+		for _, p := range sm.PopAll() {
+			tm.Del(p.Dst.IP, p.ID, p.Seq)
+			s.queue.Push(dispatch.Item{Map: sm, Ping: p, Err: ErrClosed})
+		}
+	}
+}
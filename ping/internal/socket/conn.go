@@ -8,8 +8,11 @@ import (
 	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/dispatch"
 	"github.com/TrilliumIT/go-multiping/ping/internal/endpointmap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/latemap"
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
 	"github.com/TrilliumIT/go-multiping/ping/internal/timeoutmap"
 )
 
@@ -21,8 +24,11 @@ func init() {
 func (s *Socket) Add(dst *net.IPAddr, h func(*ping.Ping, error)) (ping.ID, error) {
 	s.l.Lock()
 	defer s.l.Unlock()
-	conn, em, tm, _, setCancel := s.getConnMaps(dst.IP)
-	return s.add(conn, em, tm, setCancel, dst, h)
+	if s.closed {
+		return 0, ErrClosed
+	}
+	conn, em, tm, lm, _, setCancel := s.getConnMaps(dst.IP)
+	return s.add(conn, em, tm, lm, setCancel, dst, h)
 }
 
 // ErrNoIDs is returned if there are no more avaliable ICMP IDs.
@@ -32,7 +38,7 @@ var ErrNoIDs = errors.New("no avaliable icmp IDs")
 var ErrTimedOut = errors.New("timed out")
 
 func (s *Socket) add(
-	conn *conn.Conn, em *endpointmap.Map, tm *timeoutmap.Map, setCancel func(func()),
+	conn *conn.Conn, em *endpointmap.Map, tm *timeoutmap.Map, lm *latemap.Map, setCancel func(func()),
 	dst *net.IPAddr, h func(*ping.Ping, error),
 ) (ping.ID, error) {
 	var id int
@@ -49,24 +55,36 @@ func (s *Socket) add(
 			if err != nil {
 				return 0, err
 			}
+			if s.running++; s.running == 1 {
+				s.stopQueue = s.queue.Start(s.HandlerWorkers)
+			}
 			ctx, cancel := context.WithCancel(context.Background())
 			setCancel(cancel)
+			um := s.getUnmatched(dst.IP)
+			s.wg.Add(1)
 			go func() {
+				defer s.wg.Done()
 				for ip, id, seq, _ := tm.Next(ctx); ip != nil; ip, id, seq, _ = tm.Next(ctx) {
-					handle(em, tm, &ping.Ping{Dst: &net.IPAddr{IP: ip}, ID: id, Seq: seq}, ErrTimedOut)
+					s.handle(em, tm, lm, um, &ping.Ping{Dst: &net.IPAddr{IP: ip}, ID: id, Seq: seq}, ErrTimedOut)
 				}
 			}()
 		}
+		// foreign replies are dropped after parsing if the filter can not be set
+		_ = conn.AddID(ping.ID(id))
 		return ping.ID(id), err
 	}
 	return 0, ErrNoIDs
 }
 
 // Del removes an IP from the socket, so returned echos will no longer be recieved.
+// Once the socket is closed every endpoint has been removed, Del does nothing.
 func (s *Socket) Del(dst net.IP, id ping.ID) error {
 	s.l.Lock()
 	defer s.l.Unlock()
-	conn, em, tm, cancel, _ := s.getConnMaps(dst)
+	if s.closed {
+		return nil
+	}
+	conn, em, tm, _, cancel, _ := s.getConnMaps(dst)
 	return s.del(conn, em, tm, cancel, dst, id)
 }
 
@@ -81,14 +99,18 @@ func (s *Socket) del(
 	if sl == 0 {
 		err = conn.Stop()
 		cancel()
+		if s.running--; s.running == 0 {
+			s.stopQueue()
+		}
 	}
+	_ = conn.DelID(id)
 	return err
 }
 
 // Drain blocks until all pending pings to dst have been handled
 func (s *Socket) Drain(dst net.IP, id ping.ID) {
 	s.l.Lock()
-	conn, em, tm, cancel, _ := s.getConnMaps(dst)
+	conn, em, tm, _, cancel, _ := s.getConnMaps(dst)
 	s.drain(conn, em, tm, cancel, dst, id)
 	s.l.Unlock()
 }
@@ -103,37 +125,76 @@ func (s *Socket) drain(
 	sm.Drain()
 }
 
-// SendPing sends the ping, in the process it sets the sent time
+// SetOrder sets the Order the handler of dst and id is called in
+func (s *Socket) SetOrder(dst net.IP, id ping.ID, o *seqmap.Order) error {
+	s.l.RLock()
+	_, em, _, _, _, _ := s.getConnMaps(dst)
+	s.l.RUnlock()
+	sm, ok, _ := em.Get(dst, id)
+	if !ok {
+		return endpointmap.ErrDoesNotExist
+	}
+	sm.SetOrder(o)
+	return nil
+}
+
+// SendPing queues the ping to be sent, once it is written the sent time is set.
 // This object will be held in the sequencemap until the reply is recieved
 // or it times out, at which point it will be handled. The handled object
 // will be the same as the sent ping but with the additional information from
 // having been recieved.
-func (s *Socket) SendPing(p *ping.Ping) {
-	conn, em, tm, _, _ := s.getConnMaps(p.Dst.IP)
+//
+// If the socket is closed ErrClosed is returned and the ping is not handled.
+func (s *Socket) SendPing(p *ping.Ping) error {
+	conn, em, tm, _, _, _ := s.getConnMaps(p.Dst.IP)
 	sm, ok, _ := em.Get(p.Dst.IP, p.ID)
 	if !ok {
-		return
+		return s.closedErr()
+	}
+
+	// this may block, so it is done before the timeout starts
+	limitErr := s.Limiter.Take(p.Dst.IP)
+	p.Key = s.getKey()
+	if p.Src == nil {
+		// the reply is copied into this, so handling it does not allocate
+		p.Src = &net.IPAddr{IP: make(net.IP, 0, net.IPv6len)}
 	}
 
+	// the sender marshals its own copy, once p is added the reply and timeout paths may read it
+	sp := *p
 	sl := sm.Add(p)
 	if sl == 0 {
 		// Sending was closed
-		return
+		return s.closedErr()
+	}
+	if limitErr != nil {
+		// SendPing may be called from a handler, waiting for room in the queue
+		// on one of its workers could deadlock, so a full queue drops the error
+		if rp, _, err := sm.Pop(p.Seq); err == nil {
+			s.queue.PushNoWait(dispatch.Item{Map: sm, Ping: rp, Err: limitErr})
+		}
+		return nil
 	}
 	dst, id, seq, to := p.Dst.IP, p.ID, p.Seq, p.TimeOut
+	sp.Seq = seq
 	if to > 0 {
 		tm.Add(dst, id, seq, time.Now().Add(2*to))
 	}
-	tot, err := conn.Send(p)
-	if err != nil {
-		tm.Del(dst, id, seq)
-		if rp, _, err2 := sm.Pop(seq); err2 == nil {
-			sm.Handle(rp, err)
+	conn.Send(sp, func(sent time.Time, l int, err error) {
+		if err != nil {
+			tm.Del(dst, id, seq)
+			// this runs on the sender of the conn, it must not wait for room in the queue,
+			// so a full queue drops the error
+			if rp, _, err2 := sm.Pop(seq); err2 == nil {
+				s.queue.PushNoWait(dispatch.Item{Map: sm, Ping: rp, Err: err})
+			}
+			return
 		}
-		return
-	}
-	if to > 0 {
-		// update timeout with accurate timeout time
-		tm.Update(dst, id, seq, tot)
-	}
+		sm.SetSent(seq, p, sent, l)
+		if to > 0 {
+			// update timeout with accurate timeout time
+			tm.Update(dst, id, seq, sent.Add(to))
+		}
+	})
+	return nil
 }
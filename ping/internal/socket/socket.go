@@ -3,78 +3,274 @@ package socket
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/dispatch"
 	"github.com/TrilliumIT/go-multiping/ping/internal/endpointmap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/latemap"
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/ratelimit"
 	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
 	"github.com/TrilliumIT/go-multiping/ping/internal/timeoutmap"
 )
 
 // Socket holds a raw socket connection, one for ipv4 and one for ipv6
 type Socket struct {
+	// the counters are first so they are 64 bit aligned for atomic access
+	unauthenticated uint64
+	v4unmatched     unmatched
+	v6unmatched     unmatched
+
+	// Workers is the number of workers each conn starts with, set it with SetWorkers
 	Workers int
-	l       sync.RWMutex
+	// HandlerWorkers is the number of goroutines running handlers, set it with SetHandlerWorkers
+	HandlerWorkers int
+	Limiter        *ratelimit.Limiter
+	l              sync.RWMutex
+
+	// queue holds matched pings waiting for their handlers. Its workers run
+	// while either family has a running conn.
+	queue     *dispatch.Queue
+	running   int
+	stopQueue func()
+
+	// closed is set once Close is called, wg is done once the timeout
+	// goroutines of both families have exited
+	closed bool
+	wg     sync.WaitGroup
+
+	// key holds the []byte secret payloads are authenticated with
+	key atomic.Value
+	// acceptUnquoted is set to accept ICMP errors that do not quote the MAC while a key is set
+	acceptUnquoted int32
 
 	v4conn     *conn.Conn
 	v4em       *endpointmap.Map
 	v4tm       *timeoutmap.Map
+	v4lm       *latemap.Map
 	v4tmCancel func()
 
 	v6conn     *conn.Conn
 	v6em       *endpointmap.Map
 	v6tm       *timeoutmap.Map
+	v6lm       *latemap.Map
 	v6tmCancel func()
 }
 
+// unmatched counts the replies of a family that did not match an endpoint,
+// or matched one but no ping sent to it
+type unmatched struct {
+	endpoint uint64
+	seq      uint64
+}
+
 // New creates a new socket
-func New() *Socket {
+func New(mode conn.Mode) *Socket {
 	s := &Socket{
-		Workers: 1,
+		Workers:        1,
+		HandlerWorkers: 1,
+		Limiter:        ratelimit.New(),
+		queue:          dispatch.New(dispatch.DefaultSize, dispatch.Block),
 
 		v4em:       endpointmap.New(4),
 		v4tm:       timeoutmap.New(4),
+		v4lm:       latemap.New(),
 		v4tmCancel: func() {},
 
 		v6em:       endpointmap.New(6),
 		v6tm:       timeoutmap.New(6),
+		v6lm:       latemap.New(),
 		v6tmCancel: func() {},
 	}
-	s.v4conn = conn.New(4, s.v4handle)
-	s.v6conn = conn.New(6, s.v6handle)
+	s.v4conn = conn.New(4, mode, s.v4handle)
+	s.v6conn = conn.New(6, mode, s.v6handle)
 	return s
 }
 
+func isV6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
+}
+
 func (s *Socket) getConnMaps(ip net.IP) (
-	*conn.Conn, *endpointmap.Map, *timeoutmap.Map, func(), func(func()),
+	*conn.Conn, *endpointmap.Map, *timeoutmap.Map, *latemap.Map, func(), func(func()),
 ) {
-	if ip.To4() == nil && ip.To16() != nil {
-		return s.v6conn, s.v6em, s.v6tm, s.v6tmCancel, func(f func()) { s.v6tmCancel = f }
+	if isV6(ip) {
+		return s.v6conn, s.v6em, s.v6tm, s.v6lm, s.v6tmCancel, func(f func()) { s.v6tmCancel = f }
+	}
+	return s.v4conn, s.v4em, s.v4tm, s.v4lm, s.v4tmCancel, func(f func()) { s.v4tmCancel = f }
+}
+
+func (s *Socket) getUnmatched(ip net.IP) *unmatched {
+	if isV6(ip) {
+		return &s.v6unmatched
 	}
-	return s.v4conn, s.v4em, s.v4tm, s.v4tmCancel, func(f func()) { s.v4tmCancel = f }
+	return &s.v4unmatched
 }
 
-func handle(
-	em *endpointmap.Map, tm *timeoutmap.Map,
+// SetLateWindow sets how long pings are remembered after they time out.
+// Replies recieved within the window are handled again as late.
+func (s *Socket) SetLateWindow(d time.Duration) {
+	s.v4lm.SetWindow(d)
+	s.v6lm.SetWindow(d)
+}
+
+// SetKey sets the secret payloads are authenticated with.
+// Replies to pings sent with a different key are dropped.
+func (s *Socket) SetKey(key []byte) {
+	k := make([]byte, len(key))
+	copy(k, key)
+	s.key.Store(k)
+}
+
+// SetAcceptUnquoted sets whether ICMP errors that do not quote the payload of the
+// echo request, so carry no MAC, are accepted while a key is set
+func (s *Socket) SetAcceptUnquoted(accept bool) {
+	var v int32
+	if accept {
+		v = 1
+	}
+	atomic.StoreInt32(&s.acceptUnquoted, v)
+}
+
+// SetWorkers sets the number of workers reading each conn, running conns are resized
+func (s *Socket) SetWorkers(n int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Workers = n
+	s.v4conn.SetWorkers(n)
+	s.v6conn.SetWorkers(n)
+}
+
+// SetHandlerWorkers sets the number of goroutines running handlers, running workers are resized
+func (s *Socket) SetHandlerWorkers(n int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.HandlerWorkers = n
+	s.queue.SetWorkers(n)
+}
+
+// SetWorkerScaling sets each conn to scale its workers between min and max,
+// if max is zero scaling is disabled
+func (s *Socket) SetWorkerScaling(min, max int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.v4conn.SetScaling(min, max)
+	s.v6conn.SetScaling(min, max)
+}
+
+// SetQueueSize sets the size of the queue of pings waiting for handlers
+func (s *Socket) SetQueueSize(size int) {
+	s.queue.SetSize(size)
+}
+
+// SetQueuePolicy sets what is done with pings matched while the queue is full
+func (s *Socket) SetQueuePolicy(p dispatch.Policy) {
+	s.queue.SetPolicy(p)
+}
+
+func (s *Socket) getKey() []byte {
+	k, _ := s.key.Load().([]byte)
+	if len(k) == 0 {
+		return nil
+	}
+	return k
+}
+
+// authentic returns false if rp needs a MAC that it does not have.
+// Echo replies and ICMP errors need one, timeouts and read errors are not replies.
+// Some routers only quote the first 8 bytes of the ICMP header in an error, leaving
+// out the payload, those are only accepted if SetAcceptUnquoted was set.
+func (s *Socket) authentic(rp *ping.Ping, err error) bool {
+	key := s.getKey()
+	if key == nil || err != nil && !isICMPError(err) {
+		return true
+	}
+	if err != nil && !rp.HasCount && atomic.LoadInt32(&s.acceptUnquoted) == 1 {
+		return true
+	}
+	if rp.Verify(key) {
+		return true
+	}
+	atomic.AddUint64(&s.unauthenticated, 1)
+	return false
+}
+
+func isICMPError(err error) bool {
+	switch err.(type) {
+	case *ping.UnreachableError, *ping.TimeExceededError, *ping.ParameterProblemError:
+		return true
+	}
+	return false
+}
+
+func (s *Socket) handle(
+	em *endpointmap.Map, tm *timeoutmap.Map, lm *latemap.Map, um *unmatched,
 	rp *ping.Ping, err error,
 ) {
-	tm.Del(rp.Dst.IP, rp.ID, rp.Seq)
+	if !s.authentic(rp, err) {
+		return
+	}
 	sm, ok, _ := em.Get(rp.Dst.IP, rp.ID)
 	if !ok {
+		tm.Del(rp.Dst.IP, rp.ID, rp.Seq)
+		// read errors have no destination, they are not replies
+		if err != ErrTimedOut && len(rp.Dst.IP) > 0 {
+			atomic.AddUint64(&um.endpoint, 1)
+		}
 		return
 	}
-	sp, _, popErr := sm.Pop(rp.Seq)
+	// a reply to an earlier ping with a wrapped Seq must not clear the timeout of the pending one
+	sp, _, popErr := sm.PopReply(rp)
 	if popErr == seqmap.ErrDoesNotExist {
+		s.handleAgain(sm, lm, um, rp, err)
 		return
 	}
+	tm.Del(rp.Dst.IP, rp.ID, rp.Seq)
+	if err == nil {
+		err = sp.CheckData(rp)
+	}
 	sp.UpdateFrom(rp)
-	sm.Handle(sp, err)
+	if err == ErrTimedOut {
+		// the handler may keep or modify sp, so a copy is remembered.
+		// A late reply is copied into its Src, which must not be shared with sp.
+		lm.Add(sp.Clone())
+	} else {
+		sp.OutOfOrder = sm.Replied(sp)
+	}
+	s.queue.Push(dispatch.Item{Map: sm, Ping: sp, Err: err})
+}
+
+// handleAgain handles a reply to a ping that is no longer waiting,
+// because it timed out or was already replied to
+func (s *Socket) handleAgain(sm *seqmap.Map, lm *latemap.Map, um *unmatched, rp *ping.Ping, err error) {
+	if err == ErrTimedOut {
+		return
+	}
+	if sp, ok := lm.Pop(rp); ok {
+		if err == nil {
+			err = sp.CheckData(rp)
+		}
+		sp.UpdateFrom(rp)
+		sp.Late = true
+		sm.Replied(sp)
+		s.queue.Push(dispatch.Item{Map: sm, Ping: sp, Err: err, Again: true})
+		return
+	}
+	if sp, ok := sm.Answered(rp); ok {
+		sp.UpdateFrom(rp)
+		sp.Duplicate = true
+		s.queue.Push(dispatch.Item{Map: sm, Ping: sp, Err: err, Again: true})
+		return
+	}
+	atomic.AddUint64(&um.seq, 1)
 }
 
 func (s *Socket) v4handle(rp *ping.Ping, err error) {
-	handle(s.v4em, s.v4tm, rp, err)
+	s.handle(s.v4em, s.v4tm, s.v4lm, &s.v4unmatched, rp, err)
 }
 
 func (s *Socket) v6handle(rp *ping.Ping, err error) {
-	handle(s.v6em, s.v6tm, rp, err)
+	s.handle(s.v6em, s.v6tm, s.v6lm, &s.v6unmatched, rp, err)
 }
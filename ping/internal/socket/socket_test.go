@@ -0,0 +1,414 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+type result struct {
+	p   *ping.Ping
+	err error
+}
+
+// collector records the pings handlers are run with, handlers run on the
+// workers of the queue so they are recorded concurrently with the test
+type collector struct {
+	l       sync.Mutex
+	results []result
+}
+
+func (c *collector) handle(p *ping.Ping, err error) {
+	c.l.Lock()
+	c.results = append(c.results, result{p, err})
+	c.l.Unlock()
+}
+
+// wait returns the results once there are n, or after a second
+func (c *collector) wait(n int) []result {
+	for end := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.l.Lock()
+		r := append([]result(nil), c.results...)
+		c.l.Unlock()
+		if len(r) >= n || time.Now().After(end) {
+			return r
+		}
+	}
+}
+
+func TestLateReply(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	s.SetLateWindow(time.Second)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	sent := time.Now()
+	sm, _, _ := s.v4em.Get(dst.IP, id)
+	sm.Add(&ping.Ping{Dst: dst, ID: id, Count: 5, Sent: sent})
+	reply := func() *ping.Ping {
+		return &ping.Ping{Dst: dst, ID: id, Seq: 5, Sent: sent, Recieved: sent.Add(1500 * time.Millisecond)}
+	}
+
+	// replies with no ping waiting are dropped
+	s.v4handle(&ping.Ping{Dst: dst, ID: id, Seq: 6}, nil)
+	assert.Empty(c.wait(0))
+
+	s.v4handle(&ping.Ping{Dst: dst, ID: id, Seq: 5}, ErrTimedOut)
+	assert.Equal(1, s.Stats().V4.LatePending)
+	s.v4handle(reply(), nil)
+	// a second reply is a duplicate, not a second late reply
+	s.v4handle(reply(), nil)
+	sm.Drain()
+
+	if results := c.wait(3); assert.Len(results, 3) {
+		assert.Equal(ErrTimedOut, results[0].err)
+		assert.False(results[0].p.Late)
+		assert.NoError(results[1].err)
+		assert.True(results[1].p.Late)
+		assert.Equal(1500*time.Millisecond, results[1].p.RTT())
+		assert.Equal(5, results[1].p.Count)
+		assert.True(results[2].p.Duplicate)
+		assert.False(results[2].p.Late)
+	}
+	assert.Zero(s.Stats().V4.LatePending)
+}
+
+func TestDuplicateOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("::1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	sent := time.Now()
+	sm, _, _ := s.v6em.Get(dst.IP, id)
+	for i := 0; i < 3; i++ {
+		sm.Add(&ping.Ping{Dst: dst, ID: id, Count: i, Sent: sent, Host: "localhost"})
+	}
+	reply := func(seq ping.Seq) *ping.Ping {
+		return &ping.Ping{Dst: dst, ID: id, Seq: seq, Sent: sent, Recieved: sent.Add(time.Millisecond)}
+	}
+	s.v6handle(reply(0), nil)
+	s.v6handle(reply(2), nil)
+	s.v6handle(reply(1), nil)
+	s.v6handle(reply(2), nil)
+	sm.Drain()
+
+	if results := c.wait(4); assert.Len(results, 4) {
+		assert.False(results[0].p.OutOfOrder)
+		assert.False(results[1].p.OutOfOrder)
+		assert.True(results[2].p.OutOfOrder)
+		assert.Equal(1, results[2].p.Count)
+		assert.True(results[3].p.Duplicate)
+		assert.Equal(2, results[3].p.Count)
+		assert.Equal("localhost", results[3].p.Host)
+		assert.Equal(time.Millisecond, results[3].p.RTT())
+	}
+}
+
+func TestWrappedSeq(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	sent := time.Now()
+	sm, _, _ := s.v4em.Get(dst.IP, id)
+	p := &ping.Ping{Dst: dst, ID: id, Count: 1<<16 + 5, Sent: sent}
+	sm.Add(p)
+	s.v4tm.Add(dst.IP, id, p.Seq, sent.Add(time.Minute))
+	reply := func(count int) *ping.Ping {
+		return &ping.Ping{Dst: dst, ID: id, Seq: p.Seq, Count: count, HasCount: true, Sent: sent, Recieved: sent.Add(time.Millisecond)}
+	}
+
+	// a reply to the ping sent 65536 pings earlier has the same seq
+	s.v4handle(reply(5), nil)
+	assert.Empty(c.wait(0))
+	assert.Equal(1, s.v4tm.Len(), "the timeout of the waiting ping should be kept")
+
+	s.v4handle(reply(p.Count), nil)
+	sm.Drain()
+	if results := c.wait(1); assert.Len(results, 1) {
+		assert.NoError(results[0].err)
+		assert.Equal(p.Count, results[0].p.Count)
+	}
+	assert.Zero(s.v4tm.Len())
+}
+
+func TestUnauthenticated(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	s.SetKey([]byte("secret"))
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	sent := time.Now()
+	sm, _, _ := s.v4em.Get(dst.IP, id)
+	p := &ping.Ping{Dst: dst, ID: id, Count: 1, Sent: sent, Key: s.getKey()}
+	sm.Add(p)
+	reply := func(key []byte) *ping.Ping {
+		rp := &ping.Ping{Dst: dst, ID: id, Seq: p.Seq, Count: p.Count, HasCount: true, Sent: sent, Recieved: time.Now()}
+		rp.MAC = rp.Sign(key)
+		return rp
+	}
+
+	s.v4handle(reply([]byte("forged")), nil)
+	// a forged send time would change the RTT
+	rp := reply([]byte("secret"))
+	rp.Sent = sent.Add(-time.Second)
+	s.v4handle(rp, nil)
+	assert.Empty(c.wait(0))
+	assert.Equal(uint64(2), s.Stats().Unauthenticated)
+
+	s.v4handle(reply([]byte("secret")), nil)
+	sm.Drain()
+	if results := c.wait(1); assert.Len(results, 1) {
+		assert.NoError(results[0].err)
+		assert.Equal(sent, results[0].p.Sent)
+	}
+	assert.Equal(uint64(2), s.Stats().Unauthenticated)
+
+	// timeouts and read errors are not authenticated
+	assert.True(s.authentic(&ping.Ping{Dst: dst, ID: id, Seq: 5}, ErrTimedOut))
+	assert.True(s.authentic(&ping.Ping{Src: &net.IPAddr{}, Dst: &net.IPAddr{}}, conn.ErrNotRunning))
+
+	// errors that do not quote the payload are dropped unless accepted
+	unreach := &ping.UnreachableError{From: dst}
+	assert.False(s.authentic(&ping.Ping{Dst: dst, ID: id, Seq: 5}, unreach))
+	assert.Equal(uint64(3), s.Stats().Unauthenticated)
+	s.SetAcceptUnquoted(true)
+	assert.True(s.authentic(&ping.Ping{Dst: dst, ID: id, Seq: 5}, unreach))
+	assert.False(s.authentic(reply([]byte("forged")), unreach), "quoted errors are always checked")
+}
+
+func TestHandleAllocs(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	id, err := s.Add(dst, func(*ping.Ping, error) {})
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	const runs = 100
+	sent := time.Now()
+	sm, _, _ := s.v4em.Get(dst.IP, id)
+	for i := 0; i <= runs; i++ {
+		// SendPing gives each ping a Src for the reply to be copied into
+		sm.Add(&ping.Ping{Dst: dst, ID: id, Count: i, Sent: sent, Src: &net.IPAddr{IP: make(net.IP, 0, net.IPv6len)}})
+	}
+	rp := &ping.Ping{Src: dst, Dst: dst, ID: id, Sent: sent, Recieved: sent.Add(time.Millisecond), HasCount: true}
+	allocs := testing.AllocsPerRun(runs, func() {
+		s.v4handle(rp, nil)
+		rp.Seq++
+		rp.Count++
+	})
+	assert.Zero(allocs)
+	assert.Equal(runs+1, rp.Count)
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	sm, _, _ := s.v4em.Get(dst.IP, id)
+	sm.Add(&ping.Ping{Dst: dst, ID: id, Count: 5})
+	st := s.Stats()
+	assert.Equal(1, st.V4.Endpoints)
+	assert.Equal(1, st.V4.Pending)
+	assert.Zero(st.V6.Pending)
+
+	s.v4handle(&ping.Ping{Dst: dst, ID: id, Seq: 6}, nil)
+	s.v4handle(&ping.Ping{Dst: dst, ID: id + 1, Seq: 5}, nil)
+	// read errors are not unmatched replies
+	s.v4handle(&ping.Ping{Src: &net.IPAddr{}, Dst: &net.IPAddr{}}, conn.ErrNotRunning)
+	st = s.Stats()
+	assert.Equal(uint64(1), st.V4.UnmatchedSeq)
+	assert.Equal(uint64(1), st.V4.UnmatchedEndpoint)
+	assert.Zero(st.V6.UnmatchedEndpoint)
+
+	s.v4tm.Add(dst.IP, id, 5, time.Now())
+	if results := c.wait(1); assert.Len(results, 1) {
+		assert.Equal(ErrTimedOut, results[0].err)
+	}
+	st = s.Stats()
+	assert.Equal(uint64(1), st.V4.TimedOut)
+	assert.Zero(st.V4.Pending)
+
+	s.SendPing(&ping.Ping{Dst: dst, ID: id, TimeOut: time.Second})
+	if results := c.wait(2); assert.Len(results, 2) {
+		assert.NoError(results[1].err)
+	}
+	st = s.Stats()
+	assert.Equal(uint64(1), st.V4.Sent)
+	assert.NotZero(st.V4.Read)
+	assert.Zero(st.V6.Sent)
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	v4 := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	v6 := &net.IPAddr{IP: net.ParseIP("::1")}
+	c := &collector{}
+	v4id, err := s.Add(v4, c.handle)
+	assert.NoError(err)
+	v6id, err := s.Add(v6, c.handle)
+	assert.NoError(err)
+
+	// pings that are never sent stay pending until the socket is closed
+	sm4, _, _ := s.v4em.Get(v4.IP, v4id)
+	sm4.Add(&ping.Ping{Dst: v4, ID: v4id, Count: 0})
+	sm6, _, _ := s.v6em.Get(v6.IP, v6id)
+	sm6.Add(&ping.Ping{Dst: v6, ID: v6id, Count: 0})
+	s.v6tm.Add(v6.IP, v6id, 0, time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, s.Close(ctx))
+	results := c.wait(2)
+	if assert.Len(results, 2) {
+		assert.Equal(ErrClosed, results[0].err)
+		assert.Equal(ErrClosed, results[1].err)
+	}
+	st := s.Stats()
+	assert.Zero(st.V4.Endpoints)
+	assert.Zero(st.V6.PendingTimeouts)
+	assert.Zero(st.V4.Workers)
+
+	_, err = s.Add(v4, c.handle)
+	assert.Equal(ErrClosed, err)
+	assert.Equal(ErrClosed, s.SendPing(&ping.Ping{Dst: v4, ID: v4id}))
+	assert.NoError(s.Del(v4.IP, v4id))
+	assert.Equal(ErrClosed, s.Close(context.Background()))
+}
+
+func TestCloseDrains(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	c := &collector{}
+	id, err := s.Add(dst, c.handle)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(s.SendPing(&ping.Ping{Dst: dst, ID: id, Count: i, TimeOut: time.Second}))
+	}
+	assert.NoError(s.Close(context.Background()))
+	results := c.wait(10)
+	if assert.Len(results, 10) {
+		for _, r := range results {
+			assert.NoError(r.err)
+		}
+	}
+}
+
+func TestSetHandlerWorkers(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	id, err := s.Add(dst, func(*ping.Ping, error) {
+		started <- struct{}{}
+		<-release
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+	defer close(release)
+
+	// the queue is already running with one worker, both handlers must run at once
+	s.SetHandlerWorkers(2)
+	for i := 0; i < 2; i++ {
+		assert.NoError(s.SendPing(&ping.Ping{Dst: dst, ID: id, Count: i, TimeOut: time.Second}))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handler workers were not resized")
+		}
+	}
+}
+
+func TestResendFromHandler(t *testing.T) {
+	assert := assert.New(t)
+	s := New(conn.ModeAuto)
+	s.SetHandlerWorkers(1)
+	s.SetQueueSize(1)
+	// after the first ping every send fails, and is handled through the queue
+	s.Limiter.Set(ratelimit.Config{Total: ratelimit.Limit{Rate: 0.001, Burst: 1}})
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	var id ping.ID
+	var count int32
+	limited := make(chan struct{}, 100)
+	send := func() {
+		_ = s.SendPing(&ping.Ping{Dst: dst, ID: id, Count: int(atomic.AddInt32(&count, 1))})
+	}
+	id, err := s.Add(dst, func(p *ping.Ping, err error) {
+		if err != ratelimit.ErrLimited {
+			return
+		}
+		// the first send fills the queue, the second is dropped rather than waiting
+		// for room on the only worker
+		if atomic.LoadInt32(&count) < 40 {
+			send()
+			send()
+		}
+		limited <- struct{}{}
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(s.Del(dst.IP, id)) }()
+
+	send()
+	send()
+	for i := 0; i < 10; i++ {
+		select {
+		case <-limited:
+		case <-time.After(time.Second):
+			t.Fatal("handler deadlocked sending from a full queue")
+		}
+	}
+	assert.NotZero(s.Stats().QueueDropped)
+}
@@ -0,0 +1,96 @@
+package socket
+
+import (
+	"sync/atomic"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/endpointmap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/latemap"
+	"github.com/TrilliumIT/go-multiping/ping/internal/timeoutmap"
+)
+
+// FamilyStats are the statistics for one address family of a socket
+type FamilyStats struct {
+	// Endpoints is the number of active destination and ICMP ID pairs
+	Endpoints int
+	// PendingTimeouts is the number of sent pings waiting for a reply or timeout
+	PendingTimeouts int
+	// LatePending is the number of timed out pings that a late reply would still be matched to
+	LatePending int
+	// Workers is the number of workers reading replies
+	Workers int
+	// Pending is the number of sent pings waiting in the sequence maps of the endpoints
+	Pending int
+	// TimedOut is the number of timeouts that have fired
+	TimedOut uint64
+	// Read is the number of packets read, including those that failed to parse
+	Read uint64
+	// Sent is the number of pings written
+	Sent uint64
+	// TooShort is the number of packets too short to be parsed
+	TooShort uint64
+	// Malformed is the number of packets that were not valid ICMP messages
+	Malformed uint64
+	// WrongType is the number of packets that were not echo replies or ICMP errors
+	WrongType uint64
+	// NotEcho is the number of ICMP errors that were not about an echo request
+	NotEcho uint64
+	// SendRetries is the number of writes retried because the kernel was out of buffer space
+	SendRetries uint64
+	// UnmatchedEndpoint is the number of replies and ICMP errors for a destination and ICMP ID that
+	// is not on the socket. Replies to other processes pinging from the same host are counted here,
+	// unless the kernel filter of a linux raw socket dropped them before they were read.
+	UnmatchedEndpoint uint64
+	// UnmatchedSeq is the number of replies and ICMP errors for an endpoint of the socket that did
+	// not match a pending ping, or a late or duplicate reply to one
+	UnmatchedSeq uint64
+}
+
+// Stats are the statistics for a socket
+type Stats struct {
+	// V4 holds statistics for ipv4
+	V4 FamilyStats
+	// V6 holds statistics for ipv6
+	V6 FamilyStats
+	// RateLimited is the number of pings that were delayed or failed by rate limits
+	RateLimited uint64
+	// Unauthenticated is the number of replies dropped because they did not carry a valid MAC
+	Unauthenticated uint64
+	// QueueDepth is the number of pings waiting for a handler
+	QueueDepth int
+	// QueueDropped is the number of pings dropped without being handled because the queue was full
+	QueueDropped uint64
+}
+
+func familyStats(c *conn.Conn, em *endpointmap.Map, tm *timeoutmap.Map, lm *latemap.Map, um *unmatched) FamilyStats {
+	cs := c.Stats()
+	return FamilyStats{
+		Endpoints:         em.Len(),
+		PendingTimeouts:   tm.Len(),
+		LatePending:       lm.Len(),
+		Workers:           c.Workers(),
+		Pending:           em.Pending(),
+		TimedOut:          tm.Fired(),
+		Read:              cs.Read,
+		Sent:              cs.Sent,
+		TooShort:          cs.TooShort,
+		Malformed:         cs.Malformed,
+		WrongType:         cs.WrongType,
+		NotEcho:           cs.NotEcho,
+		SendRetries:       cs.SendRetries,
+		UnmatchedEndpoint: atomic.LoadUint64(&um.endpoint),
+		UnmatchedSeq:      atomic.LoadUint64(&um.seq),
+	}
+}
+
+// Stats returns a snapshot of the statistics for the socket
+func (s *Socket) Stats() *Stats {
+	return &Stats{
+		V4:              familyStats(s.v4conn, s.v4em, s.v4tm, s.v4lm, &s.v4unmatched),
+		V6:              familyStats(s.v6conn, s.v6em, s.v6tm, s.v6lm, &s.v6unmatched),
+		RateLimited:     s.Limiter.Limited(),
+		Unauthenticated: atomic.LoadUint64(&s.unauthenticated),
+		QueueDepth:      s.queue.Len(),
+		QueueDropped:    s.queue.Dropped(),
+	}
+}
@@ -0,0 +1,46 @@
+package timeoutmap
+
+import (
+	"net"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+type entry struct {
+	ip    net.IP
+	id    ping.ID
+	seq   ping.Seq
+	t     time.Time
+	index int
+}
+
+// entryHeap is a min-heap of entries ordered by timeout time.
+// Entries track their own index so they can be fixed or removed in O(log n).
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool { return h[i].t.Before(h[j].t) }
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
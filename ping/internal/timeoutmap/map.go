@@ -1,8 +1,10 @@
 package timeoutmap
 
 import (
+	"container/heap"
 	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -10,49 +12,59 @@ import (
 )
 
 // Map holds a timeout map, a map of when different pings time out
+//
+// Entries are indexed by endpoint and sequence for lookups and kept in a
+// min-heap by timeout, so adding, updating and deleting are O(log n)
+// and finding the next timeout is O(1).
 type Map struct {
 	l        sync.Mutex
-	to       tMap
+	to       map[key]*entry
+	h        entryHeap
 	t        *time.Timer
-	nextIP   net.IP
-	nextID   ping.ID
-	nextSeq  ping.Seq
 	nextTime time.Time
+	// fired counts the timeouts returned by Next
+	fired uint64
 }
 
-type tMap interface {
-	add(net.IP, ping.ID, ping.Seq, time.Time)
-	del(net.IP, ping.ID, ping.Seq)
-	exists(net.IP, ping.ID, ping.Seq) bool
-	getNext() (net.IP, ping.ID, ping.Seq, time.Time)
+type key struct {
+	ip  netip.Addr
+	id  ping.ID
+	seq ping.Seq
+}
+
+func toKey(ip net.IP, id ping.ID, seq ping.Seq) key {
+	return key{ip: ping.Addr(ip), id: id, seq: seq}
 }
 
 // New creates a new timeout map
 func New(proto int) *Map {
+	if proto != 4 && proto != 6 {
+		panic("invalid protocol")
+	}
 	m := &Map{
-		t: time.NewTimer(time.Hour),
+		to: make(map[key]*entry),
+		t:  time.NewTimer(time.Hour),
 	}
 	m.t.Stop()
 	select {
 	case <-m.t.C:
 	default:
 	}
-
-	switch proto {
-	case 4:
-		m.to = make(ip4m)
-	case 6:
-		m.to = make(ip6m)
-	default:
-		panic("invalid protocol")
-	}
 	return m
 }
 
 // Add adds an entry to the timeout map
 func (m *Map) Add(ip net.IP, id ping.ID, seq ping.Seq, t time.Time) {
 	m.l.Lock()
-	m.to.add(ip, id, seq, t)
+	k := toKey(ip, id, seq)
+	if e, ok := m.to[k]; ok {
+		e.t = t
+		heap.Fix(&m.h, e.index)
+	} else {
+		e = &entry{ip: ip, id: id, seq: seq, t: t}
+		heap.Push(&m.h, e)
+		m.to[k] = e
+	}
 	m.setNext()
 	m.l.Unlock()
 }
@@ -62,8 +74,9 @@ func (m *Map) Add(ip net.IP, id ping.ID, seq ping.Seq, t time.Time) {
 // been deleted by being recieved
 func (m *Map) Update(ip net.IP, id ping.ID, seq ping.Seq, t time.Time) {
 	m.l.Lock()
-	if m.to.exists(ip, id, seq) {
-		m.to.add(ip, id, seq, t)
+	if e, ok := m.to[toKey(ip, id, seq)]; ok {
+		e.t = t
+		heap.Fix(&m.h, e.index)
 		m.setNext()
 	}
 	m.l.Unlock()
@@ -73,24 +86,31 @@ func (m *Map) Update(ip net.IP, id ping.ID, seq ping.Seq, t time.Time) {
 // the ping is received
 func (m *Map) Del(ip net.IP, id ping.ID, seq ping.Seq) {
 	m.l.Lock()
-	m.to.del(ip, id, seq)
-	m.setNext()
+	k := toKey(ip, id, seq)
+	if e, ok := m.to[k]; ok {
+		delete(m.to, k)
+		heap.Remove(&m.h, e.index)
+		m.setNext()
+	}
 	m.l.Unlock()
 }
 
 func (m *Map) setNext() {
-	pnt := m.nextTime
-	m.nextIP, m.nextID, m.nextSeq, m.nextTime = m.to.getNext()
-	if pnt != m.nextTime {
+	var nt time.Time
+	if len(m.h) > 0 {
+		nt = m.h[0].t
+	}
+	if !nt.Equal(m.nextTime) {
 		m.t.Stop()
 		select {
 		case <-m.t.C:
 		default:
 		}
-		if !m.nextTime.IsZero() {
-			m.t.Reset(time.Until(m.nextTime))
+		if !nt.IsZero() {
+			m.t.Reset(time.Until(nt))
 		}
 	}
+	m.nextTime = nt
 }
 
 // Next blocks until the next packet times out, then returns the information for that packet.
@@ -103,14 +123,32 @@ func (m *Map) Next(ctx context.Context) (ip net.IP, id ping.ID, seq ping.Seq, t
 		case tt = <-m.t.C:
 		}
 		m.l.Lock()
-		ip, id, seq, t = m.nextIP, m.nextID, m.nextSeq, m.nextTime
-		if t.IsZero() || t.After(tt) {
+		if len(m.h) == 0 || m.h[0].t.After(tt) {
 			m.l.Unlock()
 			continue
 		}
-		m.to.del(ip, id, seq)
+		e := heap.Pop(&m.h).(*entry)
+		delete(m.to, toKey(e.ip, e.id, e.seq))
+		// the timer has fired, so it must be reset even if the next entry
+		// times out at the same time as this one
+		m.nextTime = time.Time{}
 		m.setNext()
+		m.fired++
 		m.l.Unlock()
-		return
+		return e.ip, e.id, e.seq, e.t
 	}
 }
+
+// Len returns the number of pending timeouts
+func (m *Map) Len() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return len(m.h)
+}
+
+// Fired returns the number of timeouts that have been returned by Next
+func (m *Map) Fired() uint64 {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.fired
+}
@@ -0,0 +1,87 @@
+package timeoutmap
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+func testIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+func TestNextOrder(t *testing.T) {
+	assert := assert.New(t)
+	m := New(4)
+	st := time.Now().Add(10 * time.Millisecond)
+	order := rand.Perm(100)
+	for i, o := range order {
+		m.Add(testIP(i), ping.ID(i), ping.Seq(i), st.Add(time.Duration(o)*time.Millisecond))
+	}
+	// deleted and updated entries should not be returned out of order
+	m.Del(testIP(0), 0, 0)
+	m.Update(testIP(1), 1, 1, st.Add(time.Hour))
+	m.Update(testIP(200), 200, 200, st)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var last time.Time
+	for i := 0; i < 98; i++ {
+		ip, id, seq, tt := m.Next(ctx)
+		if !assert.NotNil(ip) {
+			return
+		}
+		assert.True(ip.Equal(testIP(int(id))))
+		assert.Equal(ping.Seq(id), seq)
+		assert.NotEqual(ping.ID(0), id)
+		assert.NotEqual(ping.ID(1), id)
+		assert.False(tt.Before(last), "%v returned before %v", tt, last)
+		assert.False(time.Now().Before(tt), "returned before timeout")
+		last = tt
+	}
+	m.Del(testIP(1), 1, 1)
+}
+
+func TestNextSameTime(t *testing.T) {
+	assert := assert.New(t)
+	m := New(6)
+	tt := time.Now().Add(time.Millisecond)
+	ip := net.ParseIP("::1")
+	for i := 0; i < 10; i++ {
+		m.Add(ip, 1, ping.Seq(i), tt)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		rip, _, _, _ := m.Next(ctx)
+		assert.NotNil(rip)
+	}
+}
+
+func benchmarkAddDel(b *testing.B, n int) {
+	m := New(4)
+	st := time.Now().Add(time.Hour)
+	for i := 0; i < n; i++ {
+		m.Add(testIP(i), ping.ID(i), ping.Seq(i), st.Add(time.Duration(rand.Int63n(int64(time.Hour)))))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, id, seq := testIP(n+i%n), ping.ID(i), ping.Seq(i)
+		m.Add(ip, id, seq, st.Add(time.Duration(rand.Int63n(int64(time.Hour)))))
+		m.Update(ip, id, seq, st.Add(time.Duration(rand.Int63n(int64(time.Hour)))))
+		m.Del(ip, id, seq)
+	}
+}
+
+func BenchmarkAddDel(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("outstanding-%v", n), func(b *testing.B) { benchmarkAddDel(b, n) })
+	}
+}
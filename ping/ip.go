@@ -7,12 +7,15 @@ import (
 	"time"
 
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/TrilliumIT/go-multiping/ping/internal/seqmap"
 )
 
 // IPConn holds a connection to a destination ip address
 type IPConn struct {
-	count int64
-	ipc   *ipConn
+	count    int64
+	ipc      *ipConn
+	hist     *Histogram
+	counters *connCounters
 }
 
 // NewIPConn creates a new connection
@@ -22,7 +25,14 @@ func NewIPConn(dst *net.IPAddr, handle HandleFunc, timeout time.Duration) (*IPCo
 
 // NewIPConn creates a new connection
 func (s *Socket) NewIPConn(dst *net.IPAddr, handle HandleFunc, timeout time.Duration) (*IPConn, error) {
-	return s.newIPConn(dst, iHandle(handle), timeout)
+	c, err := s.newIPConn(dst, s.iHandle(handle), timeout)
+	if err != nil {
+		return nil, err
+	}
+	// only connections opened by the user are tracked, the socket closes its own
+	s.leaks.add(c.ipc)
+	s.leaks.watch(c)
+	return c, nil
 }
 
 // ID returns the ICMP ID associated with this connection
@@ -30,6 +40,47 @@ func (c *IPConn) ID() int {
 	return int(c.ipc.id)
 }
 
+// SetPayload sets the payload sent with each echo request. ErrPayloadTooSmall is
+// returned for a size below MinPayloadSize, see Payload for the smallest sizes.
+//
+// This must be called before any pings are sent.
+func (c *IPConn) SetPayload(p Payload) error {
+	pl, err := p.data()
+	if err != nil {
+		return err
+	}
+	c.ipc.payload = pl
+	return nil
+}
+
+// SetOrdered sets whether handler calls for this connection are serialized in Count order.
+// The default is false.
+//
+// When set, the handler is never run concurrently for this connection, and a reply is
+// only handled once every ping sent before it has been replied to or timed out. Pings
+// without a timeout can hold back the pings after them indefinitely. Late and duplicate
+// replies are handled in the order they are recieved. Different connections are still
+// handled in parallel by the handler workers of the socket.
+//
+// This must be called before any pings are sent.
+func (c *IPConn) SetOrdered(ordered bool) error {
+	var o *seqmap.Order
+	if ordered {
+		o = seqmap.NewOrder(c.ipc.handle)
+	}
+	return c.ipc.setOrder(o)
+}
+
+// Histogram returns the histogram of RTTs of successful pings on this connection
+func (c *IPConn) Histogram() *Histogram {
+	return c.hist
+}
+
+// Stats returns the counts of results on this connection
+func (c *IPConn) Stats() *ConnStats {
+	return c.counters.stats()
+}
+
 func (c *IPConn) getNextPing() (*ping.Ping, error) {
 	p := &ping.Ping{
 		Count: int(atomic.AddInt64(&c.count, 1)),
@@ -48,7 +99,9 @@ func (c *IPConn) sendPing(p *ping.Ping, err error) {
 
 // SendPing sends a ping.
 //
-// Errors sending will be sent to the handler.
+// Errors sending will be sent to the handler. If the socket is closed the handler is
+// called with ErrSocketClosed before SendPing returns, on the calling goroutine. That
+// call is not ordered by SetOrdered or waited for by Drain.
 func (c *IPConn) SendPing() {
 	c.sendPing(c.getNextPing())
 }
@@ -75,7 +128,7 @@ func IPOnce(dst *net.IPAddr, timeout time.Duration) (*Ping, error) {
 // It is not recommended to use IPOnce in a loop, use Interval, or create a Conn and call SendPing() in a loop
 func (s *Socket) IPOnce(dst *net.IPAddr, timeout time.Duration) (*Ping, error) {
 	sendGet := func(h HandleFunc) (func(), func() error, error) {
-		c, err := s.NewIPConn(dst, h, timeout)
+		c, err := s.newIPConn(dst, s.iHandle(h), timeout)
 		return c.SendPing, c.Close, err
 	}
 	return runOnce(sendGet)
@@ -96,14 +149,16 @@ func IPInterval(ctx context.Context, dst *net.IPAddr, handler HandleFunc, count
 //
 // If a count of zero is specified, interval will continue to send pings until ctx is canceled.
 func (s *Socket) IPInterval(ctx context.Context, dst *net.IPAddr, handler HandleFunc, count int, interval, timeout time.Duration) error {
-	c, err := s.NewIPConn(dst, handler, timeout)
+	c, err := s.newIPConn(dst, s.iHandle(handler), timeout)
 	if err != nil {
 		return err
 	}
 
-	runInterval(ctx, c.getNextPing, c.sendPing, count, interval)
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	runInterval(ctx, s.sched, ipKey(dst.IP), c.getNextPing, c.sendPing, count, interval)
 	c.Drain()
-	return c.Close()
+	return s.closedErr(c.Close())
 }
 
 // IPFlood performs IPFlood using the default socket.
@@ -113,18 +168,25 @@ func IPFlood(ctx context.Context, dst *net.IPAddr, handler HandleFunc, count int
 
 // IPFlood continuously sends pings, sending the next ping as soon as the previous one is replied or times out.
 func (s *Socket) IPFlood(ctx context.Context, dst *net.IPAddr, handler HandleFunc, count int, timeout time.Duration) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
 	fC := make(chan struct{})
 	floodHander := func(p *Ping, err error) {
-		fC <- struct{}{}
+		if !p.Again() {
+			select {
+			case fC <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
 		handler(p, err)
 	}
 
-	c, err := s.NewIPConn(dst, floodHander, timeout)
+	c, err := s.newIPConn(dst, s.iHandle(floodHander), timeout)
 	if err != nil {
 		return err
 	}
 
 	runFlood(ctx, c.getNextPing, c.sendPing, fC, count)
 	c.Drain()
-	return c.Close()
+	return s.closedErr(c.Close())
 }
@@ -42,18 +42,63 @@ func TestIPOnceV6(t *testing.T) {
 	assert.True(dst.IP.Equal(p.Dst.IP))
 }
 
+func testIPConnMode(mode Mode, host string) func(*testing.T) {
+	return func(t *testing.T) {
+		assert := assert.New(t)
+		s := NewSocket(WithMode(mode))
+		dst, err := net.ResolveIPAddr("ip", host)
+		assert.NoError(err)
+		rCh := make(chan *ret, 1)
+		c, err := s.NewIPConn(dst, func(p *Ping, err error) { rCh <- &ret{p, err} }, time.Second)
+		if !assert.NoError(err) {
+			return
+		}
+		c.SendPing()
+		r := <-rCh
+		assert.NoError(c.Close())
+		assert.NoError(r.err)
+		if !assert.NotNil(r.p) {
+			return
+		}
+		assert.NotZero(r.p.RTT())
+		assert.NotZero(r.p.TTL)
+		assert.True(dst.IP.Equal(r.p.Dst.IP))
+		assert.Equal(c.ID(), r.p.ID)
+	}
+}
+
+func TestIPConnModes(t *testing.T) {
+	modes := map[string]Mode{
+		"raw":          ModeRaw,
+		"unprivileged": ModeUnprivileged,
+	}
+	for n, m := range modes {
+		for _, h := range []string{"127.0.0.1", "::1"} {
+			t.Run(fmt.Sprintf("%v-%v", n, h), testIPConnMode(m, h))
+		}
+	}
+}
+
 func TestIPOnceUnreachable(t *testing.T) {
 	assert := assert.New(t)
 	dst, err := net.ResolveIPAddr("ip", "198.51.100.1")
 	assert.NoError(err)
 	p, err := IPOnce(dst, time.Second)
-	assert.Equal(ErrTimedOut, err)
 	assert.NotNil(p)
 	assert.WithinDuration(time.Now(), p.Sent, 2*time.Second)
+	assert.True(dst.IP.Equal(p.Dst.IP))
+	// depending on the network, the echo is either dropped silently
+	// or a router sends back destination unreachable
+	if ue, ok := err.(*UnreachableError); ok {
+		assert.NotNil(ue.From)
+		assert.NotZero(p.Recieved)
+		assert.NotZero(p.TTL)
+		return
+	}
+	assert.Equal(ErrTimedOut, err)
 	assert.Zero(p.Recieved)
 	assert.Zero(p.RTT())
 	assert.Zero(p.TTL)
-	assert.True(dst.IP.Equal(p.Dst.IP))
 }
 
 func testIPDrain(t *testing.T) {
@@ -106,3 +151,68 @@ func Test10kDeadLock(t *testing.T) {
 	assert.NoError(IPInterval(ctx, dst, h, 10000, 0, time.Second))
 	cancel()
 }
+
+func TestIPConnOrdered(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	s.SetHandlerWorkers(4)
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+
+	const pings = 50
+	var running int32
+	var counts []int
+	done := make(chan struct{})
+	h := func(p *Ping, err error) {
+		assert.Equal(int32(1), atomic.AddInt32(&running, 1), "handler called concurrently")
+		counts = append(counts, p.Count)
+		// slow handlers let replies queue up for the other workers
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if len(counts) == pings {
+			close(done)
+		}
+	}
+	c, err := s.NewIPConn(dst, h, time.Second)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(c.Close()) }()
+	assert.NoError(c.SetOrdered(true))
+
+	for i := 0; i < pings; i++ {
+		c.SendPing()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not all pings were handled")
+	}
+	for i, c := range counts {
+		if !assert.Equal(i, c) {
+			break
+		}
+	}
+}
+
+func TestSetWorkers(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+	c, err := s.NewIPConn(dst, func(*Ping, error) {}, time.Second)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(1, s.Stats().V4.Workers)
+
+	// the workers of an open connection are resized
+	s.SetWorkers(3)
+	assert.Equal(3, s.Stats().V4.Workers)
+	s.SetWorkers(2)
+	assert.Eventually(func() bool { return s.Stats().V4.Workers == 2 }, time.Second, time.Millisecond)
+	assert.Zero(s.Stats().V6.Workers)
+
+	assert.NoError(c.Close())
+	assert.Zero(s.Stats().V4.Workers)
+}
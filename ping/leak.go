@@ -0,0 +1,108 @@
+package ping
+
+import (
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// LeakedConn is a connection that was never closed, reported by WithLeakDetection
+type LeakedConn struct {
+	// Dst is the destination of the connection
+	Dst *net.IPAddr
+	// ID is the ICMP ID of the connection
+	ID int
+	// Stack is the stack trace of the goroutine that opened the connection
+	Stack string
+	// Collected is set if the connection was garbage collected, otherwise it was
+	// still open when the socket was closed
+	Collected bool
+}
+
+// WithLeakDetection records where each IPConn on the socket is opened.
+// report is called for each IPConn that is garbage collected without being closed,
+// which is then closed, and for each IPConn still open when the socket is closed.
+// The connections of interval pings, host connections and monitors are closed by
+// the socket, they are not tracked.
+//
+// An IPConn referenced by its own handler is never garbage collected, it is only
+// reported when the socket is closed. This is meant for debugging, recording where
+// every connection is opened is slow.
+func WithLeakDetection(report func(*LeakedConn)) SocketOption {
+	return func(c *socketConf) { c.leaks = report }
+}
+
+// leakTracker records the open IPConns of a socket. A nil leakTracker tracks nothing.
+type leakTracker struct {
+	l      sync.Mutex
+	report func(*LeakedConn)
+	open   map[*ipConn]*LeakedConn
+}
+
+func newLeakTracker(report func(*LeakedConn)) *leakTracker {
+	if report == nil {
+		return nil
+	}
+	return &leakTracker{report: report, open: make(map[*ipConn]*LeakedConn)}
+}
+
+// add records where c was opened
+func (t *leakTracker) add(c *ipConn) {
+	if t == nil {
+		return
+	}
+	lc := &LeakedConn{Dst: c.dst, ID: int(c.id), Stack: string(debug.Stack())}
+	t.l.Lock()
+	t.open[c] = lc
+	t.l.Unlock()
+}
+
+// del forgets c once it is closed
+func (t *leakTracker) del(c *ipConn) {
+	if t == nil {
+		return
+	}
+	t.l.Lock()
+	delete(t.open, c)
+	t.l.Unlock()
+}
+
+// pop removes and returns the record of c, or nil if it is closed
+func (t *leakTracker) pop(c *ipConn) *LeakedConn {
+	t.l.Lock()
+	defer t.l.Unlock()
+	lc := t.open[c]
+	delete(t.open, c)
+	return lc
+}
+
+// watch reports c if it is garbage collected while open
+func (t *leakTracker) watch(c *IPConn) {
+	if t == nil {
+		return
+	}
+	runtime.SetFinalizer(c, func(c *IPConn) {
+		lc := t.pop(c.ipc)
+		if lc == nil {
+			return
+		}
+		lc.Collected = true
+		t.report(lc)
+		_ = c.ipc.close()
+	})
+}
+
+// closed reports every connection still open when the socket is closed
+func (t *leakTracker) closed() {
+	if t == nil {
+		return
+	}
+	t.l.Lock()
+	open := t.open
+	t.open = make(map[*ipConn]*LeakedConn)
+	t.l.Unlock()
+	for _, lc := range open {
+		t.report(lc)
+	}
+}
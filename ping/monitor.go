@@ -0,0 +1,165 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Target is a host pinged by a Monitor
+type Target struct {
+	// Host is the hostname or ip address to ping. Targets in a Monitor are identified by Host.
+	Host string
+	// Interval is the time between pings.
+	// If an interval of zero is specified, pings are sent as fast as possible.
+	Interval time.Duration
+	// Timeout is how long to wait for a reply. If zero pings never time out.
+	Timeout time.Duration
+	// ReResolveEvery is how many pings are sent before resolving the host again.
+	// Zero resolves once.
+	ReResolveEvery int
+	// Labels are arbitrary metadata for the target
+	Labels map[string]string
+	// Handler handles the results of pings to the target
+	Handler HandleFunc
+}
+
+func (t *Target) copy() *Target {
+	c := *t
+	if t.Labels != nil {
+		c.Labels = make(map[string]string, len(t.Labels))
+		for k, v := range t.Labels {
+			c.Labels[k] = v
+		}
+	}
+	return &c
+}
+
+// ErrTargetExists is returned when adding a target with the same host as an existing target
+var ErrTargetExists = errors.New("target already exists")
+
+// ErrTargetNotFound is returned when updating or removing a target that does not exist
+var ErrTargetNotFound = errors.New("target not found")
+
+type monitorTarget struct {
+	t      *Target
+	cancel func()
+	done   chan struct{}
+}
+
+// Monitor pings a changing set of targets.
+//
+// Each target is pinged on its own interval from the time it is added until it is removed.
+// Adding, updating or removing a target does not affect the others.
+type Monitor struct {
+	s       *Socket
+	l       sync.Mutex
+	targets map[string]*monitorTarget
+}
+
+// NewMonitor creates a Monitor on the default socket
+func NewMonitor() *Monitor {
+	return DefaultSocket().NewMonitor()
+}
+
+// NewMonitor creates a Monitor with no targets
+func (s *Socket) NewMonitor() *Monitor {
+	return &Monitor{
+		s:       s,
+		targets: make(map[string]*monitorTarget),
+	}
+}
+
+func (m *Monitor) start(t *Target) *monitorTarget {
+	// targets stop when the socket is closed
+	ctx, cancel := m.s.context(context.Background())
+	mt := &monitorTarget{t: t, cancel: cancel, done: make(chan struct{})}
+	h := t.Handler
+	if h == nil {
+		h = func(*Ping, error) {}
+	}
+	go func() {
+		defer close(mt.done)
+		hc := m.s.NewHostConn(t.Host, t.ReResolveEvery, h, t.Timeout)
+		runInterval(ctx, m.s.sched, hostKey(t.Host), hc.getNextPing, hc.sendPing, 0, t.Interval)
+		hc.Drain()
+		_ = hc.Close()
+	}()
+	return mt
+}
+
+// stop stops pinging a target and blocks until its pending pings are handled
+func (mt *monitorTarget) stop() {
+	mt.cancel()
+	<-mt.done
+}
+
+// Add starts pinging t
+func (m *Monitor) Add(t *Target) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if _, ok := m.targets[t.Host]; ok {
+		return ErrTargetExists
+	}
+	m.targets[t.Host] = m.start(t.copy())
+	return nil
+}
+
+// Update replaces the target with the same host as t.
+//
+// Pinging with the new settings starts immediately. Update blocks until pending pings
+// sent with the old settings have been handled, by the old handler.
+func (m *Monitor) Update(t *Target) error {
+	m.l.Lock()
+	mt, ok := m.targets[t.Host]
+	if !ok {
+		m.l.Unlock()
+		return ErrTargetNotFound
+	}
+	m.targets[t.Host] = m.start(t.copy())
+	m.l.Unlock()
+	mt.stop()
+	return nil
+}
+
+// Remove stops pinging host. It blocks until pending pings to host have been handled.
+func (m *Monitor) Remove(host string) error {
+	m.l.Lock()
+	mt, ok := m.targets[host]
+	delete(m.targets, host)
+	m.l.Unlock()
+	if !ok {
+		return ErrTargetNotFound
+	}
+	mt.stop()
+	return nil
+}
+
+// Targets returns a copy of the current targets, sorted by host
+func (m *Monitor) Targets() []*Target {
+	m.l.Lock()
+	r := make([]*Target, 0, len(m.targets))
+	for _, mt := range m.targets {
+		r = append(r, mt.t.copy())
+	}
+	m.l.Unlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].Host < r[j].Host })
+	return r
+}
+
+// Close removes all targets. It blocks until all pending pings have been handled.
+func (m *Monitor) Close() error {
+	m.l.Lock()
+	targets := m.targets
+	m.targets = make(map[string]*monitorTarget)
+	m.l.Unlock()
+	for _, mt := range targets {
+		mt.cancel()
+	}
+	for _, mt := range targets {
+		<-mt.done
+	}
+	return nil
+}
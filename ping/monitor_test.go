@@ -0,0 +1,55 @@
+package ping
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitor(t *testing.T) {
+	assert := assert.New(t)
+	m := NewMonitor()
+	var v4, v6, v6new int64
+	counter := func(c *int64) HandleFunc {
+		return func(p *Ping, err error) {
+			assert.NoError(err)
+			atomic.AddInt64(c, 1)
+		}
+	}
+	assert.NoError(m.Add(&Target{Host: "127.0.0.1", Interval: 10 * time.Millisecond, Timeout: time.Second, Handler: counter(&v4)}))
+	assert.NoError(m.Add(&Target{Host: "::1", Interval: 10 * time.Millisecond, Timeout: time.Second,
+		Labels: map[string]string{"site": "lo"}, Handler: counter(&v6)}))
+	assert.Equal(ErrTargetExists, m.Add(&Target{Host: "::1"}))
+
+	ts := m.Targets()
+	if assert.Len(ts, 2) {
+		assert.Equal("127.0.0.1", ts[0].Host)
+		assert.Equal("::1", ts[1].Host)
+		assert.Equal("lo", ts[1].Labels["site"])
+		ts[1].Labels["site"] = "changed"
+		assert.Equal("lo", m.Targets()[1].Labels["site"], "targets should be copies")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(m.Update(&Target{Host: "::1", Interval: 10 * time.Millisecond, Timeout: time.Second, Handler: counter(&v6new)}))
+	v6AtUpdate := atomic.LoadInt64(&v6)
+	assert.NotZero(v6AtUpdate)
+	assert.Equal(ErrTargetNotFound, m.Update(&Target{Host: "192.0.2.1"}))
+
+	assert.NoError(m.Remove("127.0.0.1"))
+	v4AtRemove := atomic.LoadInt64(&v4)
+	assert.NotZero(v4AtRemove)
+	assert.Equal(ErrTargetNotFound, m.Remove("127.0.0.1"))
+	assert.Len(m.Targets(), 1)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(v4AtRemove, atomic.LoadInt64(&v4), "removed target should not be pinged")
+	assert.Equal(v6AtUpdate, atomic.LoadInt64(&v6), "old handler should not be called after update")
+	assert.NotZero(atomic.LoadInt64(&v6new))
+
+	assert.NoError(m.Close())
+	assert.Empty(m.Targets())
+	assert.Zero(DefaultSocket().Stats().V6.Endpoints)
+}
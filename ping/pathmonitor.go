@@ -0,0 +1,325 @@
+package ping
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// PathMonitorOptions configures a PathMonitor
+type PathMonitorOptions struct {
+	// Interval is how often the path is probed
+	Interval time.Duration
+	// Timeout is how long to wait for a response to each probe
+	Timeout time.Duration
+	// MaxHops is the highest ttl or hop limit that will be probed
+	MaxHops int
+	// Window is the number of probes per hop that statistics are calculated over.
+	// Responders that have not been seen within the window are forgotten.
+	Window int
+}
+
+// DefaultPathMonitorOptions returns the options used for any unset fields in the options passed to NewPathMonitor
+func DefaultPathMonitorOptions() *PathMonitorOptions {
+	return &PathMonitorOptions{
+		Interval: time.Second,
+		Timeout:  time.Second,
+		MaxHops:  30,
+		Window:   100,
+	}
+}
+
+// PathEventType is the type of a PathEvent
+type PathEventType int
+
+const (
+	// PathNewResponder is sent when a hop is answered by an address that has not
+	// responded for that hop within the window
+	PathNewResponder PathEventType = iota
+	// PathLengthChanged is sent when the number of hops to the destination changes
+	PathLengthChanged
+	// PathError is sent when probing the path fails, for instance because the host failed to resolve
+	PathError
+)
+
+// PathEvent describes a change in the path to a host
+type PathEvent struct {
+	// Type is the type of the event
+	Type PathEventType
+	// Host is the host being monitored
+	Host string
+	// Time is when the change was detected
+	Time time.Time
+	// TTL is the hop with a new responder. Only set for PathNewResponder.
+	TTL int
+	// Responder is the new responder. Only set for PathNewResponder.
+	Responder *net.IPAddr
+	// OldLength and NewLength are the number of hops before and after a PathLengthChanged event
+	OldLength, NewLength int
+	// Err is the error for a PathError event
+	Err error
+}
+
+// PathEventFunc is a function to handle PathEvents
+type PathEventFunc func(*PathEvent)
+
+// HopStats are the rolling statistics for a single hop
+type HopStats struct {
+	// TTL is the ttl or hop limit of the hop
+	TTL int
+	// Responders are the addresses that responded for this hop within the window
+	Responders []*net.IPAddr
+	// Sent is the number of probes within the window
+	Sent int
+	// Lost is the number of probes within the window that were not answered
+	Lost int
+	// Last is the RTT of the most recent answered probe
+	Last time.Duration
+	// Min, Avg and Max are the minimum, average and maximum RTT of answered probes
+	Min, Avg, Max time.Duration
+	// StdDev is the standard deviation of the RTT of answered probes
+	StdDev time.Duration
+	// Jitter is the mean difference in RTT between consecutive answered probes
+	Jitter time.Duration
+}
+
+// Loss returns the fraction of probes to this hop that were lost
+func (h *HopStats) Loss() float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return float64(h.Lost) / float64(h.Sent)
+}
+
+type hopSample struct {
+	rtt  time.Duration
+	lost bool
+}
+
+type hopResponder struct {
+	addr     *net.IPAddr
+	lastSeen int
+}
+
+// hopWindow is a ring of the most recent samples for a hop
+type hopWindow struct {
+	samples    []hopSample
+	next       int
+	full       bool
+	responders map[string]*hopResponder
+}
+
+func newHopWindow(size int) *hopWindow {
+	return &hopWindow{
+		samples:    make([]hopSample, size),
+		responders: make(map[string]*hopResponder),
+	}
+}
+
+func (w *hopWindow) add(s hopSample) {
+	w.samples[w.next] = s
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// addResponder records a responder and returns true if it was not already known
+func (w *hopWindow) addResponder(a *net.IPAddr, cycle int) bool {
+	k := a.IP.String()
+	r, ok := w.responders[k]
+	if ok {
+		r.lastSeen = cycle
+		return false
+	}
+	w.responders[k] = &hopResponder{addr: a, lastSeen: cycle}
+	return true
+}
+
+func (w *hopWindow) expire(cycle int) {
+	for k, r := range w.responders {
+		if cycle-r.lastSeen >= len(w.samples) {
+			delete(w.responders, k)
+		}
+	}
+}
+
+// ordered returns the samples oldest first
+func (w *hopWindow) ordered() []hopSample {
+	if !w.full {
+		return w.samples[:w.next]
+	}
+	return append(append([]hopSample{}, w.samples[w.next:]...), w.samples[:w.next]...)
+}
+
+func (w *hopWindow) stats(ttl int) *HopStats {
+	h := &HopStats{TTL: ttl}
+	for _, r := range w.responders {
+		h.Responders = append(h.Responders, r.addr)
+	}
+	var rtt rttAcc
+	var jSum float64
+	var jN int
+	for _, s := range w.ordered() {
+		h.Sent++
+		if s.lost {
+			h.Lost++
+			continue
+		}
+		if rtt.n > 0 {
+			jSum += math.Abs(float64(s.rtt - rtt.last))
+			jN++
+		}
+		rtt.add(s.rtt)
+	}
+	h.Last, h.Min, h.Avg, h.Max, h.StdDev = rtt.last, rtt.min, rtt.avg(), rtt.max, rtt.stdDev()
+	if jN > 0 {
+		h.Jitter = time.Duration(jSum / float64(jN))
+	}
+	return h
+}
+
+// PathMonitor continuously probes every hop to a host, keeping rolling statistics
+// for each hop and sending events when the path changes.
+type PathMonitor struct {
+	s       *Socket
+	host    string
+	handler PathEventFunc
+	opts    *PathMonitorOptions
+
+	l      sync.Mutex
+	hops   []*hopWindow
+	length int
+	cycle  int
+}
+
+// NewPathMonitor creates a PathMonitor on the default socket.
+func NewPathMonitor(host string, handler PathEventFunc, opts *PathMonitorOptions) *PathMonitor {
+	return DefaultSocket().NewPathMonitor(host, handler, opts)
+}
+
+// NewPathMonitor creates a PathMonitor for host. Events are sent to handler, which may be nil.
+//
+// Probing does not start until Run is called.
+func (s *Socket) NewPathMonitor(host string, handler PathEventFunc, opts *PathMonitorOptions) *PathMonitor {
+	o := DefaultPathMonitorOptions()
+	if opts != nil {
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+		if opts.MaxHops > 0 {
+			o.MaxHops = opts.MaxHops
+		}
+		if opts.Window > 0 {
+			o.Window = opts.Window
+		}
+	}
+	if handler == nil {
+		handler = func(*PathEvent) {}
+	}
+	return &PathMonitor{
+		s:       s,
+		host:    host,
+		handler: handler,
+		opts:    o,
+	}
+}
+
+// Run probes the path every interval until ctx is canceled.
+//
+// Each probe is a single round Trace, so a PathMonitor uses one ICMP ID from the socket
+// at a time, and any number of PathMonitors and pings can share the same socket.
+func (m *PathMonitor) Run(ctx context.Context) error {
+	t := time.NewTicker(m.opts.Interval)
+	defer t.Stop()
+	for {
+		r, err := m.s.Trace(ctx, m.host, &TraceOptions{
+			MaxHops: m.opts.MaxHops,
+			Probes:  1,
+			Timeout: m.opts.Timeout,
+		})
+		if ctxDone(ctx) {
+			return nil
+		}
+		if err != nil {
+			m.handler(&PathEvent{Type: PathError, Host: m.host, Time: time.Now(), Err: err})
+		} else {
+			m.update(r)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (m *PathMonitor) update(r *TraceResult) {
+	var events []*PathEvent
+	now := time.Now()
+
+	m.l.Lock()
+	first := m.cycle == 0
+	for _, h := range r.Hops {
+		for len(m.hops) < h.TTL {
+			m.hops = append(m.hops, newHopWindow(m.opts.Window))
+		}
+		w := m.hops[h.TTL-1]
+		for _, p := range h.Probes {
+			w.add(hopSample{rtt: p.RTT, lost: p.Lost()})
+			if p.Lost() {
+				continue
+			}
+			if w.addResponder(p.From, m.cycle) && !first {
+				events = append(events, &PathEvent{
+					Type: PathNewResponder, Host: m.host, Time: now, TTL: h.TTL, Responder: p.From,
+				})
+			}
+		}
+		w.expire(m.cycle)
+	}
+	if r.Reached {
+		if m.length != len(r.Hops) && m.length != 0 {
+			events = append(events, &PathEvent{
+				Type: PathLengthChanged, Host: m.host, Time: now, OldLength: m.length, NewLength: len(r.Hops),
+			})
+		}
+		m.length = len(r.Hops)
+	}
+	m.cycle++
+	m.l.Unlock()
+
+	for _, e := range events {
+		m.handler(e)
+	}
+}
+
+// Length returns the number of hops to the destination, as of the most recent
+// probe that reached it. It is zero if the destination has not been reached.
+func (m *PathMonitor) Length() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.length
+}
+
+// Hops returns a snapshot of the statistics for each hop.
+//
+// It is safe to call while the monitor is running.
+func (m *PathMonitor) Hops() []*HopStats {
+	m.l.Lock()
+	defer m.l.Unlock()
+	n := len(m.hops)
+	if m.length > 0 && m.length < n {
+		n = m.length
+	}
+	r := make([]*HopStats, n)
+	for i := range r {
+		r[i] = m.hops[i].stats(i + 1)
+	}
+	return r
+}
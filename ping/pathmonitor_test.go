@@ -0,0 +1,100 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathMonitorLocal(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var events []*PathEvent
+	m := NewPathMonitor("127.0.0.1", func(e *PathEvent) { events = append(events, e) },
+		&PathMonitorOptions{Interval: 50 * time.Millisecond, Window: 5})
+	assert.NoError(m.Run(ctx))
+	assert.Empty(events)
+	assert.Equal(1, m.Length())
+	hops := m.Hops()
+	if assert.Len(hops, 1) {
+		assert.Equal(5, hops[0].Sent)
+		assert.Zero(hops[0].Loss())
+		assert.Len(hops[0].Responders, 1)
+		assert.NotZero(hops[0].Avg)
+		assert.True(hops[0].Min <= hops[0].Avg && hops[0].Avg <= hops[0].Max)
+	}
+}
+
+func TestPathMonitorEvents(t *testing.T) {
+	assert := assert.New(t)
+	var events []*PathEvent
+	m := NewPathMonitor("192.0.2.10", func(e *PathEvent) { events = append(events, e) },
+		&PathMonitorOptions{Window: 2})
+	ip := func(s string) *net.IPAddr { return &net.IPAddr{IP: net.ParseIP(s)} }
+	te := func(a *net.IPAddr) *TraceProbe {
+		return &TraceProbe{From: a, RTT: time.Millisecond, Err: &TimeExceededError{From: a}}
+	}
+	dst := ip("192.0.2.10")
+	reply := &TraceProbe{From: dst, RTT: 2 * time.Millisecond}
+
+	m.update(&TraceResult{Reached: true, Hops: []*Hop{
+		{TTL: 1, Probes: []*TraceProbe{te(ip("192.0.2.1"))}},
+		{TTL: 2, Probes: []*TraceProbe{reply}},
+	}})
+	assert.Empty(events, "the first probe should not send events")
+
+	m.update(&TraceResult{Reached: true, Hops: []*Hop{
+		{TTL: 1, Probes: []*TraceProbe{te(ip("192.0.2.2"))}},
+		{TTL: 2, Probes: []*TraceProbe{te(ip("192.0.2.3"))}},
+		{TTL: 3, Probes: []*TraceProbe{reply}},
+	}})
+	if assert.Len(events, 4) {
+		assert.Equal(PathNewResponder, events[0].Type)
+		assert.Equal(1, events[0].TTL)
+		assert.True(events[0].Responder.IP.Equal(net.ParseIP("192.0.2.2")))
+		assert.Equal(PathNewResponder, events[1].Type)
+		assert.Equal(2, events[1].TTL)
+		assert.Equal(PathNewResponder, events[2].Type)
+		assert.Equal(3, events[2].TTL)
+		assert.Equal(PathLengthChanged, events[3].Type)
+		assert.Equal(2, events[3].OldLength)
+		assert.Equal(3, events[3].NewLength)
+	}
+
+	hops := m.Hops()
+	if assert.Len(hops, 3) {
+		assert.Len(hops[0].Responders, 2)
+		assert.Equal(2, hops[0].Sent)
+		assert.Equal(1, hops[2].Sent)
+	}
+
+	// a lost probe does not forget responders, but falling out of the window does
+	events = nil
+	lost := &Hop{TTL: 1, Probes: []*TraceProbe{{Err: ErrTimedOut}}}
+	m.update(&TraceResult{Hops: []*Hop{lost}})
+	m.update(&TraceResult{Hops: []*Hop{lost}})
+	assert.Empty(events)
+	assert.Len(m.Hops()[0].Responders, 0)
+	assert.Equal(1.0, m.Hops()[0].Loss())
+}
+
+func TestHopWindowStats(t *testing.T) {
+	assert := assert.New(t)
+	w := newHopWindow(4)
+	for _, rtt := range []time.Duration{100, 10, 30, 20, 40} {
+		w.add(hopSample{rtt: rtt})
+	}
+	w.add(hopSample{lost: true})
+	h := w.stats(1)
+	assert.Equal(4, h.Sent)
+	assert.Equal(1, h.Lost)
+	assert.Equal(time.Duration(20), h.Min)
+	assert.Equal(time.Duration(40), h.Max)
+	assert.Equal(time.Duration(30), h.Avg)
+	assert.Equal(time.Duration(40), h.Last)
+	assert.Equal(time.Duration(15), h.Jitter)
+}
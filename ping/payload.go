@@ -0,0 +1,101 @@
+package ping
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+const (
+	// MinPayloadSize is the smallest echo payload. It holds the send timestamp.
+	MinPayloadSize = ping.TimeSliceLength
+	// HeaderSize is the size of the header at the start of each payload. It holds the
+	// send timestamp, the ICMP ID, the count and the MAC.
+	HeaderSize = ping.HeaderLength
+	// MaxPayloadSize is the largest echo payload that fits in an ipv4 packet
+	MaxPayloadSize = ping.MaxPayloadLength
+)
+
+// Payload configures the data sent in each echo request.
+//
+// Replies are checked against the data that was sent. A reply with less data
+// is handled with ErrTruncated, a reply with different data is handled with
+// ErrCorrupted.
+type Payload struct {
+	// Size is the size of the ICMP echo payload in bytes. Zero sends just the header,
+	// HeaderSize. Other sizes less than MinPayloadSize are an error.
+	//
+	// Sizes less than HeaderSize send only the start of the header. Without the count,
+	// replies are matched by the 16 bit sequence alone. Pings sent with them fail with
+	// ErrPayloadTooSmall while a secret is set, as there is no room for the MAC, and on
+	// unprivileged sockets below 10 bytes, as replies are matched by the ID in the payload.
+	Size int
+	// Fill fills the payload following the header.
+	// If nil the payload is filled with zeros.
+	Fill Fill
+}
+
+// payload is the part of a payload that is set on each ping
+type payload struct {
+	// hl is the length of the header, zero is all of it
+	hl   int
+	data []byte
+}
+
+// ErrPayloadTooLarge is returned when setting a payload larger than MaxPayloadSize
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrPayloadTooSmall is returned when setting a payload smaller than MinPayloadSize.
+// Pings are handled with it if their payload is too small to be sent, see Payload.
+var ErrPayloadTooSmall = ping.ErrPayloadTooSmall
+
+func (p Payload) data() (payload, error) {
+	switch {
+	case p.Size > MaxPayloadSize:
+		return payload{}, ErrPayloadTooLarge
+	case p.Size == 0 || p.Size == HeaderSize:
+		return payload{}, nil
+	case p.Size < MinPayloadSize:
+		return payload{}, ErrPayloadTooSmall
+	case p.Size < HeaderSize:
+		return payload{hl: p.Size}, nil
+	}
+	b := make([]byte, p.Size-HeaderSize)
+	if p.Fill != nil {
+		p.Fill(b)
+	}
+	return payload{data: b}, nil
+}
+
+// Fill fills a payload. It is called once when the payload is set, and the
+// same data is sent with every echo request.
+type Fill func([]byte)
+
+// FillByte fills the payload with a single byte
+func FillByte(c byte) Fill {
+	return func(b []byte) {
+		for i := range b {
+			b[i] = c
+		}
+	}
+}
+
+// FillPattern fills the payload by repeating pattern
+func FillPattern(pattern []byte) Fill {
+	return func(b []byte) {
+		if len(pattern) == 0 {
+			return
+		}
+		for i := range b {
+			b[i] = pattern[i%len(pattern)]
+		}
+	}
+}
+
+// FillRandom fills the payload with pseudo-random bytes generated from seed
+func FillRandom(seed int64) Fill {
+	return func(b []byte) {
+		_, _ = rand.New(rand.NewSource(seed)).Read(b)
+	}
+}
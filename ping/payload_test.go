@@ -0,0 +1,104 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadData(t *testing.T) {
+	assert := assert.New(t)
+	pl, err := Payload{}.data()
+	assert.NoError(err)
+	assert.Equal(payload{}, pl)
+	pl, err = Payload{Size: HeaderSize}.data()
+	assert.NoError(err)
+	assert.Equal(payload{}, pl)
+
+	_, err = Payload{Size: MinPayloadSize - 1}.data()
+	assert.Equal(ErrPayloadTooSmall, err)
+	_, err = Payload{Size: -1}.data()
+	assert.Equal(ErrPayloadTooSmall, err)
+	pl, err = Payload{Size: MinPayloadSize, Fill: FillByte(0xff)}.data()
+	assert.NoError(err)
+	assert.Equal(payload{hl: MinPayloadSize}, pl)
+
+	pl, err = Payload{Size: HeaderSize + 5, Fill: FillByte(0xff)}.data()
+	assert.NoError(err)
+	assert.Equal([]byte{0xff, 0xff, 0xff, 0xff, 0xff}, pl.data)
+
+	pl, err = Payload{Size: HeaderSize + 5, Fill: FillPattern([]byte{1, 2})}.data()
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 1, 2, 1}, pl.data)
+
+	pl, err = Payload{Size: HeaderSize + 64, Fill: FillRandom(1)}.data()
+	assert.NoError(err)
+	pl2, err := Payload{Size: HeaderSize + 64, Fill: FillRandom(1)}.data()
+	assert.NoError(err)
+	assert.Equal(pl.data, pl2.data)
+
+	_, err = Payload{Size: MaxPayloadSize + 1}.data()
+	assert.Equal(ErrPayloadTooLarge, err)
+}
+
+func testPayload(host string, p Payload) func(*testing.T) {
+	return func(t *testing.T) {
+		assert := assert.New(t)
+		dst, err := net.ResolveIPAddr("ip", host)
+		assert.NoError(err)
+		rCh := make(chan *ret, 1)
+		c, err := NewIPConn(dst, func(p *Ping, err error) { rCh <- &ret{p, err} }, time.Second)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(c.SetPayload(p))
+		c.SendPing()
+		r := <-rCh
+		assert.NoError(c.Close())
+		assert.NoError(r.err)
+		if assert.NotNil(r.p) {
+			assert.NotZero(r.p.RTT())
+		}
+	}
+}
+
+func TestPayloadSecret(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	defer func() { assert.NoError(s.Close(context.Background())) }()
+	s.SetSecret([]byte("secret"))
+	rCh := make(chan error, 2)
+	c, err := s.NewIPConn(&net.IPAddr{IP: net.ParseIP("127.0.0.1")}, func(p *Ping, err error) { rCh <- err }, time.Second)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { assert.NoError(c.Close()) }()
+	// there is no room for the MAC
+	assert.NoError(c.SetPayload(Payload{Size: HeaderSize - 1}))
+	c.SendPing()
+	assert.Equal(ErrPayloadTooSmall, <-rCh)
+	assert.NoError(c.SetPayload(Payload{Size: HeaderSize}))
+	c.SendPing()
+	assert.NoError(<-rCh)
+}
+
+func TestPayload(t *testing.T) {
+	payloads := []Payload{
+		{Size: 0},
+		{Size: MinPayloadSize},
+		{Size: 16},
+		{Size: 56, Fill: FillByte(0xa5)},
+		{Size: 1472, Fill: FillPattern([]byte("multiping"))},
+		{Size: 8972, Fill: FillRandom(42)},
+		{Size: MaxPayloadSize, Fill: FillRandom(7)},
+	}
+	for _, h := range []string{"127.0.0.1", "::1"} {
+		for _, p := range payloads {
+			t.Run(fmt.Sprintf("%v-%v", h, p.Size), testPayload(h, p))
+		}
+	}
+}
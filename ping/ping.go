@@ -8,6 +8,19 @@ import (
 	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
 )
 
+// TimestampSource is where the recieved time of a ping came from
+type TimestampSource = ping.TimestampSource
+
+const (
+	// TimestampUser is a time taken after the read returned, it includes worker scheduling delay
+	TimestampUser = ping.TimestampUser
+	// TimestampKernel is a software timestamp taken by the kernel when the packet arrived
+	TimestampKernel = ping.TimestampKernel
+	// TimestampHardware is a timestamp taken by the network card when the packet arrived.
+	// It is not reported yet, it needs a hardware send timestamp to compare against.
+	TimestampHardware = ping.TimestampHardware
+)
+
 // Ping is an ICMP packet that has been received
 type Ping struct {
 	// Host is the hostname that was pinged
@@ -24,12 +37,17 @@ type Ping struct {
 	ID int
 	// Seq is the ICMP Sequence
 	Seq int
-	// Count is the count of this ICMP
+	// Count is the count of this ICMP. It is carried in the echo payload and replies are
+	// matched on it, so it identifies a single packet for the life of a connection, even
+	// after the 16 bit Seq wraps.
 	Count int
 	// Sent is the time the echo was sent
 	Sent time.Time
 	// Recieved is the time the echo was recieved.
+	// On linux this is the kernel receive timestamp when it is available.
 	Recieved time.Time
+	// RecievedSource is where Recieved came from
+	RecievedSource TimestampSource
 	// TimeOut is timeout duration
 	TimeOut time.Duration
 	// TTL is the ttl on the recieved packet.
@@ -37,6 +55,20 @@ type Ping struct {
 	TTL int
 	// Len is the length of the recieved packet
 	Len int
+	// Late is true for a reply recieved after the ping timed out, within the late window of the socket.
+	// The ping was already handled with ErrTimedOut, and is handled again with Late set and the RTT of the reply.
+	Late bool
+	// Duplicate is true for a second or later reply to a ping that was already replied to.
+	// Duplicates often indicate a layer 2 loop or misconfigured link aggregation.
+	Duplicate bool
+	// OutOfOrder is true for a reply recieved after the reply to a ping sent later on the same connection
+	OutOfOrder bool
+}
+
+// Again returns true if the ping was already handled, and is being handled again for a
+// late or duplicate reply. Handlers that count results should ignore these pings.
+func (p *Ping) Again() bool {
+	return p.Late || p.Duplicate
 }
 
 // RTT returns the RTT of the ping
@@ -56,24 +88,49 @@ func iPingToPing(p *ping.Ping) *Ping {
 	if p == nil {
 		return nil
 	}
-	rp := &Ping{
-		Host:     p.Host,
-		ID:       int(p.ID),
-		Seq:      int(p.Seq),
-		Count:    p.Count,
-		Sent:     p.Sent,
-		Recieved: p.Recieved,
-		TimeOut:  p.TimeOut,
-		TTL:      p.TTL,
-		Len:      p.Len,
+	return iPingInto(&Ping{}, p)
+}
+
+// iPingInto copies p into rp, reusing the addresses of rp if it has them
+func iPingInto(rp *Ping, p *ping.Ping) *Ping {
+	src, dst := rp.Src, rp.Dst
+	*rp = Ping{
+		Host:           p.Host,
+		ID:             int(p.ID),
+		Seq:            int(p.Seq),
+		Count:          p.Count,
+		Sent:           p.Sent,
+		Recieved:       p.Recieved,
+		RecievedSource: p.RecievedSource,
+		TimeOut:        p.TimeOut,
+		TTL:            p.TTL,
+		Len:            p.Len,
+		Late:           p.Late,
+		Duplicate:      p.Duplicate,
+		OutOfOrder:     p.OutOfOrder,
 	}
-	if p.Src != nil {
-		rp.Src = &net.IPAddr{}
-		*rp.Src = *p.Src
+	rp.Src = copyIPAddr(src, p.Src)
+	rp.Dst = copyIPAddr(dst, p.Dst)
+	return rp
+}
+
+// copyIPAddr copies a into dst, allocating dst if it is nil
+func copyIPAddr(dst, a *net.IPAddr) *net.IPAddr {
+	if a == nil {
+		return nil
 	}
-	if p.Dst != nil {
-		rp.Dst = &net.IPAddr{}
-		*rp.Dst = *p.Dst
+	if dst == nil {
+		dst = &net.IPAddr{}
 	}
-	return rp
+	dst.IP = append(dst.IP[:0], a.IP...)
+	dst.Zone = a.Zone
+	return dst
+}
+
+// clone returns a copy of p that does not share its addresses
+func (p *Ping) clone() *Ping {
+	rp := *p
+	rp.Src = copyIPAddr(nil, p.Src)
+	rp.Dst = copyIPAddr(nil, p.Dst)
+	return &rp
 }
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package ping
+
+// raceEnabled is set when the race detector is on, it makes sync.Pool drop items at random
+const raceEnabled = true
@@ -0,0 +1,26 @@
+package ping
+
+import (
+	"github.com/TrilliumIT/go-multiping/ping/internal/ratelimit"
+)
+
+// RateLimit is a token bucket limit on sent pings. A zero Rate is unlimited.
+type RateLimit = ratelimit.Limit
+
+// RateLimits configures the rate limits of a Socket.
+//
+// Every limit that applies to a ping must allow it before it is sent.
+type RateLimits = ratelimit.Config
+
+// ErrRateLimited is returned when a ping is not sent because it would exceed a rate limit.
+// It is only returned when RateLimits.Wait is false.
+var ErrRateLimited = ratelimit.ErrLimited
+
+// SetRateLimits sets limits on how fast pings are sent on the socket.
+// The zero RateLimits removes all limits.
+//
+// Limits apply to every ping sent on the socket, including floods and traces.
+// The number of pings that were limited is reported in the socket Stats.
+func (s *Socket) SetRateLimits(l RateLimits) {
+	s.s.Limiter.Set(l)
+}
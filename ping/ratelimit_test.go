@@ -0,0 +1,42 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimits(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+
+	s.SetRateLimits(RateLimits{Total: RateLimit{Rate: 100, Burst: 5}})
+	var ok, limited int
+	assert.NoError(s.IPInterval(context.Background(), dst, func(p *Ping, err error) {
+		switch err {
+		case nil:
+			ok++
+		case ErrRateLimited:
+			limited++
+		default:
+			assert.NoError(err)
+		}
+	}, 20, 0, time.Second))
+	assert.Equal(20, ok+limited)
+	assert.True(ok >= 5 && ok < 20, "%v pings were sent", ok)
+	assert.Equal(uint64(limited), s.Stats().RateLimited)
+
+	s.SetRateLimits(RateLimits{Destination: RateLimit{Rate: 100}, Wait: true})
+	start := time.Now()
+	assert.NoError(s.IPInterval(context.Background(), dst, func(p *Ping, err error) {
+		assert.NoError(err)
+	}, 11, 0, time.Second))
+	assert.True(time.Since(start) >= 90*time.Millisecond, "took %v", time.Since(start))
+
+	s.SetRateLimits(RateLimits{})
+}
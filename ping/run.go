@@ -16,7 +16,10 @@ type ret struct {
 func runOnce(sendGet func(HandleFunc) (func(), func() error, error)) (*Ping, error) {
 	rCh := make(chan *ret)
 	h := func(p *Ping, err error) {
-		rCh <- &ret{p, err}
+		if !p.Again() {
+			// p may be reused once the handler returns
+			rCh <- &ret{p.clone(), err}
+		}
 	}
 	send, cClose, err := sendGet(h)
 	if err != nil {
@@ -37,29 +40,31 @@ func ctxDone(ctx context.Context) bool {
 	return false
 }
 
-func runInterval(ctx context.Context, getPing func() (*ping.Ping, error), sendPing func(*ping.Ping, error), count int, interval time.Duration) {
-	var tC <-chan time.Time
+// runInterval sends count pings, or until ctx is canceled. Ticks come from sched,
+// which staggers destinations by key.
+func runInterval(ctx context.Context, sched *scheduler, key string, getPing func() (*ping.Ping, error), sendPing func(*ping.Ping, error), count int, interval time.Duration) {
+	var tC <-chan struct{}
 	switch interval {
 	case 0:
-		tc := make(chan time.Time)
+		tc := make(chan struct{})
 		tC = tc
 		close(tc)
 	default:
-		t := time.NewTicker(interval)
-		tC = t.C
-		defer t.Stop()
+		e := sched.add(key, interval)
+		tC = e.c
+		defer sched.remove(e)
 	}
 
-	for p, err := getPing(); p.Count < count || count == 0; p, err = getPing() {
-		if ctxDone(ctx) {
-			return
-		}
-		sendPing(p, err)
+	for n := 0; n < count || count == 0; n++ {
 		select {
 		case <-ctx.Done():
 			return
 		case <-tC:
 		}
+		if ctxDone(ctx) {
+			return
+		}
+		sendPing(getPing())
 	}
 }
 
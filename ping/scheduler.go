@@ -0,0 +1,208 @@
+package ping
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// Stagger selects how interval pings to different destinations are spread across the interval
+type Stagger int
+
+const (
+	// StaggerNone sends the first ping immediately, then every interval.
+	// Destinations started at the same time are pinged at the same time.
+	StaggerNone Stagger = iota
+	// StaggerHash offsets each destination by a phase derived from a hash of the destination,
+	// aligned to the wall clock. A destination is always pinged at the same point in the interval,
+	// and many destinations are spread evenly across it.
+	StaggerHash
+	// StaggerRandom offsets each destination by a random phase within the interval
+	StaggerRandom
+)
+
+type schedEntry struct {
+	next     time.Time
+	interval time.Duration
+	c        chan struct{}
+	index    int
+}
+
+type schedHeap []*schedEntry
+
+func (h schedHeap) Len() int           { return len(h) }
+func (h schedHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h schedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *schedHeap) Push(x interface{}) {
+	e := x.(*schedEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *schedHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// scheduler sends the ticks for every interval ping on a socket from a single goroutine,
+// so that the start of each destination can be staggered and the total rate can be paced.
+//
+// The goroutine runs only while there are entries.
+type scheduler struct {
+	l       sync.Mutex
+	h       schedHeap
+	stagger Stagger
+	pps     int
+	last    time.Time
+	running bool
+	wake    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+func (s *scheduler) setStagger(st Stagger) {
+	s.l.Lock()
+	s.stagger = st
+	s.l.Unlock()
+}
+
+func (s *scheduler) setRate(pps int) {
+	s.l.Lock()
+	s.pps = pps
+	s.l.Unlock()
+	s.poke()
+}
+
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ipKey returns the key of interval pings to ip. The 4 and 16 byte forms of an
+// ipv4 address are the same key, so they are staggered the same.
+func ipKey(ip net.IP) string {
+	return ping.Addr(ip).String()
+}
+
+// hostKey returns the key of interval pings to host, hosts that are ip addresses are keyed like ipKey
+func hostKey(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ipKey(ip)
+	}
+	return host
+}
+
+// first returns the time of the first tick for key
+func (s *scheduler) first(key string, interval time.Duration, now time.Time) time.Time {
+	var offset time.Duration
+	switch s.stagger {
+	case StaggerHash:
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		offset = time.Duration(h.Sum64() % uint64(interval))
+		t := now.Truncate(interval).Add(offset)
+		if t.Before(now) {
+			t = t.Add(interval)
+		}
+		return t
+	case StaggerRandom:
+		offset = time.Duration(rand.Int63n(int64(interval)))
+	}
+	return now.Add(offset)
+}
+
+// add returns an entry that recieves a tick on c every interval
+func (s *scheduler) add(key string, interval time.Duration) *schedEntry {
+	s.l.Lock()
+	e := &schedEntry{
+		next:     s.first(key, interval, time.Now()),
+		interval: interval,
+		c:        make(chan struct{}, 1),
+	}
+	heap.Push(&s.h, e)
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.l.Unlock()
+	s.poke()
+	return e
+}
+
+func (s *scheduler) remove(e *schedEntry) {
+	s.l.Lock()
+	if e.index >= 0 {
+		heap.Remove(&s.h, e.index)
+	}
+	s.l.Unlock()
+	s.poke()
+}
+
+func (s *scheduler) run() {
+	t := time.NewTimer(time.Hour)
+	for {
+		s.l.Lock()
+		if len(s.h) == 0 {
+			s.running = false
+			s.l.Unlock()
+			t.Stop()
+			return
+		}
+		now := time.Now()
+		at := s.h[0].next
+		if s.pps > 0 {
+			if p := s.last.Add(time.Second / time.Duration(s.pps)); p.After(at) {
+				at = p
+			}
+		}
+		if !at.After(now) {
+			e := s.h[0]
+			// like a time.Ticker, ticks are dropped if the reciever is not ready,
+			// only a tick that sends a ping counts against the rate
+			select {
+			case e.c <- struct{}{}:
+				s.last = now
+			default:
+			}
+			e.next = e.next.Add(e.interval)
+			// if pacing has put the entry more than an interval behind, skip the missed ticks
+			if behind := now.Sub(e.next); behind > 0 {
+				e.next = e.next.Add((behind/e.interval + 1) * e.interval)
+			}
+			heap.Fix(&s.h, 0)
+			s.l.Unlock()
+			continue
+		}
+		s.l.Unlock()
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(at.Sub(now))
+		select {
+		case <-t.C:
+		case <-s.wake:
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerFirstHash(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler()
+	s.setStagger(StaggerHash)
+	interval := time.Second
+	now := time.Now()
+
+	// the phase only depends on the key, not when the destination was added
+	a := s.first("192.0.2.1", interval, now)
+	b := s.first("192.0.2.1", interval, now.Add(300*time.Millisecond))
+	assert.True(!a.Before(now) && a.Before(now.Add(interval)))
+	assert.Equal(a.Sub(a.Truncate(interval)), b.Sub(b.Truncate(interval)))
+
+	// many destinations are spread across the interval
+	buckets := make([]int, 10)
+	for i := 0; i < 1000; i++ {
+		f := s.first(fmt.Sprintf("10.0.%v.%v", i/256, i%256), interval, now)
+		buckets[f.Sub(f.Truncate(interval))/(interval/10)]++
+	}
+	for _, c := range buckets {
+		assert.InDelta(100, c, 40)
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	assert := assert.New(t)
+	ip := net.ParseIP("192.0.2.1")
+	assert.Equal(ipKey(ip), ipKey(ip.To4()))
+	assert.Equal("192.0.2.1", ipKey(ip))
+	assert.NotEqual(ipKey(ip), ipKey(net.ParseIP("::ffff:192.0.2.2")))
+	assert.Equal(ipKey(ip), hostKey("::ffff:192.0.2.1"))
+	assert.Equal("example.com", hostKey("example.com"))
+}
+
+func TestSchedulerFirst(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler()
+	now := time.Now()
+	assert.Equal(now, s.first("a", time.Second, now))
+	s.setStagger(StaggerRandom)
+	f := s.first("a", time.Second, now)
+	assert.True(!f.Before(now) && f.Before(now.Add(time.Second)))
+}
+
+func TestSchedulerRate(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler()
+	s.setRate(100)
+	var entries []*schedEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, s.add(fmt.Sprint(i), time.Hour))
+	}
+	ch := make(chan time.Time, len(entries))
+	for _, e := range entries {
+		go func(e *schedEntry) {
+			<-e.c
+			ch <- time.Now()
+		}(e)
+	}
+	var ticks []time.Time
+	for range entries {
+		ticks = append(ticks, <-ch)
+	}
+	sort.Slice(ticks, func(i, j int) bool { return ticks[i].Before(ticks[j]) })
+	// ten ticks at 100pps span at least 90ms, not all at once
+	assert.True(ticks[9].Sub(ticks[0]) >= 80*time.Millisecond, "ticks span %v", ticks[9].Sub(ticks[0]))
+	for _, e := range entries {
+		s.remove(e)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.l.Lock()
+	assert.False(s.running, "scheduler should stop with no entries")
+	s.l.Unlock()
+}
+
+func TestSchedulerSkip(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler()
+	slow := s.add("slow", 10*time.Millisecond)
+	fast := s.add("fast", 10*time.Millisecond)
+	// slow is never read, which must not hold up fast
+	for i := 0; i < 5; i++ {
+		select {
+		case <-fast.c:
+		case <-time.After(time.Second):
+			assert.Fail("tick not recieved")
+		}
+	}
+	assert.Len(slow.c, 1)
+	s.remove(slow)
+	s.remove(fast)
+}
+
+func TestSchedulerRateSkip(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler()
+	s.setRate(10)
+	slow := s.add("slow", 10*time.Millisecond)
+	fast := s.add("fast", 100*time.Millisecond)
+	// the dropped ticks of slow must not use up the rate of fast
+	var n int
+	end := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case <-fast.c:
+			n++
+		case <-end:
+			done = true
+		}
+	}
+	assert.GreaterOrEqual(n, 8, "ticks recieved in a second")
+	s.remove(slow)
+	s.remove(fast)
+}
+
+func TestIntervalStagger(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSocket()
+	s.SetStagger(StaggerRandom)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	var sent []time.Time
+	assert.NoError(s.HostInterval(ctx, "127.0.0.1", 0, func(p *Ping, err error) {
+		assert.NoError(err)
+		sent = append(sent, p.Sent)
+	}, 3, 100*time.Millisecond, time.Second))
+	if assert.Len(sent, 3) {
+		assert.True(sent[0].Sub(start) < 100*time.Millisecond)
+		assert.InDelta(float64(100*time.Millisecond), float64(sent[2].Sub(sent[1])), float64(20*time.Millisecond))
+	}
+}
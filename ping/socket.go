@@ -1,8 +1,13 @@
 package ping
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/TrilliumIT/go-multiping/ping/internal/conn"
+	"github.com/TrilliumIT/go-multiping/ping/internal/dispatch"
 	"github.com/TrilliumIT/go-multiping/ping/internal/socket"
 )
 
@@ -14,26 +19,284 @@ import (
 //
 // In most cases using DefaultSocket() is appropriate
 type Socket struct {
-	s *socket.Socket
+	// reuse is set if pings passed to handlers are reused
+	reuse int32
+	s     *socket.Socket
+	sched *scheduler
+	pings sync.Pool
+	leaks *leakTracker
+
+	// done is closed when the socket is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Mode selects the kind of operating system socket used to send and receive ICMP
+type Mode int
+
+const (
+	// ModeAuto uses raw sockets, falling back to unprivileged datagram sockets
+	// if opening a raw socket fails with a permission error.
+	ModeAuto = Mode(conn.ModeAuto)
+	// ModeRaw uses raw sockets. This requires root or CAP_NET_RAW.
+	ModeRaw = Mode(conn.ModeRaw)
+	// ModeUnprivileged uses ICMP datagram sockets. On linux these do not
+	// require root, but the group of the process must be within the
+	// net.ipv4.ping_group_range sysctl. The kernel replaces the ICMP ID on these
+	// sockets, so the reported ID is the one carried in the echo payload.
+	// ICMP error messages are not recieved on these sockets, so unreachable
+	// destinations are reported as timeouts.
+	ModeUnprivileged = Mode(conn.ModeDatagram)
+)
+
+// SocketOption configures a Socket created with NewSocket
+type SocketOption func(*socketConf)
+
+type socketConf struct {
+	mode  Mode
+	leaks func(*LeakedConn)
+}
+
+// WithMode sets the Mode of a Socket. The default is ModeAuto.
+func WithMode(m Mode) SocketOption {
+	return func(c *socketConf) { c.mode = m }
 }
 
 // NewSocket returns a new Socket
-func NewSocket() *Socket {
+func NewSocket(opts ...SocketOption) *Socket {
+	c := &socketConf{mode: ModeAuto}
+	for _, o := range opts {
+		o(c)
+	}
 	s := &Socket{
-		s: socket.New(),
+		s:     socket.New(conn.Mode(c.mode)),
+		sched: newScheduler(),
+		leaks: newLeakTracker(c.leaks),
+		done:  make(chan struct{}),
 	}
 	return s
 }
 
-// SetWorkers sets a number of workers to process incoming packets and run handlers
+// NewSocketContext returns a new Socket that is closed when ctx is done.
+// Pings still pending then are handled with ErrSocketClosed.
+func NewSocketContext(ctx context.Context, opts ...SocketOption) *Socket {
+	s := NewSocket(opts...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close(ctx)
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// ErrSocketClosed is returned when using a closed socket.
+// Pings still pending when a socket is closed are handled with it.
+var ErrSocketClosed = socket.ErrClosed
+
+// Close closes the socket.
 //
-// Consider increasing this if your handlers take a long time to return.
+// Connections can no longer be opened, and pings sent are handled with ErrSocketClosed
+// on the goroutine sending them, outside the handler workers.
+// Interval and flood pings on the socket stop, returning ErrSocketClosed. Pings still
+// pending are waited for until ctx is done, then they are handled with ErrSocketClosed
+// and ctx.Err() is returned. The operating system sockets are closed, and Close waits for
+// every goroutine of the socket to exit, including running handlers. Close must not be
+// called from a handler.
 //
-// A higher number of workers will prevent dropping replies, at the cost of more memory and cpu usage.
+// Closing the default socket replaces it, DefaultSocket returns a new socket after.
+// Closing a socket more than once returns ErrSocketClosed.
+func (s *Socket) Close(ctx context.Context) error {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		close(s.done)
+	})
+	if !first {
+		return ErrSocketClosed
+	}
+	dSocketLock.Lock()
+	if dSocket == s {
+		dSocket = nil
+	}
+	dSocketLock.Unlock()
+	err := s.s.Close(ctx)
+	s.leaks.closed()
+	return err
+}
+
+// context returns a context that is done when ctx is done or the socket is closed
+func (s *Socket) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// closedErr returns ErrSocketClosed if the socket is closed, otherwise err
+func (s *Socket) closedErr(err error) error {
+	select {
+	case <-s.done:
+		return ErrSocketClosed
+	default:
+	}
+	return err
+}
+
+// SocketStats is a snapshot of the internal state of a Socket
+type SocketStats = socket.Stats
+
+// SocketFamilyStats are the statistics for one address family of a Socket
+type SocketFamilyStats = socket.FamilyStats
+
+// Stats returns a snapshot of the internal state of the socket.
 //
-// This change will only take effect once all open connections are closed
+// Along with the current endpoints, pending pings and timeouts, it counts the packets
+// read and sent, the packets that failed to parse and the replies that matched no
+// pending ping. Comparing these with the results handled tells loss on the network
+// apart from replies dropped by the socket.
+//
+// It is safe to call while pings are running.
+func (s *Socket) Stats() *SocketStats {
+	return s.s.Stats()
+}
+
+// SetWorkers sets a number of workers to read and match incoming packets, for each
+// of ipv4 and ipv6. The default is one.
+//
+// Handlers do not run on these workers, see SetHandlerWorkers. More workers
+// can help when replies arrive faster than one worker can parse them.
+//
+// Workers are started or stopped on open connections. A stopped worker exits once
+// the replies it has read are matched. With SetWorkerScaling the number of workers
+// is scaled from n.
 func (s *Socket) SetWorkers(n int) {
-	s.s.Workers = n
+	s.s.SetWorkers(n)
+}
+
+// SetWorkerScaling scales the number of workers reading replies between min and max.
+// Setting max to zero disables scaling, which is the default.
+//
+// Once a second a worker is added if the kernel dropped replies because the receive
+// buffer was full, or if most reads found more replies waiting than fit in one batch.
+// A worker is stopped if neither happened. The number of workers is in
+// SocketFamilyStats.Workers. Dropped replies and batches are only reported on linux,
+// on other platforms the workers are kept at min.
+func (s *Socket) SetWorkerScaling(min, max int) {
+	s.s.SetWorkerScaling(min, max)
+}
+
+// QueuePolicy is what is done with a reply that is matched while the handler queue is full
+type QueuePolicy = dispatch.Policy
+
+const (
+	// QueueBlock waits for room in the queue. The workers reading replies stop
+	// until a handler returns, so replies may be dropped by the kernel instead.
+	QueueBlock = dispatch.Block
+	// QueueDropOldest drops the ping that has waited longest in the queue
+	QueueDropOldest = dispatch.DropOldest
+	// QueueDropNewest drops the ping being queued
+	QueueDropNewest = dispatch.DropNewest
+)
+
+// SetHandlerWorkers sets the number of goroutines running handlers. The default is one.
+//
+// Matched replies, timeouts and errors wait in a queue for a handler worker, so a slow
+// handler does not stop replies being read. Consider increasing this if your handlers
+// take a long time to return.
+//
+// It can be changed while pings are running. When it is lowered, workers exit once
+// the handler they are running returns.
+func (s *Socket) SetHandlerWorkers(n int) {
+	s.s.SetHandlerWorkers(n)
+}
+
+// SetQueueSize sets how many pings can wait for a handler. The default is 1024.
+func (s *Socket) SetQueueSize(n int) {
+	s.s.SetQueueSize(n)
+}
+
+// SetQueuePolicy sets what is done with pings while the handler queue is full.
+// The default is QueueBlock.
+//
+// Under QueueBlock, errors for pings that could not be sent, including ErrRateLimited,
+// are dropped rather than waiting for room, so a handler sending pings can not deadlock.
+//
+// Dropped pings are not passed to any handler, they are counted in SocketStats.QueueDropped.
+// Draining a connection does not wait for its dropped pings.
+func (s *Socket) SetQueuePolicy(p QueuePolicy) {
+	s.s.SetQueuePolicy(p)
+}
+
+// SetStagger sets how pings sent on an interval to different destinations are spread across the interval.
+// The default is StaggerNone.
+//
+// This applies to IPInterval, HostInterval and Monitor targets started after it is set.
+func (s *Socket) SetStagger(st Stagger) {
+	s.sched.setStagger(st)
+}
+
+// SetScheduleRate limits the total rate of pings sent on an interval to pps packets per second.
+// Zero is unlimited.
+//
+// Pings over the rate are delayed, and skipped if they fall a whole interval behind.
+// Pings sent with a zero interval, floods and individual SendPing calls are not affected.
+func (s *Socket) SetScheduleRate(pps int) {
+	s.sched.setRate(pps)
+}
+
+// SetLateWindow sets how long pings are remembered after they time out. The default is zero.
+//
+// A reply recieved within the window is passed to the handler a second time, with Late set
+// and the true RTT, so slow replies can be told apart from lost pings.
+// Handlers that count results should check Again to avoid counting the ping twice.
+func (s *Socket) SetLateWindow(d time.Duration) {
+	s.s.SetLateWindow(d)
+}
+
+// SetSecret sets a secret that echo payloads are authenticated with. The default is none.
+//
+// Each echo request carries a MAC of its send time, ID, count and destination. Replies
+// without a valid MAC are dropped and counted in SocketStats.Unauthenticated, so
+// injected packets cannot fake reachability or RTTs. RTTs are always measured from the
+// locally recorded send time.
+//
+// ICMP errors are authenticated by the MAC in the echo request they quote. Errors that
+// quote only the first 8 bytes of the echo request, as some routers send, carry no MAC
+// and are dropped too, unless SetAcceptUnquotedErrors is set.
+//
+// Replies to pings sent before the secret changed are dropped, so it should be set before pinging.
+func (s *Socket) SetSecret(key []byte) {
+	s.s.SetKey(key)
+}
+
+// SetAcceptUnquotedErrors sets whether ICMP errors that do not quote the payload of the
+// echo request are accepted while a secret is set. The default is false.
+//
+// Such errors can not be authenticated, so a spoofed unreachable or time exceeded message
+// can fail a pending ping. Accepting them is needed to trace through routers that quote
+// only the first 8 bytes of the echo request.
+func (s *Socket) SetAcceptUnquotedErrors(accept bool) {
+	s.s.SetAcceptUnquoted(accept)
+}
+
+// SetReusePings sets whether the Ping passed to handlers is reused. The default is false.
+//
+// When set, each Ping is returned to a pool once the handler returns, so handling replies
+// does not allocate. Handlers must not keep the Ping, or its Src and Dst, after returning.
+// Copy any fields that are needed later.
+func (s *Socket) SetReusePings(reuse bool) {
+	var v int32
+	if reuse {
+		v = 1
+	}
+	atomic.StoreInt32(&s.reuse, v)
 }
 
 // SetWorkers sets the workers on the default socket
@@ -0,0 +1,139 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketClose(t *testing.T) {
+	assert := assert.New(t)
+	before := runtime.NumGoroutine()
+	s := NewSocket()
+	s.SetHandlerWorkers(2)
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+
+	replied := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		done <- s.IPInterval(context.Background(), dst, func(p *Ping, err error) {
+			select {
+			case replied <- struct{}{}:
+			default:
+			}
+		}, 0, 10*time.Millisecond, time.Second)
+	}()
+	<-replied
+
+	var l sync.Mutex
+	var errs []error
+	c, err := s.NewIPConn(dst, func(p *Ping, err error) {
+		l.Lock()
+		errs = append(errs, err)
+		l.Unlock()
+	}, time.Second)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NoError(s.Close(context.Background()))
+	assert.Equal(ErrSocketClosed, <-done)
+	assert.Equal(ErrSocketClosed, s.Close(context.Background()))
+
+	_, err = s.NewIPConn(dst, func(*Ping, error) {}, time.Second)
+	assert.Equal(ErrSocketClosed, err)
+	c.SendPing()
+	l.Lock()
+	assert.Equal([]error{ErrSocketClosed}, errs)
+	l.Unlock()
+	assert.NoError(c.Close())
+
+	// Eventually would count its own goroutine
+	for end := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(runtime.NumGoroutine(), before, "goroutines left running after close")
+}
+
+func TestCloseDefaultSocket(t *testing.T) {
+	assert := assert.New(t)
+	s := DefaultSocket()
+	assert.NoError(s.Close(context.Background()))
+	assert.NotEqual(s, DefaultSocket())
+	_, err := IPOnce(&net.IPAddr{IP: net.ParseIP("127.0.0.1")}, time.Second)
+	assert.NoError(err)
+}
+
+func TestNewSocketContext(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSocketContext(ctx)
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	_, err := s.IPOnce(dst, time.Second)
+	assert.NoError(err)
+
+	cancel()
+	assert.Eventually(func() bool {
+		_, err := s.NewIPConn(dst, func(*Ping, error) {}, time.Second)
+		return err == ErrSocketClosed
+	}, time.Second, time.Millisecond)
+}
+
+func TestLeakDetection(t *testing.T) {
+	assert := assert.New(t)
+	leaks := make(chan *LeakedConn, 2)
+	s := NewSocket(WithLeakDetection(func(lc *LeakedConn) { leaks <- lc }))
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	open := func() *IPConn {
+		c, err := s.NewIPConn(dst, func(*Ping, error) {}, time.Second)
+		assert.NoError(err)
+		return c
+	}
+	closed := open()
+	assert.NoError(closed.Close())
+	open()
+	kept := open()
+
+	var lc *LeakedConn
+	assert.Eventually(func() bool {
+		runtime.GC()
+		select {
+		case lc = <-leaks:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond, "dropped connection was not reported")
+	if lc != nil {
+		assert.True(lc.Collected)
+		assert.True(strings.Contains(lc.Stack, "TestLeakDetection"), lc.Stack)
+		assert.NotEqual(kept.ID(), lc.ID)
+	}
+	assert.Equal(1, s.Stats().V4.Endpoints, "the dropped connection is closed")
+
+	// connections of interval pings are closed by the socket, they are not reported
+	interval := make(chan error, 1)
+	go func() {
+		interval <- s.IPInterval(context.Background(), dst, func(*Ping, error) {}, 0, 10*time.Millisecond, time.Second)
+	}()
+	assert.Eventually(func() bool { return s.Stats().V4.Endpoints == 2 }, time.Second, time.Millisecond)
+
+	assert.NoError(s.Close(context.Background()))
+	assert.Equal(ErrSocketClosed, <-interval)
+	select {
+	case lc = <-leaks:
+		assert.False(lc.Collected)
+		assert.Equal(kept.ID(), lc.ID)
+	default:
+		t.Error("open connection was not reported on close")
+	}
+	assert.Empty(leaks)
+}
@@ -0,0 +1,318 @@
+package ping
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rttAcc accumulates round trip times
+type rttAcc struct {
+	n              int
+	sum, sumSq     float64
+	min, max, last time.Duration
+}
+
+func (a *rttAcc) add(rtt time.Duration) {
+	if a.n == 0 || rtt < a.min {
+		a.min = rtt
+	}
+	if rtt > a.max {
+		a.max = rtt
+	}
+	a.last = rtt
+	a.sum += float64(rtt)
+	a.sumSq += float64(rtt) * float64(rtt)
+	a.n++
+}
+
+func (a *rttAcc) avg() time.Duration {
+	if a.n == 0 {
+		return 0
+	}
+	return time.Duration(a.sum / float64(a.n))
+}
+
+func (a *rttAcc) stdDev() time.Duration {
+	if a.n == 0 {
+		return 0
+	}
+	avg := a.sum / float64(a.n)
+	return time.Duration(math.Sqrt(math.Max(a.sumSq/float64(a.n)-avg*avg, 0)))
+}
+
+// jitterAcc is the RFC 3550 interarrival jitter estimate.
+// For pings the difference in transit time between two replies is the difference in their RTT.
+type jitterAcc struct {
+	j    float64
+	prev time.Duration
+	ok   bool
+}
+
+func (a *jitterAcc) add(rtt time.Duration) {
+	if a.ok {
+		a.j += (math.Abs(float64(rtt-a.prev)) - a.j) / 16
+	}
+	a.prev, a.ok = rtt, true
+}
+
+func (a *jitterAcc) jitter() time.Duration {
+	return time.Duration(a.j)
+}
+
+// StatsSummary holds the statistics for a destination over a window
+type StatsSummary struct {
+	// Window is the duration the statistics cover, zero for the lifetime of the Stats
+	Window time.Duration
+	// Sent is the number of pings that have been handled
+	Sent int
+	// Recieved is the number of pings that were replied to
+	Recieved int
+	// Lost is the number of pings that timed out
+	Lost int
+	// Errors is the number of pings that were handled with an error other than ErrTimedOut
+	Errors int
+	// Late is the number of lost pings that later got a reply within the late window of the socket.
+	// They are still counted as lost.
+	Late int
+	// Duplicates is the number of duplicate replies
+	Duplicates int
+	// OutOfOrder is the number of replies recieved after the reply to a later ping
+	OutOfOrder int
+	// Min, Avg and Max are the minimum, average and maximum RTT of replies
+	Min, Avg, Max time.Duration
+	// StdDev is the standard deviation of the RTT of replies
+	StdDev time.Duration
+	// Jitter is the RFC 3550 interarrival jitter of replies
+	Jitter time.Duration
+}
+
+// Loss returns the fraction of pings that timed out or errored
+func (s *StatsSummary) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Recieved) / float64(s.Sent)
+}
+
+type statsSample struct {
+	sent       time.Time
+	rtt        time.Duration
+	err        error
+	late       bool
+	duplicate  bool
+	outOfOrder bool
+}
+
+type summaryAcc struct {
+	s   StatsSummary
+	rtt rttAcc
+	j   jitterAcc
+}
+
+func (a *summaryAcc) add(s *statsSample) {
+	switch {
+	case s.late:
+		a.s.Late++
+		return
+	case s.duplicate:
+		a.s.Duplicates++
+		return
+	case s.outOfOrder:
+		a.s.OutOfOrder++
+	}
+	a.s.Sent++
+	switch s.err {
+	case nil:
+		a.s.Recieved++
+		a.rtt.add(s.rtt)
+		a.j.add(s.rtt)
+	case ErrTimedOut:
+		a.s.Lost++
+	default:
+		a.s.Errors++
+	}
+}
+
+func (a *summaryAcc) summary() *StatsSummary {
+	s := a.s
+	s.Min, s.Avg, s.Max, s.StdDev, s.Jitter = a.rtt.min, a.rtt.avg(), a.rtt.max, a.rtt.stdDev(), a.j.jitter()
+	return &s
+}
+
+type dstStats struct {
+	lifetime summaryAcc
+	// samples are kept in the order they were sent for as long as the longest window
+	samples []statsSample
+	// last is when a ping to the destination was last handled
+	last time.Time
+}
+
+// add adds sm to the samples sent within maxWindow of now
+func (d *dstStats) add(sm statsSample, now time.Time, maxWindow time.Duration) {
+	cutoff := now.Add(-maxWindow)
+	i := sort.Search(len(d.samples), func(i int) bool { return !d.samples[i].sent.Before(cutoff) })
+	d.samples = d.samples[i:]
+	if sm.sent.Before(cutoff) {
+		// a late reply to a ping sent before the window
+		return
+	}
+	// replies are mostly handled in the order they were sent, late and out of order ones are inserted
+	i = sort.Search(len(d.samples), func(i int) bool { return d.samples[i].sent.After(sm.sent) })
+	d.samples = append(d.samples, statsSample{})
+	copy(d.samples[i+1:], d.samples[i:])
+	d.samples[i] = sm
+}
+
+// Stats keeps per destination ping statistics, over the lifetime of the Stats and
+// over sliding windows.
+//
+// Destinations are keyed by the host for pings sent via a HostConn, and the
+// destination IP otherwise.
+//
+// Stats is safe to read while handlers are running on multiple workers.
+//
+// Destinations are kept until they are removed with Remove, or until they are idle
+// if SetIdleTimeout is set.
+type Stats struct {
+	l         sync.Mutex
+	windows   []time.Duration
+	maxWindow time.Duration
+	dsts      map[string]*dstStats
+	idle      time.Duration
+	nextEvict time.Time
+}
+
+// NewStats creates a new Stats, keeping sliding statistics for each of windows
+func NewStats(windows ...time.Duration) *Stats {
+	s := &Stats{
+		dsts: make(map[string]*dstStats),
+	}
+	for _, w := range windows {
+		if w <= 0 {
+			continue
+		}
+		s.windows = append(s.windows, w)
+		if w > s.maxWindow {
+			s.maxWindow = w
+		}
+	}
+	return s
+}
+
+func statsKey(p *Ping) string {
+	if p.Host != "" {
+		return p.Host
+	}
+	if p.Dst != nil {
+		return p.Dst.IP.String()
+	}
+	return ""
+}
+
+// SetIdleTimeout sets how long a destination is kept after its last ping was handled.
+// Zero, the default, keeps destinations until they are removed.
+func (s *Stats) SetIdleTimeout(d time.Duration) {
+	s.l.Lock()
+	s.idle, s.nextEvict = d, time.Time{}
+	s.l.Unlock()
+}
+
+// Remove deletes the statistics for dst, such as once it is no longer pinged
+func (s *Stats) Remove(dst string) {
+	s.l.Lock()
+	delete(s.dsts, dst)
+	s.l.Unlock()
+}
+
+// evict removes the destinations idle for longer than the idle timeout.
+// They are checked at most once each timeout, it is called with the lock held.
+func (s *Stats) evict(now time.Time) {
+	if s.idle <= 0 || now.Before(s.nextEvict) {
+		return
+	}
+	s.nextEvict = now.Add(s.idle)
+	for k, d := range s.dsts {
+		if now.Sub(d.last) > s.idle {
+			delete(s.dsts, k)
+		}
+	}
+}
+
+// Handle records a ping. It can be used directly as a HandleFunc.
+func (s *Stats) Handle(p *Ping, err error) {
+	if p == nil {
+		return
+	}
+	k := statsKey(p)
+	sm := statsSample{
+		sent:       p.Sent,
+		rtt:        p.RTT(),
+		err:        err,
+		late:       p.Late,
+		duplicate:  p.Duplicate,
+		outOfOrder: p.OutOfOrder,
+	}
+	now := time.Now()
+	s.l.Lock()
+	s.evict(now)
+	d, ok := s.dsts[k]
+	if !ok {
+		d = &dstStats{}
+		s.dsts[k] = d
+	}
+	d.last = now
+	d.lifetime.add(&sm)
+	if s.maxWindow > 0 {
+		d.add(sm, now, s.maxWindow)
+	}
+	s.l.Unlock()
+}
+
+// Wrap returns a HandleFunc that records each ping before passing it on to h
+func (s *Stats) Wrap(h HandleFunc) HandleFunc {
+	return func(p *Ping, err error) {
+		s.Handle(p, err)
+		h(p, err)
+	}
+}
+
+// Destinations returns the destinations that have statistics, sorted
+func (s *Stats) Destinations() []string {
+	s.l.Lock()
+	s.evict(time.Now())
+	r := make([]string, 0, len(s.dsts))
+	for k := range s.dsts {
+		r = append(r, k)
+	}
+	s.l.Unlock()
+	sort.Strings(r)
+	return r
+}
+
+// Summary returns the statistics for dst. The first summary covers the lifetime of the Stats,
+// it is followed by a summary for each window in the order they were passed to NewStats.
+//
+// Nil is returned if there are no statistics for dst.
+func (s *Stats) Summary(dst string) []*StatsSummary {
+	s.l.Lock()
+	defer s.l.Unlock()
+	d, ok := s.dsts[dst]
+	if !ok {
+		return nil
+	}
+	r := []*StatsSummary{d.lifetime.summary()}
+	now := time.Now()
+	for _, w := range s.windows {
+		a := &summaryAcc{s: StatsSummary{Window: w}}
+		cutoff := now.Add(-w)
+		for i := range d.samples {
+			if !d.samples[i].sent.Before(cutoff) {
+				a.add(&d.samples[i])
+			}
+		}
+		r = append(r, a.summary())
+	}
+	return r
+}
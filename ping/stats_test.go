@@ -0,0 +1,172 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+	"github.com/stretchr/testify/assert"
+)
+
+func statsPing(host string, sent time.Time, rtt time.Duration) *Ping {
+	return &Ping{Host: host, Sent: sent, Recieved: sent.Add(rtt)}
+}
+
+func TestStatsSummary(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStats(time.Minute)
+	now := time.Now()
+	old := now.Add(-2 * time.Minute)
+	s.Handle(statsPing("a", old, 100*time.Millisecond), nil)
+	s.Handle(statsPing("a", now, 10*time.Millisecond), nil)
+	s.Handle(statsPing("a", now, 30*time.Millisecond), nil)
+	s.Handle(&Ping{Host: "a", Sent: now}, ErrTimedOut)
+	s.Handle(&Ping{Host: "a", Sent: now, Recieved: now.Add(2 * time.Second), Late: true}, nil)
+	s.Handle(&Ping{Host: "a", Sent: now}, errors.New("send failed"))
+	s.Handle(&Ping{Dst: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, Sent: now}, ErrTimedOut)
+
+	assert.Equal([]string{"192.0.2.1", "a"}, s.Destinations())
+	assert.Nil(s.Summary("b"))
+
+	sm := s.Summary("a")
+	if !assert.Len(sm, 2) {
+		return
+	}
+	lt, w := sm[0], sm[1]
+	assert.Zero(lt.Window)
+	assert.Equal(5, lt.Sent)
+	assert.Equal(3, lt.Recieved)
+	assert.Equal(1, lt.Lost)
+	assert.Equal(1, lt.Errors)
+	assert.Equal(1, lt.Late)
+	assert.Equal(0.4, lt.Loss())
+	assert.Equal(10*time.Millisecond, lt.Min)
+	assert.Equal(100*time.Millisecond, lt.Max)
+	assert.Equal(140*time.Millisecond/3, lt.Avg)
+	// (90/16) then (20-90/16)/16 added
+	assert.InDelta(float64(90*time.Millisecond)/16+(float64(20*time.Millisecond)-float64(90*time.Millisecond)/16)/16, float64(lt.Jitter), 1)
+
+	assert.Equal(time.Minute, w.Window)
+	assert.Equal(4, w.Sent)
+	assert.Equal(2, w.Recieved)
+	assert.Equal(10*time.Millisecond, w.Min)
+	assert.Equal(30*time.Millisecond, w.Max)
+	assert.Equal(20*time.Millisecond, w.Avg)
+	assert.Equal(10*time.Millisecond, w.StdDev)
+	assert.Equal(0.5, w.Loss())
+}
+
+func TestStatsDuplicateOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStats(time.Minute)
+	now := time.Now()
+	s.Handle(statsPing("a", now, 10*time.Millisecond), nil)
+	dup := statsPing("a", now, 20*time.Millisecond)
+	dup.Duplicate = true
+	s.Handle(dup, nil)
+	ooo := statsPing("a", now, 30*time.Millisecond)
+	ooo.OutOfOrder = true
+	s.Handle(ooo, nil)
+
+	for _, sm := range s.Summary("a") {
+		assert.Equal(2, sm.Sent)
+		assert.Equal(2, sm.Recieved)
+		assert.Equal(1, sm.Duplicates)
+		assert.Equal(1, sm.OutOfOrder)
+		assert.Equal(30*time.Millisecond, sm.Max)
+	}
+}
+
+func TestStatsWindowOrder(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStats(time.Minute)
+	now := time.Now()
+	s.Handle(statsPing("a", now.Add(-50*time.Second), time.Millisecond), nil)
+	s.Handle(statsPing("a", now, time.Millisecond), nil)
+	// handled after later pings, they are kept in the order they were sent
+	s.Handle(statsPing("a", now.Add(-10*time.Second), time.Millisecond), nil)
+	s.Handle(&Ping{Host: "a", Sent: now.Add(-2 * time.Minute), Late: true}, nil)
+
+	var sent []time.Time
+	for _, sm := range s.dsts["a"].samples {
+		sent = append(sent, sm.sent)
+	}
+	assert.Equal([]time.Time{now.Add(-50 * time.Second), now.Add(-10 * time.Second), now}, sent)
+
+	// a sample sent before the window is trimmed even though it was handled last
+	d := s.dsts["a"]
+	d.add(statsSample{sent: now.Add(-5 * time.Second)}, now.Add(45*time.Second), time.Minute)
+	if assert.Len(d.samples, 3) {
+		assert.Equal(now.Add(-10*time.Second), d.samples[0].sent)
+		assert.Equal(now.Add(-5*time.Second), d.samples[1].sent)
+	}
+}
+
+func TestStatsEvict(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStats(time.Minute)
+	now := time.Now()
+	s.Handle(statsPing("a", now, time.Millisecond), nil)
+	s.Handle(statsPing("b", now, time.Millisecond), nil)
+	s.Remove("a")
+	assert.Equal([]string{"b"}, s.Destinations())
+
+	s.SetIdleTimeout(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Handle(statsPing("c", now, time.Millisecond), nil)
+	assert.Equal([]string{"c"}, s.Destinations())
+}
+
+func TestConnStats(t *testing.T) {
+	assert := assert.New(t)
+	var c connCounters
+	h := c.wrap(func(*ping.Ping, error) {})
+	h(&ping.Ping{}, nil)
+	h(&ping.Ping{OutOfOrder: true}, nil)
+	h(&ping.Ping{Duplicate: true}, nil)
+	h(&ping.Ping{}, ErrTimedOut)
+	h(&ping.Ping{Late: true}, nil)
+	h(&ping.Ping{}, errors.New("send failed"))
+	assert.Equal(&ConnStats{Recieved: 2, TimedOut: 1, Errors: 1, Late: 1, Duplicates: 1, OutOfOrder: 1}, c.stats())
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	s := NewStats(time.Second)
+	var hc int64
+	var l sync.Mutex
+	h := s.Wrap(func(*Ping, error) {
+		l.Lock()
+		hc++
+		l.Unlock()
+	})
+	dst, err := net.ResolveIPAddr("ip", "127.0.0.1")
+	assert.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, d := range s.Destinations() {
+				s.Summary(d)
+			}
+		}
+	}()
+	assert.NoError(IPInterval(ctx, dst, h, 100, 0, time.Second))
+	close(done)
+	assert.Equal(int64(100), hc)
+	sm := s.Summary("127.0.0.1")
+	if assert.Len(sm, 2) {
+		assert.Equal(100, sm[0].Sent)
+		assert.Equal(100, sm[1].Sent)
+	}
+}
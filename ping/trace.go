@@ -0,0 +1,236 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/TrilliumIT/go-multiping/ping/internal/ping"
+)
+
+// TraceOptions configures a trace
+type TraceOptions struct {
+	// MaxHops is the highest ttl or hop limit that will be probed
+	MaxHops int
+	// Probes is the number of probes sent to each hop
+	Probes int
+	// Timeout is how long to wait for a response to each probe
+	Timeout time.Duration
+	// Interval is the delay between each round of probes. Each round sends one probe to every hop.
+	Interval time.Duration
+}
+
+// DefaultTraceOptions returns the options used for any unset fields in the options passed to Trace
+func DefaultTraceOptions() *TraceOptions {
+	return &TraceOptions{
+		MaxHops: 30,
+		Probes:  3,
+		Timeout: time.Second,
+	}
+}
+
+// TraceProbe is the result of a single probe sent to a hop
+type TraceProbe struct {
+	// From is the address that responded to the probe. It is nil if the probe was lost.
+	From *net.IPAddr
+	// RTT is the round trip time of the probe
+	RTT time.Duration
+	// Err is the error the probe was handled with.
+	// Probes answered by a router have a *TimeExceededError, probes that reached the
+	// destination have a nil error and lost probes have ErrTimedOut. Probes that could
+	// not be sent with their ttl have ErrTTLNotSupported.
+	Err error
+}
+
+// Lost returns true if no response was recieved for this probe
+func (p *TraceProbe) Lost() bool {
+	return p.From == nil
+}
+
+func newTraceProbe(p *ping.Ping, err error) *TraceProbe {
+	tp := &TraceProbe{Err: err}
+	switch e := err.(type) {
+	case nil:
+		tp.From = p.Dst
+	case *TimeExceededError:
+		tp.From = e.From
+	case *UnreachableError:
+		tp.From = e.From
+	case *ParameterProblemError:
+		tp.From = e.From
+	default:
+		return tp
+	}
+	tp.RTT = p.RTT()
+	return tp
+}
+
+// terminal returns true if the probe got a response that was not time exceeded,
+// so probes with a higher ttl will not get any further
+func (p *TraceProbe) terminal() bool {
+	if p == nil || p.Lost() {
+		return false
+	}
+	_, ok := p.Err.(*TimeExceededError)
+	return !ok
+}
+
+// Hop is the results of the probes sent to a single ttl or hop limit
+type Hop struct {
+	// TTL is the ttl or hop limit the probes were sent with
+	TTL int
+	// Probes holds the result of each probe in the order they were sent
+	Probes []*TraceProbe
+}
+
+// Responders returns the unique addresses that responded to probes for this hop.
+//
+// More than one responder indicates load balancing or a path change during the trace.
+func (h *Hop) Responders() []*net.IPAddr {
+	var r []*net.IPAddr
+probes:
+	for _, p := range h.Probes {
+		if p == nil || p.Lost() {
+			continue
+		}
+		for _, a := range r {
+			if a.IP.Equal(p.From.IP) {
+				continue probes
+			}
+		}
+		r = append(r, p.From)
+	}
+	return r
+}
+
+// Loss returns the fraction of probes to this hop that were lost
+func (h *Hop) Loss() float64 {
+	if len(h.Probes) == 0 {
+		return 0
+	}
+	var l int
+	for _, p := range h.Probes {
+		if p == nil || p.Lost() {
+			l++
+		}
+	}
+	return float64(l) / float64(len(h.Probes))
+}
+
+// TraceResult holds the results of a trace
+type TraceResult struct {
+	// Host is the host that was traced
+	Host string
+	// Dst is the resolved destination address
+	Dst *net.IPAddr
+	// Hops holds a hop for each ttl, starting at one, up to the destination or MaxHops
+	Hops []*Hop
+	// Reached is true if an echo reply was recieved from the destination
+	Reached bool
+}
+
+// Trace performs Trace on the default socket.
+func Trace(ctx context.Context, host string, opts *TraceOptions) (*TraceResult, error) {
+	return DefaultSocket().Trace(ctx, host, opts)
+}
+
+// Trace discovers the path to host by sending echo requests with increasing ttl or hop limit,
+// and recording the routers that respond with time exceeded.
+//
+// Probes are sent in rounds, each round sends one probe to every hop and waits for them
+// to be handled. Once a response from the destination is recieved, later rounds
+// only probe up to the destination. Canceling ctx stops sending further rounds.
+//
+// Traces use an ICMP ID from the socket like any other connection, so many traces and pings
+// can be run on the same socket concurrently.
+// Routers only send time exceeded messages to raw sockets, on a socket using
+// ModeUnprivileged only the destination will respond.
+//
+// Setting the ttl of each ipv4 probe is only supported on linux. On other platforms
+// every probe of an ipv4 trace fails with ErrTTLNotSupported.
+func (s *Socket) Trace(ctx context.Context, host string, opts *TraceOptions) (*TraceResult, error) {
+	o := DefaultTraceOptions()
+	if opts != nil {
+		if opts.MaxHops > 0 {
+			o.MaxHops = opts.MaxHops
+		}
+		if opts.Probes > 0 {
+			o.Probes = opts.Probes
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+		o.Interval = opts.Interval
+	}
+
+	dst, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TraceResult{Host: host, Dst: dst, Hops: make([]*Hop, o.MaxHops)}
+	for i := range r.Hops {
+		r.Hops[i] = &Hop{TTL: i + 1, Probes: make([]*TraceProbe, o.Probes)}
+	}
+
+	// Each probe is only ever written by the handler for that probe, so no locking is required.
+	// Count is round*MaxHops + ttl-1
+	h := func(p *ping.Ping, err error) {
+		if p.Again() {
+			return
+		}
+		r.Hops[p.SendTTL-1].Probes[p.Count/o.MaxHops] = newTraceProbe(p, err)
+	}
+	ipc, err := s.newipConn(dst, h, o.Timeout, payload{})
+	if err != nil {
+		return nil, err
+	}
+
+	maxTTL := o.MaxHops
+	round := 0
+	for ; round < o.Probes; round++ {
+		if round > 0 && o.Interval > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(o.Interval):
+			}
+		}
+		if ctxDone(ctx) {
+			break
+		}
+		for ttl := 1; ttl <= maxTTL; ttl++ {
+			ipc.sendPing(&ping.Ping{
+				Host:    host,
+				Count:   round*o.MaxHops + ttl - 1,
+				Sent:    time.Now(),
+				SendTTL: ttl,
+			})
+		}
+		ipc.drain()
+		maxTTL = r.lastHop(maxTTL)
+	}
+
+	// drop any rounds that were not sent because ctx was canceled
+	r.Hops = r.Hops[:maxTTL]
+	for _, h := range r.Hops {
+		h.Probes = h.Probes[:round]
+	}
+	for _, p := range r.Hops[maxTTL-1].Probes {
+		if p != nil && !p.Lost() && p.Err == nil {
+			r.Reached = true
+		}
+	}
+	return r, ipc.close()
+}
+
+// lastHop returns the lowest ttl, up to max, with a probe that got a terminal response
+func (r *TraceResult) lastHop(max int) int {
+	for _, h := range r.Hops[:max] {
+		for _, p := range h.Probes {
+			if p.terminal() {
+				return h.TTL
+			}
+		}
+	}
+	return max
+}
@@ -0,0 +1,70 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTraceLocal(host string) func(*testing.T) {
+	return func(t *testing.T) {
+		assert := assert.New(t)
+		r, err := Trace(context.Background(), host, &TraceOptions{Probes: 2, Timeout: time.Second})
+		assert.NoError(err)
+		if !assert.NotNil(r) {
+			return
+		}
+		assert.True(r.Reached)
+		if !assert.Len(r.Hops, 1) {
+			return
+		}
+		h := r.Hops[0]
+		assert.Equal(1, h.TTL)
+		assert.Len(h.Probes, 2)
+		assert.Zero(h.Loss())
+		if assert.Len(h.Responders(), 1) {
+			assert.True(r.Dst.IP.Equal(h.Responders()[0].IP))
+		}
+		for _, p := range h.Probes {
+			assert.NoError(p.Err)
+			assert.NotZero(p.RTT)
+		}
+	}
+}
+
+func TestTraceLocal(t *testing.T) {
+	t.Run("v4", testTraceLocal("127.0.0.1"))
+	t.Run("v6", testTraceLocal("::1"))
+}
+
+func TestTraceCanceled(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err := Trace(ctx, "127.0.0.1", nil)
+	assert.NoError(err)
+	if assert.NotNil(r) {
+		assert.False(r.Reached)
+		assert.Len(r.Hops, DefaultTraceOptions().MaxHops)
+		assert.Len(r.Hops[0].Probes, 0)
+	}
+}
+
+func TestHopStats(t *testing.T) {
+	assert := assert.New(t)
+	a, b := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, &net.IPAddr{IP: net.ParseIP("192.0.2.2")}
+	h := &Hop{TTL: 3, Probes: []*TraceProbe{
+		{From: a, Err: &TimeExceededError{From: a}},
+		{Err: ErrTimedOut},
+		{From: b, Err: &TimeExceededError{From: b}},
+		{From: a, Err: &TimeExceededError{From: a}},
+	}}
+	assert.Equal(0.25, h.Loss())
+	assert.Len(h.Responders(), 2)
+	assert.False(h.Probes[0].terminal())
+	assert.True((&TraceProbe{From: a}).terminal())
+	assert.True((&TraceProbe{From: a, Err: &UnreachableError{From: a}}).terminal())
+}